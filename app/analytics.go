@@ -0,0 +1,333 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"git.mills.io/prologic/tube/media"
+)
+
+// maxAnalyticsDays limits the date range of an analytics report.
+const maxAnalyticsDays = 366
+
+// dayViews is the no. of views on a single day.
+type dayViews struct {
+	Day   string `json:"day"`
+	Views int64  `json:"views"`
+	// Height is Views relative to the busiest day of the series (0-100)
+	// and used for drawing charts.
+	Height int `json:"-"`
+}
+
+// countItem is a single entry of a distribution (e.g. referrers).
+type countItem struct {
+	Key     string  `json:"key"`
+	Count   int64   `json:"count"`
+	Percent float64 `json:"percent"`
+}
+
+// videoReport holds the analytics of a single video.
+type videoReport struct {
+	ID           string      `json:"id"`
+	Title        string      `json:"title"`
+	Collection   string      `json:"collection"`
+	Views        int64       `json:"views"`
+	Daily        []dayViews  `json:"daily"`
+	Plays        int64       `json:"plays"`
+	WatchThrough float64     `json:"watch_through"`
+	Referrers    []countItem `json:"referrers"`
+	Qualities    []countItem `json:"qualities"`
+}
+
+// collectionReport holds the analytics of a library path (collection).
+type collectionReport struct {
+	Path   string     `json:"path"`
+	Prefix string     `json:"prefix"`
+	Views  int64      `json:"views"`
+	Daily  []dayViews `json:"daily"`
+}
+
+// analyticsReport holds the analytics of the whole library for a date range.
+type analyticsReport struct {
+	From         string              `json:"from"`
+	To           string              `json:"to"`
+	Views        int64               `json:"views"`
+	Plays        int64               `json:"plays"`
+	WatchThrough float64             `json:"watch_through"`
+	Daily        []dayViews          `json:"daily"`
+	Videos       []*videoReport      `json:"videos"`
+	Collections  []*collectionReport `json:"collections"`
+	Referrers    []countItem         `json:"referrers"`
+	Qualities    []countItem         `json:"qualities"`
+}
+
+// parseDateRange parses the from and to query parameters of r, defaulting
+// to the last 30 days.
+func parseDateRange(r *http.Request) (time.Time, time.Time, error) {
+	to := time.Now()
+	if s := r.URL.Query().Get("to"); s != "" {
+		t, err := time.ParseInLocation(dayFormat, s, time.Local)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid date for to: %s", s)
+		}
+		to = t
+	}
+	from := to.AddDate(0, 0, -29)
+	if s := r.URL.Query().Get("from"); s != "" {
+		t, err := time.ParseInLocation(dayFormat, s, time.Local)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid date for from: %s", s)
+		}
+		from = t
+	}
+	if from.After(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("from %s is after to %s", from.Format(dayFormat), to.Format(dayFormat))
+	}
+	if to.Sub(from) > maxAnalyticsDays*24*time.Hour {
+		return time.Time{}, time.Time{}, fmt.Errorf("date range exceeds %d days", maxAnalyticsDays)
+	}
+	return from, to, nil
+}
+
+// days returns all days from from to to (inclusive) formatted as dayFormat.
+func days(from, to time.Time) []string {
+	var ds []string
+	last := to.Format(dayFormat)
+	for d := from; ; d = d.AddDate(0, 0, 1) {
+		ds = append(ds, d.Format(dayFormat))
+		if d.Format(dayFormat) == last {
+			return ds
+		}
+	}
+}
+
+// dailySeries returns the views for each of ds from daily as well as the total.
+func dailySeries(ds []string, daily map[string]int64) ([]dayViews, int64) {
+	var (
+		total int64
+		max   int64
+	)
+	series := make([]dayViews, len(ds))
+	for i, d := range ds {
+		series[i] = dayViews{Day: d, Views: daily[d]}
+		total += daily[d]
+		if daily[d] > max {
+			max = daily[d]
+		}
+	}
+	if max > 0 {
+		for i := range series {
+			series[i].Height = int(series[i].Views * 100 / max)
+		}
+	}
+	return series, total
+}
+
+// sumStats sums the counters of stats over the days ds into sums.
+func sumStats(sums map[string]int64, ds []string, stats map[string]map[string]int64) {
+	for _, d := range ds {
+		for k, n := range stats[d] {
+			sums[k] += n
+		}
+	}
+}
+
+// distribution returns counts as countItems sorted by count.
+func distribution(counts map[string]int64) []countItem {
+	var total int64
+	for _, n := range counts {
+		total += n
+	}
+	items := make([]countItem, 0, len(counts))
+	for k, n := range counts {
+		if n == 0 {
+			continue
+		}
+		items = append(items, countItem{
+			Key:     k,
+			Count:   n,
+			Percent: float64(n) * 100 / float64(total),
+		})
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Count == items[j].Count {
+			return items[i].Key < items[j].Key
+		}
+		return items[i].Count > items[j].Count
+	})
+	return items
+}
+
+// buildAnalytics aggregates the statistics recorded in the Store for all
+// videos in the Library from from to to.
+func (a *App) buildAnalytics(from, to time.Time) (*analyticsReport, error) {
+	ds := days(from, to)
+
+	report := &analyticsReport{
+		From: from.Format(dayFormat),
+		To:   to.Format(dayFormat),
+	}
+
+	allDaily := make(map[string]int64)
+	allReferrers := make(map[string]int64)
+	allQualities := make(map[string]int64)
+	var allWatched int64
+
+	collections := make(map[string]*collectionReport)
+	collectionDaily := make(map[string]map[string]int64)
+	for _, p := range a.Library.Paths {
+		collections[p.Path] = &collectionReport{Path: p.Path, Prefix: p.Prefix}
+		collectionDaily[p.Path] = make(map[string]int64)
+	}
+
+	for _, v := range a.Library.Playlist() {
+		vr, watched, err := a.buildVideoAnalytics(v, ds)
+		if err != nil {
+			return nil, err
+		}
+		report.Videos = append(report.Videos, vr)
+
+		for _, dv := range vr.Daily {
+			allDaily[dv.Day] += dv.Views
+			if c, ok := collectionDaily[vr.Collection]; ok {
+				c[dv.Day] += dv.Views
+			}
+		}
+		for _, item := range vr.Referrers {
+			allReferrers[item.Key] += item.Count
+		}
+		for _, item := range vr.Qualities {
+			allQualities[item.Key] += item.Count
+		}
+		report.Plays += vr.Plays
+		allWatched += watched
+	}
+
+	report.Daily, report.Views = dailySeries(ds, allDaily)
+	report.Referrers = distribution(allReferrers)
+	report.Qualities = distribution(allQualities)
+	if report.Plays > 0 {
+		report.WatchThrough = float64(allWatched) / float64(report.Plays) / 1000
+	}
+
+	for path, c := range collections {
+		c.Daily, c.Views = dailySeries(ds, collectionDaily[path])
+		report.Collections = append(report.Collections, c)
+	}
+	sort.Slice(report.Collections, func(i, j int) bool {
+		return report.Collections[i].Prefix < report.Collections[j].Prefix
+	})
+
+	sort.SliceStable(report.Videos, func(i, j int) bool {
+		return report.Videos[i].Views > report.Videos[j].Views
+	})
+
+	return report, nil
+}
+
+// buildVideoAnalytics aggregates the statistics of a single video over the
+// days ds. It also returns the sum of watch-through (in 1/1000) of all plays.
+func (a *App) buildVideoAnalytics(v *media.Video, ds []string) (*videoReport, int64, error) {
+	vr := &videoReport{
+		ID:    v.ID,
+		Title: v.Title,
+	}
+	if p, ok := a.Library.PathOf(v); ok {
+		vr.Collection = p.Path
+	}
+
+	daily, err := a.Store.GetDailyViews(v.ID)
+	if err != nil {
+		return nil, 0, err
+	}
+	vr.Daily, vr.Views = dailySeries(ds, daily)
+
+	referrers := make(map[string]int64)
+	stats, err := a.Store.GetStats(v.ID, "referrers")
+	if err != nil {
+		return nil, 0, err
+	}
+	sumStats(referrers, ds, stats)
+	vr.Referrers = distribution(referrers)
+
+	qualities := make(map[string]int64)
+	stats, err = a.Store.GetStats(v.ID, "quality")
+	if err != nil {
+		return nil, 0, err
+	}
+	sumStats(qualities, ds, stats)
+	vr.Qualities = distribution(qualities)
+	for _, n := range qualities {
+		vr.Plays += n
+	}
+
+	watch := make(map[string]int64)
+	stats, err = a.Store.GetStats(v.ID, "watch")
+	if err != nil {
+		return nil, 0, err
+	}
+	sumStats(watch, ds, stats)
+	if vr.Plays > 0 {
+		vr.WatchThrough = float64(watch["permille"]) / float64(vr.Plays) / 1000
+	}
+
+	return vr, watch["permille"], nil
+}
+
+// HTTP handler for /admin/analytics
+func (a *App) analyticsHandler(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseDateRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := a.buildAnalytics(from, to)
+	if err != nil {
+		err := fmt.Errorf("error building analytics: %w", err)
+		logger(r.Context()).Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ctx := &struct {
+		Config    *Config
+		Playing   *media.Video
+		Analytics *analyticsReport
+	}{
+		Config:    a.config(),
+		Playing:   &media.Video{ID: ""},
+		Analytics: report,
+	}
+	a.render("analytics", w, ctx)
+}
+
+// HTTP handler for /api/analytics
+func (a *App) analyticsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	from, to, err := parseDateRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := a.buildAnalytics(from, to)
+	if err != nil {
+		err := fmt.Errorf("error building analytics: %w", err)
+		logger(r.Context()).Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if limit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && limit >= 0 && limit < len(report.Videos) {
+		report.Videos = report.Videos[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		logger(r.Context()).WithError(err).Error("error encoding analytics")
+	}
+}
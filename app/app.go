@@ -2,31 +2,36 @@
 package app
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"git.mills.io/prologic/tube/app/middleware"
 	"git.mills.io/prologic/tube/importers"
 	"git.mills.io/prologic/tube/media"
 	"git.mills.io/prologic/tube/static"
 	"git.mills.io/prologic/tube/templates"
+	"git.mills.io/prologic/tube/transcoder"
 	"git.mills.io/prologic/tube/utils"
 
-	"github.com/cyphar/filepath-securejoin"
 	"github.com/dustin/go-humanize"
 	"github.com/fsnotify/fsnotify"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
-	shortuuid "github.com/lithammer/shortuuid/v3"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -40,6 +45,42 @@ type App struct {
 	Feed      []byte
 	Listener  net.Listener
 	Router    *mux.Router
+
+	server  *http.Server
+	jobs    *jobRegistry
+	metrics *appMetrics
+
+	// work queues transcodes for remote workers while serving.
+	work *workQueue
+
+	// backfilling is 1 while a backfill is running.
+	backfilling int32
+
+	// redirectServer redirects plain HTTP to HTTPS, if configured.
+	redirectServer   *http.Server
+	redirectListener net.Listener
+
+	// Loader re-reads the configuration on Reload, nil disables reloading.
+	Loader func() (*Config, error)
+
+	// Transcoder probes, transcodes and thumbnails videos (ffmpeg by
+	// default), e.g: a transcoder.Fake in tests.
+	Transcoder transcoder.Transcoder
+
+	// NewImporter returns the importer of a video URL (importers.NewImporter
+	// by default), e.g: one of a local server in tests.
+	NewImporter func(url string) (importers.Importer, error)
+
+	// configMu guards Config which is swapped on Reload.
+	configMu sync.RWMutex
+	reloadMu sync.Mutex
+
+	views   *viewCounter
+	limiter *rateLimiter
+
+	// tools and readiness cache the health checks, see Health.
+	tools     toolCache
+	readiness healthCache
 }
 
 // 1MB buffer in RAM seems enough
@@ -51,8 +92,11 @@ func NewApp(cfg *Config) (*App, error) {
 		cfg = DefaultConfig()
 	}
 	a := &App{
-		Config: cfg,
+		Config:      cfg,
+		Transcoder:  transcoder.FFmpeg{},
+		NewImporter: importers.NewImporter,
 	}
+	applyLogConfig(cfg.Log)
 	// Setup Library
 	a.Library = media.NewLibrary()
 	// Setup Store
@@ -61,62 +105,63 @@ func NewApp(cfg *Config) (*App, error) {
 		err := fmt.Errorf("error opening store %s: %w", cfg.Server.StorePath, err)
 		return nil, err
 	}
-	a.Store = store
+	a.metrics = newAppMetrics()
+	a.Store = newInstrumentedStore(store, a.metrics)
+	a.views = newViewCounter(a.Store)
+	a.limiter = newRateLimiter()
+	a.jobs = newJobRegistry(a.metrics)
+	a.metrics.register(a.libraryCollectors()...)
 	// Setup Watcher
 	w, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, err
 	}
 	a.Watcher = w
-	// Setup Listener
-	ln, err := newListener(cfg.Server)
-	if err != nil {
-		return nil, err
-	}
-	a.Listener = ln
 
 	// Templates
 
 	a.Templates = newTemplateStore("base")
-
-	templateFuncs := map[string]interface{}{
-		"bytes": func(size int64) string { return humanize.Bytes(uint64(size)) },
-	}
-
-	indexTemplate := template.New("index").Funcs(templateFuncs)
-	template.Must(indexTemplate.Parse(templates.MustGetTemplate("index.html")))
-	template.Must(indexTemplate.Parse(templates.MustGetTemplate("base.html")))
-	a.Templates.Add("index", indexTemplate)
-
-	uploadTemplate := template.New("upload").Funcs(templateFuncs)
-	template.Must(uploadTemplate.Parse(templates.MustGetTemplate("upload.html")))
-	template.Must(uploadTemplate.Parse(templates.MustGetTemplate("base.html")))
-	a.Templates.Add("upload", uploadTemplate)
-
-	importTemplate := template.New("import").Funcs(templateFuncs)
-	template.Must(importTemplate.Parse(templates.MustGetTemplate("import.html")))
-	template.Must(importTemplate.Parse(templates.MustGetTemplate("base.html")))
-	a.Templates.Add("import", importTemplate)
+	a.loadTemplates()
 
 	// Setup Router
-	authPassword := os.Getenv("auth_password")
-	isSandstorm := os.Getenv("SANDSTORM")
-
 	r := mux.NewRouter().StrictSlash(true)
 	r.HandleFunc("/", a.indexHandler).Methods("GET", "OPTIONS")
-	if isSandstorm == "1" {
-		r.HandleFunc("/upload", middleware.RequireSandstormPermission(a.uploadHandler, "upload")).Methods("GET", "OPTIONS", "POST")
-	} else {
-		r.HandleFunc("/upload", middleware.OptionallyRequireAdminAuth(a.uploadHandler, authPassword)).Methods("GET", "OPTIONS", "POST")
-	}
+	r.HandleFunc("/upload", a.requirePermission(a.uploadHandler, "upload")).Methods("GET", "OPTIONS", "POST")
 	r.HandleFunc("/import", a.importHandler).Methods("GET", "OPTIONS", "POST")
 	r.HandleFunc("/v/{id}.mp4", a.videoHandler).Methods("GET")
 	r.HandleFunc("/v/{prefix}/{id}.mp4", a.videoHandler).Methods("GET")
+	r.HandleFunc("/v/{id}.{ext:mp3|m4a|ogg|flac}", a.videoHandler).Methods("GET")
+	r.HandleFunc("/v/{prefix}/{id}.{ext:mp3|m4a|ogg|flac}", a.videoHandler).Methods("GET")
+	r.HandleFunc("/c/{id}.{ext:vtt|json}", a.chaptersHandler).Methods("GET")
+	r.HandleFunc("/c/{prefix}/{id}.{ext:vtt|json}", a.chaptersHandler).Methods("GET")
 	r.HandleFunc("/t/{id}", a.thumbHandler).Methods("GET")
 	r.HandleFunc("/t/{prefix}/{id}", a.thumbHandler).Methods("GET")
 	r.HandleFunc("/v/{id}", a.pageHandler).Methods("GET")
 	r.HandleFunc("/v/{prefix}/{id}", a.pageHandler).Methods("GET")
+	r.HandleFunc("/b/{id}", a.beaconHandler).Methods("POST")
+	r.HandleFunc("/b/{prefix}/{id}", a.beaconHandler).Methods("POST")
+	r.HandleFunc("/p/{id}", a.positionHandler).Methods("POST")
+	r.HandleFunc("/p/{prefix}/{id}", a.positionHandler).Methods("POST")
+	r.HandleFunc("/like/{id}", a.likeHandler).Methods("POST")
+	r.HandleFunc("/like/{prefix}/{id}", a.likeHandler).Methods("POST")
+	r.HandleFunc("/comment/{id}", a.commentHandler).Methods("POST")
+	r.HandleFunc("/comment/{prefix}/{id}", a.commentHandler).Methods("POST")
 	r.HandleFunc("/feed.xml", a.rssHandler).Methods("GET")
+	r.HandleFunc("/admin/analytics", a.requireAdmin(a.analyticsHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/api/videos/{id}", a.videoAPIHandler).Methods("GET")
+	r.HandleFunc("/api/videos/{prefix}/{id}", a.videoAPIHandler).Methods("GET")
+	r.HandleFunc("/api/videos/{id}", a.requireAdmin(a.videoEditHandler)).Methods("PATCH")
+	r.HandleFunc("/api/videos/{prefix}/{id}", a.requireAdmin(a.videoEditHandler)).Methods("PATCH")
+	r.HandleFunc("/api/analytics", a.requireAdmin(a.analyticsAPIHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/comments", a.requireAdmin(a.moderationHandler)).Methods("GET", "OPTIONS")
+	r.HandleFunc("/admin/comments/{action}", a.requireAdmin(a.moderateHandler)).Methods("POST", "OPTIONS")
+	r.HandleFunc("/admin/reload", a.requireAdmin(a.reloadHandler)).Methods("POST")
+	r.HandleFunc("/admin/backfill", a.requireAdmin(a.backfillHandler)).Methods("POST")
+	r.HandleFunc("/api/worker/lease", a.requireWorker(a.workerLeaseHandler)).Methods("POST")
+	r.HandleFunc("/api/worker/leases/{lease}/{action}", a.requireWorker(a.workerLeaseActionHandler)).Methods("GET", "POST", "PUT")
+	r.HandleFunc("/metrics", a.metricsHandler).Methods("GET")
+	r.HandleFunc("/healthz", a.healthzHandler).Methods("GET", "HEAD")
+	r.HandleFunc("/readyz", a.readyzHandler).Methods("GET", "HEAD")
 	// Static file handler
 	fsHandler := http.StripPrefix(
 		"/static",
@@ -141,44 +186,293 @@ func NewApp(cfg *Config) (*App, error) {
 		handlers.AllowCredentials(),
 	)
 
+	r.Use(a.accessLogMiddleware)
+	r.Use(a.metricsMiddleware)
 	r.Use(cors)
 
+	// unmatched requests bypass the router's middlewares
+	r.NotFoundHandler = a.accessLogMiddleware(a.metricsMiddleware(http.NotFoundHandler()))
+	r.MethodNotAllowedHandler = a.accessLogMiddleware(a.metricsMiddleware(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		}),
+	))
+
 	a.Router = r
 	return a, nil
 }
 
-// Run imports the library and starts server.
-func (a *App) Run() error {
-	for _, pc := range a.Config.Library {
-		pc.Path = filepath.Clean(pc.Path)
-		p := &media.Path{
-			Path:                   pc.Path,
-			Prefix:                 pc.Prefix,
-			PreserveUploadFilename: pc.PreserveUploadFilename,
-		}
-		err := a.Library.AddPath(p)
-		if err != nil {
-			return err
-		}
-		err = a.Library.Import(p)
-		if err != nil {
+// loadTemplates parses the templates into the Templates store, replacing
+// any previously loaded ones.
+func (a *App) loadTemplates() {
+	templateFuncs := map[string]interface{}{
+		"bytes":   func(size int64) string { return humanize.Bytes(uint64(size)) },
+		"percent": func(f float64) string { return fmt.Sprintf("%.1f%%", f) },
+		"ratio":   func(f float64) string { return fmt.Sprintf("%.1f%%", f*100) },
+		"inc":     func(i int) int { return i + 1 },
+		"list":    func(items ...interface{}) []interface{} { return items },
+		"join":    strings.Join,
+		"dict": func(kv ...interface{}) map[string]interface{} {
+			m := make(map[string]interface{}, len(kv)/2)
+			for i := 0; i+1 < len(kv); i += 2 {
+				m[fmt.Sprint(kv[i])] = kv[i+1]
+			}
+			return m
+		},
+		"timestamp": func(seconds float64) string {
+			s := int(seconds)
+			if s >= 3600 {
+				return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+			}
+			return fmt.Sprintf("%d:%02d", s/60, s%60)
+		},
+	}
+
+	indexTemplate := template.New("index").Funcs(templateFuncs)
+	template.Must(indexTemplate.Parse(templates.MustGetTemplate("index.html")))
+	template.Must(indexTemplate.Parse(templates.MustGetTemplate("base.html")))
+	a.Templates.Add("index", indexTemplate)
+
+	uploadTemplate := template.New("upload").Funcs(templateFuncs)
+	template.Must(uploadTemplate.Parse(templates.MustGetTemplate("upload.html")))
+	template.Must(uploadTemplate.Parse(templates.MustGetTemplate("base.html")))
+	a.Templates.Add("upload", uploadTemplate)
+
+	importTemplate := template.New("import").Funcs(templateFuncs)
+	template.Must(importTemplate.Parse(templates.MustGetTemplate("import.html")))
+	template.Must(importTemplate.Parse(templates.MustGetTemplate("base.html")))
+	a.Templates.Add("import", importTemplate)
+
+	analyticsTemplate := template.New("analytics").Funcs(templateFuncs)
+	template.Must(analyticsTemplate.Parse(templates.MustGetTemplate("analytics.html")))
+	template.Must(analyticsTemplate.Parse(templates.MustGetTemplate("base.html")))
+	a.Templates.Add("analytics", analyticsTemplate)
+
+	commentsTemplate := template.New("comments").Funcs(templateFuncs)
+	template.Must(commentsTemplate.Parse(templates.MustGetTemplate("comments.html")))
+	template.Must(commentsTemplate.Parse(templates.MustGetTemplate("base.html")))
+	a.Templates.Add("comments", commentsTemplate)
+}
+
+// LoadLibrary adds the configured library paths to the Library and
+// imports their videos.
+func (a *App) LoadLibrary() error {
+	for _, pc := range a.config().Library {
+		if err := a.addPath(pc); err != nil {
 			return err
 		}
-		a.Watcher.Add(p.Path)
 	}
-	if _, err := os.Stat(a.Config.Server.UploadPath) ; err != nil && os.IsNotExist(err) {
+	return nil
+}
+
+// addPath adds the library path pc to the Library and imports its videos.
+func (a *App) addPath(pc *PathConfig) error {
+	pc.Path = filepath.Clean(pc.Path)
+	p := &media.Path{
+		Path:                   pc.Path,
+		Prefix:                 pc.Prefix,
+		PreserveUploadFilename: pc.PreserveUploadFilename,
+		DisableComments:        pc.DisableComments,
+		Profile:                pc.Profile,
+	}
+	err := a.Library.AddPath(p)
+	if err != nil {
+		return err
+	}
+	return a.Library.Import(p)
+}
+
+// ensureUploadPath creates the upload path if it doesn't exist yet.
+func (a *App) ensureUploadPath() error {
+	uploadPath := a.config().Server.UploadPath
+	if _, err := os.Stat(uploadPath); err != nil && os.IsNotExist(err) {
 		log.Warn(
 			fmt.Sprintf("app: upload path '%s' does not exist. Creating it now.",
-			a.Config.Server.UploadPath))
-		if err := os.MkdirAll(a.Config.Server.UploadPath, 0o755); err != nil {
+				uploadPath))
+		if err := os.MkdirAll(uploadPath, 0o755); err != nil {
 			return fmt.Errorf(
 				"error creating upload path %s: %w",
-				a.Config.Server.UploadPath, err)
+				uploadPath, err)
 		}
 	}
+	return nil
+}
+
+// Run imports the library and serves (on Listener if set, otherwise on
+// server.host:server.port) until ctx is done, then shuts down
+// gracefully: in-flight requests are given server.shutdown_timeout seconds to
+// finish, after which running jobs (transcodes) are cancelled. Finally the
+// watcher and store are closed.
+func (a *App) Run(ctx context.Context) error {
+	if err := a.LoadLibrary(); err != nil {
+		a.Close()
+		return err
+	}
+	for _, p := range a.Library.Paths {
+		a.Watcher.Add(p.Path)
+	}
+	if err := a.ensureUploadPath(); err != nil {
+		a.Close()
+		return err
+	}
+	a.preflight()
+	// Setup Listener, unless one was provided (e.g: by tests)
+	if a.Listener == nil {
+		ln, err := newListener(a.config().Server)
+		if err != nil {
+			a.Close()
+			return err
+		}
+		a.Listener = ln
+	}
+	cfg := a.config().Server
+	a.server = &http.Server{Handler: a.Router, ConnContext: unixConnContext}
+	scheme := "http"
+	if cfg.TLS.Enabled() {
+		tlsConfig, redirect, err := newTLSConfig(cfg)
+		if err == nil && cfg.TLS.RedirectPort != 0 {
+			err = a.listenRedirect(cfg, redirect)
+		}
+		if err != nil {
+			a.Listener.Close()
+			a.Close()
+			return err
+		}
+		a.server.TLSConfig = tlsConfig
+		scheme = "https"
+	}
+	log.Printf("Local server: %s", listenerURL(scheme, a.Listener))
 	buildFeed(a)
-	go startWatcher(a)
-	return http.Serve(a.Listener, a.Router)
+	a.work = newWorkQueue(func() *WorkersConfig { return a.config().Transcoder.Workers }, a.Transcoder)
+	go a.work.expireLeases(ctx)
+
+	watcherDone := make(chan struct{})
+	go func() {
+		startWatcher(a)
+		close(watcherDone)
+	}()
+	go a.reloadOnSIGHUP(ctx)
+	if a.config().Transcoder.Backfill.OnStartup {
+		go func() {
+			if err := a.Backfill(ctx); err != nil && ctx.Err() == nil {
+				log.WithError(err).Warn("error backfilling library")
+			}
+		}()
+	}
+
+	serveErr := make(chan error, 2)
+	go func() {
+		if a.server.TLSConfig != nil {
+			serveErr <- a.server.ServeTLS(a.Listener, "", "")
+		} else {
+			serveErr <- a.server.Serve(a.Listener)
+		}
+	}()
+	if a.redirectServer != nil {
+		go func() {
+			serveErr <- a.redirectServer.Serve(a.redirectListener)
+		}()
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+		log.Info("shutting down")
+	case err = <-serveErr:
+		err = fmt.Errorf("error serving http: %w", err)
+	}
+
+	if shutdownErr := a.shutdown(); err == nil {
+		err = shutdownErr
+	}
+	<-watcherDone
+	return err
+}
+
+// listenRedirect listens on server.tls.redirect_port for the plain HTTP
+// server serving handler (see newTLSConfig).
+func (a *App) listenRedirect(cfg *ServerConfig, handler http.Handler) error {
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.TLS.RedirectPort))
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		err := fmt.Errorf("error listening for HTTP redirects on %s: %w", addr, err)
+		return err
+	}
+	log.Printf("Redirecting HTTP to HTTPS: http://%s", ln.Addr())
+	a.redirectServer = &http.Server{Handler: handler}
+	a.redirectListener = ln
+	return nil
+}
+
+// shutdown stops the server gracefully (see Run) and closes the App.
+func (a *App) shutdown() error {
+	timeout := time.Duration(a.config().Server.ShutdownTimeout) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	a.jobs.Stop()
+	if a.redirectServer != nil {
+		a.redirectServer.Close()
+	}
+	if err := a.server.Shutdown(ctx); err != nil {
+		log.WithError(err).Warn("error draining connections, closing them")
+		a.server.Close()
+	}
+	if err := a.jobs.Wait(ctx); err != nil {
+		a.jobs.CancelAll()
+		// cancelled jobs finish quickly once their ffmpeg is killed
+		a.jobs.Wait(context.Background())
+	}
+
+	return a.Close()
+}
+
+// Close releases the resources of the App, i.e: stops the watcher and
+// closes the store. Run calls Close on its own on shutdown.
+func (a *App) Close() error {
+	if err := a.Watcher.Close(); err != nil {
+		log.WithError(err).Warn("error closing watcher")
+	}
+	if err := a.Store.Close(); err != nil {
+		err := fmt.Errorf("error closing store: %w", err)
+		return err
+	}
+	return nil
+}
+
+// requireAdmin wraps handler requiring the "admin" permission on Sandstorm
+// and the uploader password otherwise, without one the admin pages are
+// forbidden. Changes (e.g: POSTs) are only accepted from our own pages (see
+// isSameOrigin). The configuration is consulted on every request so that
+// changes apply on Reload.
+func (a *App) requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isSafeMethod(r.Method) && !a.isSameOrigin(r) {
+			logger(r.Context()).Warn("rejecting cross-site admin request")
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		cfg := a.config()
+		if cfg.Auth.Sandstorm {
+			middleware.RequireSandstormPermission(handler, "admin")(w, r)
+			return
+		}
+		middleware.RequireAdminAuth(handler, cfg.Auth.Password)(w, r)
+	}
+}
+
+// requirePermission wraps handler requiring permission on Sandstorm and the
+// uploader password (if any) otherwise. The configuration is consulted on
+// every request so that changes apply on Reload.
+func (a *App) requirePermission(handler http.HandlerFunc, permission string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := a.config()
+		if cfg.Auth.Sandstorm {
+			middleware.RequireSandstormPermission(handler, permission)(w, r)
+			return
+		}
+		middleware.OptionallyRequireAdminAuth(handler, cfg.Auth.Password)(w, r)
+	}
 }
 
 func (a *App) render(name string, w http.ResponseWriter, ctx interface{}) {
@@ -195,8 +489,7 @@ func (a *App) render(name string, w http.ResponseWriter, ctx interface{}) {
 
 // HTTP handler for /
 func (a *App) indexHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("/")
-	pl := a.Library.Playlist()
+	pl := a.Library.Playlist().Listed()
 	if len(pl) > 0 {
 		http.Redirect(w, r, fmt.Sprintf("/v/%s?%s", pl[0].ID, r.URL.RawQuery), 302)
 	} else {
@@ -211,9 +504,9 @@ func (a *App) indexHandler(w http.ResponseWriter, r *http.Request) {
 		}{
 			Sort:     sort,
 			Quality:  quality,
-			Config:   a.Config,
+			Config:   a.config(),
 			Playing:  &media.Video{ID: ""},
-			Playlist: a.Library.Playlist(),
+			Playlist: a.Library.Playlist().Listed(),
 		}
 
 		a.render("index", w, ctx)
@@ -232,7 +525,7 @@ func (a *App) uploadHandler(w http.ResponseWriter, r *http.Request) {
 			Config  *Config
 			Playing *media.Video
 		}{
-			Config:  a.Config,
+			Config:  a.config(),
 			Playing: &media.Video{ID: ""},
 		}
 		a.render("upload", w, ctx)
@@ -242,7 +535,7 @@ func (a *App) uploadHandler(w http.ResponseWriter, r *http.Request) {
 		file, handler, err := r.FormFile("video_file")
 		if err != nil {
 			err := fmt.Errorf("error processing form: %w", err)
-			log.Error(err)
+			logger(r.Context()).Error(err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -250,177 +543,40 @@ func (a *App) uploadHandler(w http.ResponseWriter, r *http.Request) {
 
 		title := r.FormValue("video_title")
 		description := r.FormValue("video_description")
-		if _, exists := a.Library.Paths[r.FormValue("target_library_path")]; !exists {
+		p, exists := a.Library.Paths[r.FormValue("target_library_path")]
+		if !exists {
 			err := fmt.Errorf("uploading to invalid library path: %s", r.FormValue("target_library_path"))
-			log.Error(err)
+			logger(r.Context()).Error(err)
 			return
 		}
-		targetLibraryPath := r.FormValue("target_library_path")
 
 		uf, err := ioutil.TempFile(
-			a.Config.Server.UploadPath,
+			a.config().Server.UploadPath,
 			fmt.Sprintf("tube-upload-*%s", filepath.Ext(handler.Filename)),
 		)
 		if err != nil {
 			err := fmt.Errorf("error creating temporary file for uploading: %w", err)
-			log.Error(err)
+			logger(r.Context()).Error(err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		defer os.Remove(uf.Name())
 
 		_, err = io.Copy(uf, file)
+		uf.Close()
 		if err != nil {
 			err := fmt.Errorf("error writing file: %w", err)
-			log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		tf, err := ioutil.TempFile(
-			a.Config.Server.UploadPath,
-			fmt.Sprintf("tube-transcode-*.mp4"),
-		)
-		if err != nil {
-			err := fmt.Errorf("error creating temporary file for transcoding: %w", err)
-			log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		// Here we set the final filename for the video file after transcoding.
-		var vf string
-		if a.Config.Server.PreserveUploadFilename ||
-		   a.Library.Paths[targetLibraryPath].PreserveUploadFilename {
-			vf, err = securejoin.SecureJoin(
-				a.Library.Paths[targetLibraryPath].Path,
-				fmt.Sprintf("%s.mp4", filenameWithoutExtension(handler.Filename)),
-			)
-		} else {
-			vf, err = securejoin.SecureJoin(
-				a.Library.Paths[targetLibraryPath].Path,
-				fmt.Sprintf("%s.mp4", shortuuid.New()),
-			)
-		}
-		if err != nil {
-			err := fmt.Errorf("error creating file name in target library: %w", err)
-			log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		// If the (sanitized) original filename collides with an existing file,
-		// we try to add a shortuuid() to it until we find one that doesn't exist.
-		for _, err := os.Stat(vf) ; ! os.IsNotExist(err) ; _, err = os.Stat(vf) {
-			if err != nil {
-				log.Error(err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			log.Warn("File '"+ vf + "' already exists.");
-			vf, err = securejoin.SecureJoin(
-				a.Library.Paths[targetLibraryPath].Path,
-				fmt.Sprintf("%s_%s.mp4", filenameWithoutExtension(vf), shortuuid.New()),
-			)
-			if err != nil {
-				err := fmt.Errorf("error creating file name in target library: %w", err)
-				log.Error(err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			log.Warn("Using filename '" + vf + "' instead.");
-		}
-
-
-		thumbFn1 := fmt.Sprintf("%s.jpg", strings.TrimSuffix(tf.Name(), filepath.Ext(tf.Name())))
-		thumbFn2 := fmt.Sprintf("%s.jpg", strings.TrimSuffix(vf, filepath.Ext(vf)))
-
-		// TODO: Use a proper Job Queue and make this async
-		if err := utils.RunCmd(
-			a.Config.Transcoder.Timeout,
-			"ffmpeg",
-			"-y",
-			"-i", uf.Name(),
-			"-vcodec", "h264",
-			"-acodec", "aac",
-			"-strict", "-2",
-			"-loglevel", "quiet",
-			"-metadata", fmt.Sprintf("title=%s", title),
-			"-metadata", fmt.Sprintf("comment=%s", description),
-			tf.Name(),
-		); err != nil {
-			err := fmt.Errorf("error transcoding video: %w", err)
-			log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		if err := utils.RunCmd(
-			a.Config.Thumbnailer.Timeout,
-			"ffmpeg",
-			"-i", uf.Name(),
-			"-y",
-			"-vf", "thumbnail",
-			"-t", fmt.Sprint(a.Config.Thumbnailer.PositionFromStart),
-			"-vframes", "1",
-			"-strict", "-2",
-			"-loglevel", "quiet",
-			thumbFn1,
-		); err != nil {
-			err := fmt.Errorf("error generating thumbnail: %w", err)
-			log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		if err := os.Rename(thumbFn1, thumbFn2); err != nil {
-			err := fmt.Errorf("error renaming generated thumbnail: %w", err)
-			log.Error(err)
+			logger(r.Context()).Error(err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		if err := os.Rename(tf.Name(), vf); err != nil {
-			err := fmt.Errorf("error renaming transcoded video: %w", err)
-			log.Error(err)
+		if _, err := a.AddVideo(detachedContext(r), uf.Name(), p, handler.Filename, title, description); err != nil {
+			logger(r.Context()).Error(err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// TODO: Make this a background job
-		// Resize for lower quality options
-		for size, suffix := range a.Config.Transcoder.Sizes {
-			log.
-				WithField("size", size).
-				WithField("vf", filepath.Base(vf)).
-				Info("resizing video for lower quality playback")
-			sf := fmt.Sprintf(
-				"%s#%s.mp4",
-				strings.TrimSuffix(vf, filepath.Ext(vf)),
-				suffix,
-			)
-
-			if err := utils.RunCmd(
-				a.Config.Transcoder.Timeout,
-				"ffmpeg",
-				"-y",
-				"-i", vf,
-				"-s", size,
-				"-c:v", "libx264",
-				"-c:a", "aac",
-				"-crf", "18",
-				"-strict", "-2",
-				"-loglevel", "quiet",
-				"-metadata", fmt.Sprintf("title=%s", title),
-				"-metadata", fmt.Sprintf("comment=%s", description),
-				sf,
-			); err != nil {
-				err := fmt.Errorf("error transcoding video: %w", err)
-				log.Error(err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-		}
-
 		fmt.Fprintf(w, "Video successfully uploaded!")
 	} else {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
@@ -434,7 +590,7 @@ func (a *App) importHandler(w http.ResponseWriter, r *http.Request) {
 			Config  *Config
 			Playing *media.Video
 		}{
-			Config:  a.Config,
+			Config:  a.config(),
 			Playing: &media.Video{ID: ""},
 		}
 		a.render("import", w, ctx)
@@ -444,180 +600,26 @@ func (a *App) importHandler(w http.ResponseWriter, r *http.Request) {
 		url := r.FormValue("url")
 		if url == "" {
 			err := fmt.Errorf("error, no url supplied")
-			log.Error(err)
+			logger(r.Context()).Error(err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
 		// TODO: Make collection user selectable from drop-down in Form
 		// XXX: Assume we can put uploaded videos into the first collection (sorted) we find
-		keys := make([]string, 0, len(a.Library.Paths))
-		for k := range a.Library.Paths {
-			keys = append(keys, k)
-		}
-		sort.Strings(keys)
-		collection := keys[0]
-
-		videoImporter, err := importers.NewImporter(url)
-		if err != nil {
-			err := fmt.Errorf("error creating video importer for %s: %w", url, err)
-			log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		videoInfo, err := videoImporter.GetVideoInfo(url)
-		if err != nil {
-			err := fmt.Errorf("error retriving video info for %s: %w", url, err)
-			log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		uf, err := ioutil.TempFile(
-			a.Config.Server.UploadPath,
-			fmt.Sprintf("tube-import-*.mp4"),
-		)
-		if err != nil {
-			err := fmt.Errorf("error creating temporary file for importing: %w", err)
-			log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		defer os.Remove(uf.Name())
-
-		log.WithField("video_url", videoInfo.VideoURL).Info("requesting video size")
-
-		res, err := http.Head(videoInfo.VideoURL)
-		if err != nil {
-			err := fmt.Errorf("error getting size of video %w", err)
-			log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		contentLength := utils.SafeParseInt64(res.Header.Get("Content-Length"), -1)
-		if contentLength == -1 {
-			err := fmt.Errorf("error calculating size of video")
-			log.WithField("contentLength", contentLength).Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		if contentLength > a.Config.Server.MaxUploadSize {
-			err := fmt.Errorf(
-				"imported video would exceed maximum upload size of %s",
-				humanize.Bytes(uint64(a.Config.Server.MaxUploadSize)),
-			)
-			log.
-				WithField("contentLength", contentLength).
-				WithField("max_upload_size", a.Config.Server.MaxUploadSize).
-				Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		log.WithField("contentLength", contentLength).Info("downloading video")
-
-		if err := utils.Download(videoInfo.VideoURL, uf.Name()); err != nil {
-			err := fmt.Errorf("error downloading video %s: %w", url, err)
-			log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		tf, err := ioutil.TempFile(
-			a.Config.Server.UploadPath,
-			fmt.Sprintf("tube-transcode-*.mp4"),
-		)
+		p, err := a.Collection("")
 		if err != nil {
-			err := fmt.Errorf("error creating temporary file for transcoding: %w", err)
-			log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		vf := filepath.Join(
-			a.Library.Paths[collection].Path,
-			fmt.Sprintf("%s.mp4", shortuuid.New()),
-		)
-		thumbFn1 := fmt.Sprintf("%s.jpg", strings.TrimSuffix(tf.Name(), filepath.Ext(tf.Name())))
-		thumbFn2 := fmt.Sprintf("%s.jpg", strings.TrimSuffix(vf, filepath.Ext(vf)))
-
-		if err := utils.Download(videoInfo.ThumbnailURL, thumbFn1); err != nil {
-			err := fmt.Errorf("error downloading thumbnail: %w", err)
-			log.Error(err)
+			logger(r.Context()).Error(err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// TODO: Use a proper Job Queue and make this async
-		if err := utils.RunCmd(
-			a.Config.Transcoder.Timeout,
-			"ffmpeg",
-			"-y",
-			"-i", uf.Name(),
-			"-vcodec", "h264",
-			"-acodec", "aac",
-			"-strict", "-2",
-			"-loglevel", "quiet",
-			"-metadata", fmt.Sprintf("title=%s", videoInfo.Title),
-			"-metadata", fmt.Sprintf("comment=%s", videoInfo.Description),
-			tf.Name(),
-		); err != nil {
-			err := fmt.Errorf("error transcoding video: %w", err)
-			log.Error(err)
+		if _, err := a.ImportVideo(detachedContext(r), url, p); err != nil {
+			logger(r.Context()).Error(err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		if err := os.Rename(thumbFn1, thumbFn2); err != nil {
-			err := fmt.Errorf("error renaming generated thumbnail: %w", err)
-			log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		if err := os.Rename(tf.Name(), vf); err != nil {
-			err := fmt.Errorf("error renaming transcoded video: %w", err)
-			log.Error(err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
-		// TODO: Make this a background job
-		// Resize for lower quality options
-		for size, suffix := range a.Config.Transcoder.Sizes {
-			log.
-				WithField("size", size).
-				WithField("vf", filepath.Base(vf)).
-				Info("resizing video for lower quality playback")
-			sf := fmt.Sprintf(
-				"%s#%s.mp4",
-				strings.TrimSuffix(vf, filepath.Ext(vf)),
-				suffix,
-			)
-
-			if err := utils.RunCmd(
-				a.Config.Transcoder.Timeout,
-				"ffmpeg",
-				"-y",
-				"-i", vf,
-				"-s", size,
-				"-c:v", "libx264",
-				"-c:a", "aac",
-				"-crf", "18",
-				"-strict", "-2",
-				"-loglevel", "quiet",
-				"-metadata", fmt.Sprintf("title=%s", videoInfo.Title),
-				"-metadata", fmt.Sprintf("comment=%s", videoInfo.Description),
-				sf,
-			); err != nil {
-				err := fmt.Errorf("error transcoding video: %w", err)
-				log.Error(err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-		}
-
 		fmt.Fprintf(w, "Video successfully imported!")
 	} else {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
@@ -632,8 +634,10 @@ func (a *App) pageHandler(w http.ResponseWriter, r *http.Request) {
 	if ok {
 		id = path.Join(prefix, id)
 	}
-	log.Printf("/v/%s", id)
 	playing, ok := a.Library.Videos[id]
+	if ok && !a.canView(r, playing) {
+		ok = false
+	}
 	if !ok {
 		sort := strings.ToLower(r.URL.Query().Get("sort"))
 		quality := strings.ToLower(r.URL.Query().Get("quality"))
@@ -646,32 +650,30 @@ func (a *App) pageHandler(w http.ResponseWriter, r *http.Request) {
 		}{
 			Sort:     sort,
 			Quality:  quality,
-			Config:   a.Config,
+			Config:   a.config(),
 			Playing:  &media.Video{ID: ""},
-			Playlist: a.Library.Playlist(),
+			Playlist: a.Library.Playlist().Listed(),
 		}
 		a.render("upload", w, ctx)
 		return
 	}
 
-	views, err := a.Store.GetViews(id)
+	playlist := a.Library.Playlist().Listed()
+
+	ids := make([]string, 0, len(playlist)+1)
+	ids = append(ids, id)
+	for _, video := range playlist {
+		ids = append(ids, video.ID)
+	}
+	views, err := a.Store.GetViewsMulti(ids)
 	if err != nil {
-		err := fmt.Errorf("error retrieving views for %s: %w", id, err)
-		log.Warn(err)
+		err := fmt.Errorf("error retrieving views: %w", err)
+		logger(r.Context()).Warn(err)
 	}
 
-	playing.Views = views
-
-	playlist := a.Library.Playlist()
-
-	// TODO: Optimize this? Bitcask has no concept of MultiGet / MGET
+	playing.Views = views[id]
 	for _, video := range playlist {
-		views, err := a.Store.GetViews(video.ID)
-		if err != nil {
-			err := fmt.Errorf("error retrieving views for %s: %w", video.ID, err)
-			log.Warn(err)
-		}
-		video.Views = views
+		video.Views = views[video.ID]
 	}
 
 	sort := strings.ToLower(r.URL.Query().Get("sort"))
@@ -682,35 +684,91 @@ func (a *App) pageHandler(w http.ResponseWriter, r *http.Request) {
 		media.By(media.SortByTimestamp).Sort(playlist)
 	default:
 		// By default the playlist is sorted by Timestamp
-		log.Warnf("invalid sort critiera: %s", sort)
+		logger(r.Context()).Warnf("invalid sort critiera: %s", sort)
 	}
 
-	quality := strings.ToLower(r.URL.Query().Get("quality"))
-	switch quality {
-	case "", "720p", "480p", "360p", "240p":
-	default:
-		log.WithField("quality", quality).Warn("invalid quality")
+	quality := r.URL.Query().Get("quality")
+	if q, ok := a.videoQuality(playing, quality); ok {
+		quality = q
+	} else {
+		if quality != "" {
+			logger(r.Context()).WithField("quality", quality).Warn("invalid quality")
+		}
 		quality = ""
 	}
 
+	positions, err := a.Store.GetPositions(a.viewerID(r))
+	if err != nil {
+		err := fmt.Errorf("error retrieving playback positions: %w", err)
+		logger(r.Context()).Warn(err)
+	}
+	var resume float64
+	if p, ok := positions[id]; ok && !p.Watched() {
+		resume = p.Position
+	}
+	// e.g: a chapter link
+	if t, err := media.ParseTimestamp(r.URL.Query().Get("t")); err == nil {
+		resume = t
+	}
+
+	viewer := a.viewerID(r)
+	likes, err := a.Store.GetLikes(id)
+	if err != nil {
+		logger(r.Context()).Warn(err)
+	}
+	liked, err := a.Store.HasLiked(viewer, id)
+	if err != nil {
+		logger(r.Context()).Warn(err)
+	}
+	comments, err := a.Store.GetComments(id)
+	if err != nil {
+		logger(r.Context()).Warn(err)
+	}
+	setViewerCookie(w, r)
+	a.recordReferrer(r, id)
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	ctx := &struct {
-		Sort     string
-		Quality  string
-		Config   *Config
-		Playing  *media.Video
-		Playlist media.Playlist
+		Sort      string
+		Quality   string
+		Config    *Config
+		Playing   *media.Video
+		Playlist  media.Playlist
+		Position  float64
+		Positions map[string]Position
+		Likes     int64
+		Liked     bool
+		Comments  []*commentThread
+		// CommentsEnabled is false if comments are disabled for the collection
+		CommentsEnabled bool
+		// CommentPending is true after posting a comment awaiting moderation
+		CommentPending bool
+		// Moderator is true for authenticated users who may delete comments
+		Moderator bool
+		// Qualities are the lower qualities the video can be played in
+		Qualities []string
+		// Sources are the formats the video can be played in
+		Sources []videoSource
 	}{
-		Sort:     sort,
-		Quality:  quality,
-		Config:   a.Config,
-		Playing:  playing,
-		Playlist: playlist,
+		Sort:            sort,
+		Quality:         quality,
+		Config:          a.config(),
+		Playing:         playing,
+		Playlist:        playlist,
+		Position:        resume,
+		Positions:       positions,
+		Likes:           likes,
+		Liked:           liked,
+		Comments:        threadComments(comments),
+		CommentsEnabled: a.commentsEnabled(playing),
+		CommentPending:  r.URL.Query().Get("comment") == "pending",
+		Moderator:       a.isModerator(r),
+		Qualities:       a.videoQualities(playing),
+		Sources:         a.videoSources(playing, quality),
 	}
 	a.render("index", w, ctx)
 }
 
-// HTTP handler for /v/id.mp4
+// HTTP handler for /v/id.mp4 (or .mp3, etc. for audio)
 func (a *App) videoHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
@@ -720,52 +778,246 @@ func (a *App) videoHandler(w http.ResponseWriter, r *http.Request) {
 		id = path.Join(prefix, id)
 	}
 
-	log.Printf("/v/%s", id)
-
 	m, ok := a.Library.Videos[id]
-	if !ok {
+	if !ok || !a.canView(r, m) {
 		return
 	}
 
 	var videoPath string
 
-	quality := strings.ToLower(r.URL.Query().Get("quality"))
-	switch quality {
-	case "720p", "480p", "360p", "240p":
-		videoPath = fmt.Sprintf(
-			"%s#%s.mp4",
-			strings.TrimSuffix(m.Path, filepath.Ext(m.Path)),
-			quality,
-		)
-		if !utils.FileExists(videoPath) {
-			log.
+	quality := r.URL.Query().Get("quality")
+	if q, ok := a.videoQuality(m, quality); ok {
+		videoPath = media.RenditionPath(m.Path, q, "")
+		quality = q
+	} else {
+		if quality != "" && quality != "source" {
+			logger(r.Context()).
 				WithField("quality", quality).
-				WithField("videoPath", videoPath).
 				Warn("video with specified quality does not exist (defaulting to default quality)")
-			videoPath = m.Path
 		}
-	case "":
-		videoPath = m.Path
-	default:
-		log.WithField("quality", quality).Warn("invalid quality")
 		videoPath = m.Path
+		quality = "source"
 	}
 
-	if err := a.Store.Migrate(prefix, id); err != nil {
-		err := fmt.Errorf("error migrating store data: %w", err)
-		log.Warn(err)
+	contentType, ext := m.MIMEType(), m.Ext()
+	if format := strings.ToLower(r.URL.Query().Get("format")); format != "" {
+		formatQuality := quality
+		if formatQuality == "source" {
+			formatQuality = ""
+		}
+		formatPath := media.RenditionPath(m.Path, formatQuality, format)
+		if !a.hasFormat(m, format) || !utils.FileExists(formatPath) {
+			logger(r.Context()).
+				WithField("format", format).
+				WithField("quality", quality).
+				Warn("video in specified format does not exist (defaulting to mp4)")
+		} else {
+			videoPath = formatPath
+			contentType, ext = "video/webm", ".webm"
+		}
 	}
 
-	if err := a.Store.IncViews(id); err != nil {
-		err := fmt.Errorf("error updating view for %s: %w", id, err)
-		log.Warn(err)
+	if err := a.Store.Migrate(prefix, id); err != nil {
+		err := fmt.Errorf("error migrating store data: %w", err)
+		logger(r.Context()).Warn(err)
 	}
 
 	title := m.Title
-	disposition := "attachment; filename=\"" + title + ".mp4\""
+	disposition := "attachment; filename=\"" + title + ext + "\""
 	w.Header().Set("Content-Disposition", disposition)
-	w.Header().Set("Content-Type", "video/mp4")
-	http.ServeFile(w, r, videoPath)
+	w.Header().Set("Content-Type", contentType)
+	rr := &responseRecorder{ResponseWriter: w}
+	http.ServeFile(rr, r, videoPath)
+	a.metrics.videoBytes.Add(float64(rr.bytes), quality)
+}
+
+// videoSource is a <source> of the player: the video in one of its formats.
+type videoSource struct {
+	Format string // empty for the MP4
+	Type   string // MIME type including the codecs, if known
+}
+
+// videoFormats returns the additional formats of the transcoding profile of
+// the collection of the video v.
+func (a *App) videoFormats(v *media.Video) []*transcoder.Format {
+	p, ok := a.Library.PathOf(v)
+	if !ok {
+		return nil
+	}
+	_, profile := a.config().Transcoder.Profile(p)
+	return profile.Formats
+}
+
+// hasFormat returns whether format is one of the additional formats of the
+// video v.
+func (a *App) hasFormat(v *media.Video, format string) bool {
+	for _, f := range a.videoFormats(v) {
+		if f.Name == format {
+			return true
+		}
+	}
+	return false
+}
+
+// videoRendition is a file of a video listed by /api/videos/id.
+type videoRendition struct {
+	Quality string `json:"quality"` // "source" or a transcoder.sizes suffix
+	Format  string `json:"format"`  // "mp4" (or "mp3", etc. for audio) or one of the additional formats
+	Type    string `json:"type"`
+	Size    int64  `json:"size"`
+	URL     string `json:"url"`
+}
+
+// HTTP handler for /api/videos/id
+func (a *App) videoAPIHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	prefix, ok := vars["prefix"]
+	if ok {
+		id = path.Join(prefix, id)
+	}
+	v, ok := a.Library.Videos[id]
+	if !ok || !a.canView(r, v) {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	chapters := append([]media.Chapter{}, v.Chapters...)
+	renditions := []videoRendition{}
+	for _, quality := range append([]string{""}, a.videoQualities(v)...) {
+		for _, source := range a.videoSources(v, quality) {
+			info, err := os.Stat(media.RenditionPath(v.Path, quality, source.Format))
+			if err != nil {
+				continue
+			}
+			query := url.Values{}
+			rendition := videoRendition{
+				Quality: quality,
+				Format:  source.Format,
+				Type:    source.Type,
+				Size:    info.Size(),
+			}
+			if quality == "" {
+				rendition.Quality = "source"
+			} else {
+				query.Set("quality", quality)
+			}
+			if source.Format == "" {
+				rendition.Format = strings.TrimPrefix(v.Ext(), ".")
+			} else {
+				query.Set("format", source.Format)
+			}
+			rendition.URL = fmt.Sprintf("/v/%s%s", v.ID, v.Ext())
+			if len(query) > 0 {
+				rendition.URL += "?" + query.Encode()
+			}
+			renditions = append(renditions, rendition)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	date := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return media.Date{Time: t}.String()
+	}
+	visibility := v.Visibility
+	if visibility == "" {
+		visibility = media.Public
+	}
+	if err := json.NewEncoder(w).Encode(struct {
+		ID          string           `json:"id"`
+		Title       string           `json:"title"`
+		Description string           `json:"description"`
+		Tags        []string         `json:"tags"`
+		Speakers    []string         `json:"speakers"`
+		Recorded    string           `json:"recorded"`
+		Published   string           `json:"published"`
+		Timestamp   time.Time        `json:"timestamp"` // published, recorded or modified
+		License     string           `json:"license"`
+		Language    string           `json:"language"`
+		Source      string           `json:"source"`
+		Visibility  media.Visibility `json:"visibility"`
+		Chapters    []media.Chapter  `json:"chapters"`
+		Renditions  []videoRendition `json:"renditions"`
+	}{
+		ID:          v.ID,
+		Title:       v.Title,
+		Description: v.Description,
+		Tags:        append([]string{}, v.Tags...),
+		Speakers:    append([]string{}, v.Speakers...),
+		Recorded:    date(v.Recorded),
+		Published:   date(v.Published),
+		Timestamp:   v.Timestamp,
+		License:     v.License,
+		Language:    v.Language,
+		Source:      v.Source,
+		Visibility:  visibility,
+		Chapters:    chapters,
+		Renditions:  renditions,
+	}); err != nil {
+		logger(r.Context()).WithError(err).Error("error encoding video")
+	}
+}
+
+// videoQualities returns the lower qualities (transcoder.sizes suffixes) of
+// the video v that have a rendition, largest first.
+func (a *App) videoQualities(v *media.Video) []string {
+	type size struct {
+		suffix string
+		area   int
+	}
+	var sizes []size
+	for s, suffix := range a.config().Transcoder.Sizes {
+		width, height, _ := transcoder.ParseSize(s)
+		sizes = append(sizes, size{suffix, width * height})
+	}
+	sort.Slice(sizes, func(i, j int) bool {
+		if sizes[i].area != sizes[j].area {
+			return sizes[i].area > sizes[j].area
+		}
+		return sizes[i].suffix < sizes[j].suffix
+	})
+
+	var qualities []string
+	for _, s := range sizes {
+		if utils.FileExists(media.RenditionPath(v.Path, s.suffix, "")) {
+			qualities = append(qualities, s.suffix)
+		}
+	}
+	return qualities
+}
+
+// videoQuality returns the lower quality of the video v matching quality
+// (case insensitively) and whether it has a rendition in it.
+func (a *App) videoQuality(v *media.Video, quality string) (string, bool) {
+	if quality == "" {
+		return "", false
+	}
+	for _, q := range a.videoQualities(v) {
+		if strings.EqualFold(q, quality) {
+			return q, true
+		}
+	}
+	return "", false
+}
+
+// videoSources returns the sources of the video v in quality ("" for the
+// source's) for the player: the existing renditions in the additional
+// formats in order of preference followed by the MP4 every browser plays.
+// Audio has a single source, its file.
+func (a *App) videoSources(v *media.Video, quality string) []videoSource {
+	if v.IsAudio() {
+		return []videoSource{{Type: v.MIMEType()}}
+	}
+	var sources []videoSource
+	for _, f := range a.videoFormats(v) {
+		if utils.FileExists(media.RenditionPath(v.Path, quality, f.Name)) {
+			sources = append(sources, videoSource{Format: f.Name, Type: f.MIMEType()})
+		}
+	}
+	return append(sources, videoSource{Type: "video/mp4"})
 }
 
 // HTTP handler for /t/id
@@ -776,9 +1028,8 @@ func (a *App) thumbHandler(w http.ResponseWriter, r *http.Request) {
 	if ok {
 		id = path.Join(prefix, id)
 	}
-	log.Printf("/t/%s", id)
 	m, ok := a.Library.Videos[id]
-	if !ok {
+	if !ok || !a.canView(r, m) {
 		return
 	}
 	w.Header().Set("Cache-Control", "public, max-age=7776000")
@@ -0,0 +1,148 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.mills.io/prologic/tube/transcoder"
+)
+
+// newTestApp returns an App with its library path, upload path and store in
+// a temporary directory, transcoding with fake.
+func newTestApp(t *testing.T, fake *transcoder.Fake) *App {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := DefaultConfig()
+	cfg.Library = []*PathConfig{{Path: filepath.Join(dir, "videos")}}
+	cfg.Server.StorePath = filepath.Join(dir, "tube.db")
+	cfg.Server.UploadPath = filepath.Join(dir, "uploads")
+	cfg.Server.ShutdownTimeout = 1
+	if err := os.Mkdir(cfg.Library[0].Path, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewApp(cfg)
+	if err != nil {
+		t.Fatalf("error creating app: %s", err)
+	}
+	a.Transcoder = fake
+	return a
+}
+
+// newUploadRequest returns a POST /upload request of the video file name
+// with content data into the library path p.
+func newUploadRequest(t *testing.T, url, p, name string, data []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("video_file", name)
+	if err == nil {
+		_, err = fw.Write(data)
+	}
+	if err == nil {
+		err = mw.WriteField("target_library_path", p)
+	}
+	if err == nil {
+		err = mw.WriteField("video_title", "Test Video")
+	}
+	if err == nil {
+		err = mw.Close()
+	}
+	if err != nil {
+		t.Fatalf("error creating upload: %s", err)
+	}
+
+	r, err := http.NewRequest("POST", url+"/upload", &body)
+	if err != nil {
+		t.Fatalf("error creating upload: %s", err)
+	}
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+// closeRecordingStore is a Store recording whether it was closed.
+type closeRecordingStore struct {
+	Store
+	closed chan struct{}
+}
+
+func (s *closeRecordingStore) Close() error {
+	close(s.closed)
+	return s.Store.Close()
+}
+
+func TestRunShutdownCancelsJobs(t *testing.T) {
+	started := make(chan struct{})
+	cancelled := make(chan error, 1)
+	fake := &transcoder.Fake{
+		ProbeResult: &transcoder.ProbeResult{Format: "mov,mp4,m4a,3gp,3g2,mj2"},
+		// transcodes run until they are cancelled
+		Hook: func(ctx context.Context, c transcoder.Call) error {
+			if c.Method != "Transcode" {
+				return nil
+			}
+			close(started)
+			<-ctx.Done()
+			cancelled <- ctx.Err()
+			return ctx.Err()
+		},
+	}
+	a := newTestApp(t, fake)
+	store := &closeRecordingStore{Store: a.Store, closed: make(chan struct{})}
+	a.Store = store
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Listener = ln
+
+	r := newUploadRequest(t, "http://"+ln.Addr().String(), a.config().Library[0].Path, "test.mp4", []byte("video"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runErr := make(chan error, 1)
+	go func() { runErr <- a.Run(ctx) }()
+	go func() {
+		// fails once the server is shut down
+		if res, err := http.DefaultClient.Do(r); err == nil {
+			res.Body.Close()
+		}
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("transcode didn't start")
+	}
+	cancel()
+
+	select {
+	case err := <-runErr:
+		if err != nil {
+			t.Errorf("expected Run to return nil, got %s", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run didn't return after cancelling its context")
+	}
+	select {
+	case err := <-cancelled:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected the transcode to be cancelled, got %v", err)
+		}
+	default:
+		t.Error("transcode is still running")
+	}
+	select {
+	case <-store.closed:
+	default:
+		t.Error("store wasn't closed")
+	}
+}
@@ -0,0 +1,265 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.mills.io/prologic/tube/media"
+	"git.mills.io/prologic/tube/utils"
+)
+
+// errBackfillRunning is returned when starting a backfill while one is
+// already running.
+var errBackfillRunning = errors.New("error, a backfill is already running")
+
+// foregroundJobs are the job types a backfill waits for.
+var foregroundJobs = map[string]bool{"transcode": true, "import": true}
+
+// Backfill reconciles the library with the transcoder settings: it generates
+// the missing thumbnails and renditions of every video, e.g: of videos copied
+// into a library path rather than uploaded, saves the chapters of their
+// container and removes renditions of sizes and formats no longer configured
+// (if transcoder.backfill.cleanup is set).
+//
+// It runs as a low priority job: videos are only started while no uploads or
+// imports are running, at most transcoder.backfill.concurrency at a time.
+func (a *App) Backfill(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&a.backfilling, 0, 1) {
+		return errBackfillRunning
+	}
+	return a.runBackfill(ctx)
+}
+
+// runBackfill is Backfill once the caller set backfilling.
+func (a *App) runBackfill(ctx context.Context) error {
+	defer atomic.StoreInt32(&a.backfilling, 0)
+
+	ctx, done, err := a.jobs.Start(ctx, "backfill", "backfill library")
+	if err != nil {
+		return err
+	}
+	err = a.backfill(ctx)
+	done(err)
+	return err
+}
+
+// backfill is the job run by Backfill.
+func (a *App) backfill(ctx context.Context) error {
+	// settings are fixed for the duration of the job, even if reloaded
+	cfg := a.config()
+	videos := a.Library.Playlist()
+	logger(ctx).WithField("videos", len(videos)).Info("backfilling library")
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed int
+	)
+	sem := make(chan struct{}, cfg.Transcoder.Backfill.Concurrency)
+	for _, v := range videos {
+		if err := a.waitForeground(ctx); err != nil {
+			break
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(v *media.Video) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := a.backfillVideo(ctx, cfg, v); err != nil {
+				logger(ctx).WithError(err).WithField("video", v.ID).Warn("error backfilling video")
+				mu.Lock()
+				failed++
+				mu.Unlock()
+			}
+		}(v)
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("error backfilling %d of %d videos", failed, len(videos))
+	}
+	logger(ctx).WithField("videos", len(videos)).Info("backfilled library")
+	return nil
+}
+
+// waitForeground waits until no uploads or imports are running.
+func (a *App) waitForeground(ctx context.Context) error {
+	for {
+		busy := false
+		for _, job := range a.jobs.Running() {
+			busy = busy || foregroundJobs[job.Type]
+		}
+		if !busy {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// backfillVideo generates the missing thumbnail (or waveform of audio),
+// chapters and renditions of the video v and removes its stale renditions.
+func (a *App) backfillVideo(ctx context.Context, cfg *Config, v *media.Video) error {
+	p, ok := a.Library.PathOf(v)
+	if !ok {
+		return nil
+	}
+
+	a.backfillChapters(ctx, cfg, v)
+
+	thumb := fmt.Sprintf("%s.jpg", strings.TrimSuffix(v.Path, filepath.Ext(v.Path)))
+	switch {
+	case v.ThumbType != "":
+	case v.IsAudio() && cfg.Thumbnailer.Waveform:
+		logger(ctx).WithField("video", v.ID).Info("generating missing waveform")
+		if err := a.transcoder().Waveform(ctx, v.Path, thumb, cfg.Thumbnailer.Timeout); err != nil {
+			err := fmt.Errorf("error generating waveform: %w", err)
+			return err
+		}
+	case !v.IsAudio():
+		logger(ctx).WithField("video", v.ID).Info("generating missing thumbnail")
+		if err := a.transcoder().Thumbnail(
+			ctx, v.Path, thumb,
+			cfg.Thumbnailer.PositionFromStart,
+			cfg.Thumbnailer.Timeout,
+		); err != nil {
+			err := fmt.Errorf("error generating thumbnail: %w", err)
+			return err
+		}
+	}
+	if v.ThumbType == "" && utils.FileExists(thumb) {
+		// pick up the thumbnail
+		if err := a.Library.Add(v.Path); err != nil {
+			logger(ctx).WithError(err).WithField("video", v.ID).Warn("error reloading video")
+		}
+	}
+
+	if v.IsAudio() {
+		// audio has no renditions
+		return nil
+	}
+
+	if cfg.Transcoder.Backfill.Cleanup {
+		if err := a.removeStaleRenditions(ctx, cfg, p, v.Path); err != nil {
+			return err
+		}
+	}
+
+	metadata := map[string]string{"title": v.Title, "comment": v.Description}
+	return a.transcodeRenditions(ctx, cfg, p, v.Path, metadata, true)
+}
+
+// backfillChapters saves the chapters of the container of the video v to
+// its sidecar, unless the sidecar sets chapters (even none) which take
+// precedence. Errors are only logged, the chapters are tried again on the
+// next backfill.
+func (a *App) backfillChapters(ctx context.Context, cfg *Config, v *media.Video) {
+	l := logger(ctx).WithField("video", v.ID)
+	sidecar, _, err := media.ReadSidecar(v.Path)
+	if err != nil {
+		l.WithError(err).Warn("error reading sidecar, not saving chapters")
+		return
+	}
+	if sidecar != nil && sidecar.Chapters != nil {
+		return
+	}
+
+	probe, err := a.transcoder().Probe(ctx, v.Path, cfg.Transcoder.Timeout)
+	if err != nil {
+		l.WithError(err).Warn("error probing video for chapters")
+		return
+	}
+	chapters := containerChapters(probe)
+	if len(chapters) == 0 {
+		return
+	}
+	l.WithField("chapters", len(chapters)).Info("saving chapters of the container")
+	if err := media.UpdateSidecar(v.Path, map[string]interface{}{"chapters": chapters}); err != nil {
+		l.WithError(err).Warn("error saving chapters")
+		return
+	}
+	// pick up the chapters
+	if err := a.Library.Add(v.Path); err != nil {
+		l.WithError(err).Warn("error reloading video")
+	}
+}
+
+// removeStaleRenditions removes the renditions of the video file vf of the
+// library path p in sizes or formats that are no longer configured.
+func (a *App) removeStaleRenditions(ctx context.Context, cfg *Config, p *media.Path, vf string) error {
+	suffixes := make(map[string]bool)
+	for _, suffix := range cfg.Transcoder.Sizes {
+		suffixes[suffix] = true
+	}
+	formats := make(map[string]bool)
+	_, profile := cfg.Transcoder.Profile(p)
+	for _, format := range profile.Formats {
+		formats[format.Name] = true
+	}
+
+	renditions, err := media.Renditions(vf)
+	if err != nil {
+		err := fmt.Errorf("error listing renditions: %w", err)
+		return err
+	}
+	for _, r := range renditions {
+		if (r.Quality == "" || suffixes[r.Quality]) && (r.Format == "" || formats[r.Format]) {
+			continue
+		}
+		if err := os.Remove(r.Path); err != nil {
+			err := fmt.Errorf("error removing stale rendition: %w", err)
+			return err
+		}
+		logger(ctx).
+			WithField("quality", r.Quality).
+			WithField("format", r.Format).
+			WithField("path", r.Path).
+			Info("removed stale rendition")
+	}
+	return nil
+}
+
+// HTTP handler for /admin/backfill
+func (a *App) backfillHandler(w http.ResponseWriter, r *http.Request) {
+	if !atomic.CompareAndSwapInt32(&a.backfilling, 0, 1) {
+		http.Error(w, errBackfillRunning.Error(), http.StatusConflict)
+		return
+	}
+
+	ctx := detachedContext(r)
+	go func() {
+		if err := a.runBackfill(ctx); err != nil {
+			logger(ctx).WithError(err).Warn("error backfilling library")
+		}
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(&struct {
+		Status string `json:"status"`
+	}{"started"}); err != nil {
+		logger(r.Context()).WithError(err).Error("error encoding backfill result")
+	}
+}
@@ -0,0 +1,115 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.mills.io/prologic/tube/media"
+	"git.mills.io/prologic/tube/transcoder"
+)
+
+// backfillVideoFile writes a video file named name into the library path of
+// a with the sidecar sidecar (none if empty), backfills the library and
+// returns the video.
+func backfillVideoFile(t *testing.T, a *App, name, sidecar string) *media.Video {
+	t.Helper()
+	vf := filepath.Join(a.config().Library[0].Path, name)
+	if err := os.WriteFile(vf, testVideo, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if sidecar != "" {
+		if err := os.WriteFile(media.SidecarPath(vf), []byte(sidecar), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.Library.Add(vf); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Backfill(context.Background()); err != nil {
+		t.Fatalf("error backfilling: %s", err)
+	}
+	return a.Library.Videos[strings.TrimSuffix(name, filepath.Ext(name))]
+}
+
+func TestBackfillChapters(t *testing.T) {
+	probe := *testProbe
+	probe.Chapters = []transcoder.Chapter{{Start: 0, End: 90, Title: "Intro"}, {Start: 90, End: 120, Title: "Outro"}}
+	a := newPipelineTestApp(t, &transcoder.Fake{ProbeResult: &probe})
+
+	v := backfillVideoFile(t, a, "copied.mp4", "")
+	if len(v.Chapters) != 2 || v.Chapters[0].Title != "Intro" || v.Chapters[1].Start != 90 {
+		t.Errorf("expected the container's chapters, got %+v", v.Chapters)
+	}
+	sidecar, _, err := media.ReadSidecar(v.Path)
+	if err != nil || sidecar == nil || len(sidecar.Chapters) != 2 {
+		t.Errorf("expected the chapters saved to the sidecar, got %+v %v", sidecar, err)
+	}
+}
+
+func TestBackfillChaptersSidecarPrecedence(t *testing.T) {
+	probe := *testProbe
+	probe.Chapters = []transcoder.Chapter{{Start: 0, End: 90, Title: "Intro"}}
+	a := newPipelineTestApp(t, &transcoder.Fake{ProbeResult: &probe})
+
+	v := backfillVideoFile(t, a, "edited.mp4", "chapters:\n  - start: 10\n    title: Edited\n")
+	if len(v.Chapters) != 1 || v.Chapters[0].Title != "Edited" {
+		t.Errorf("expected the sidecar's chapters, got %+v", v.Chapters)
+	}
+
+	v = backfillVideoFile(t, a, "none.mp4", "chapters: []\n")
+	if len(v.Chapters) != 0 {
+		t.Errorf("expected no chapters, got %+v", v.Chapters)
+	}
+}
+
+func TestBackfillFailedRendition(t *testing.T) {
+	fail := true
+	fake := &transcoder.Fake{
+		ProbeResult: testProbe,
+		// a failed encode leaves a partial output behind
+		Hook: func(ctx context.Context, c transcoder.Call) error {
+			if c.Method != "Resize" || !fail {
+				return nil
+			}
+			if err := os.WriteFile(c.Dst, []byte("partial"), 0o644); err != nil {
+				return err
+			}
+			return errors.New("ffmpeg failed")
+		},
+	}
+	a := newPipelineTestApp(t, fake)
+	dir := a.config().Library[0].Path
+	vf := filepath.Join(dir, "copied.mp4")
+	if err := os.WriteFile(vf, testVideo, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Library.Add(vf); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Backfill(context.Background()); err == nil {
+		t.Fatal("expected the backfill to fail")
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if strings.Contains(f.Name(), "#") || strings.HasPrefix(f.Name(), ".") {
+			t.Errorf("expected no partial rendition, got %s", f.Name())
+		}
+	}
+
+	// retried by the next backfill
+	fail = false
+	if err := a.Backfill(context.Background()); err != nil {
+		t.Fatalf("error backfilling: %s", err)
+	}
+	if data, err := os.ReadFile(media.RenditionPath(vf, "720p", "")); err != nil || string(data) != string(testVideo) {
+		t.Errorf("expected the 720p rendition, got %q %v", data, err)
+	}
+}
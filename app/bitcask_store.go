@@ -1,17 +1,33 @@
 package app
 
 import (
+	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"git.mills.io/prologic/bitcask"
 )
 
+// pingWriteInterval is the minimum time between the writes of Ping, which
+// only reads otherwise: Bitcask is append-only, every write grows its log.
+const pingWriteInterval = 10 * time.Minute
+
 // BitcaskStore ...
 type BitcaskStore struct {
+	// mu serializes read-modify-write updates such as view increments,
+	// Bitcask itself has no notion of atomic increments.
+	mu sync.Mutex
 	db *bitcask.Bitcask
+
+	// pinged is the time of the last write of Ping, guarded by mu.
+	pinged time.Time
 }
 
 // NewBitcaskStore ...
@@ -53,6 +69,37 @@ func (s *BitcaskStore) Close() error {
 	return s.db.Close()
 }
 
+// Ping checks that the store is readable and writable, writing at most once
+// every pingWriteInterval.
+func (s *BitcaskStore) Ping() error {
+	key := []byte("/health")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.pinged) < pingWriteInterval {
+		if _, err := s.db.Get(key); err != nil {
+			err := fmt.Errorf("error reading from store: %w", err)
+			return err
+		}
+		return nil
+	}
+
+	value := []byte(time.Now().UTC().Format(time.RFC3339Nano))
+	if err := s.db.Put(key, value); err != nil {
+		err := fmt.Errorf("error writing to store: %w", err)
+		return err
+	}
+	got, err := s.db.Get(key)
+	if err != nil {
+		err := fmt.Errorf("error reading from store: %w", err)
+		return err
+	}
+	if !bytes.Equal(got, value) {
+		return fmt.Errorf("error, store returned %q instead of %q", got, value)
+	}
+	s.pinged = time.Now()
+	return nil
+}
+
 // GetViews_ ...
 func (s *BitcaskStore) GetViews_(collection, id string) (int64, error) {
 	var views uint64
@@ -72,6 +119,9 @@ func (s *BitcaskStore) GetViews_(collection, id string) (int64, error) {
 
 // IncView_ ...
 func (s *BitcaskStore) IncView_(collection, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	views, err := s.GetViews_(collection, id)
 	if err != nil {
 		err := fmt.Errorf("error getting existing views for %s %s: %w", collection, id, err)
@@ -107,8 +157,27 @@ func (s *BitcaskStore) GetViews(id string) (int64, error) {
 	return int64(views), nil
 }
 
+// GetViewsMulti returns the views for all the given ids keyed by id, ids
+// without views count 0. Bitcask has no MGET, so this is a loop over
+// GetViews, but it saves callers from handling errors for each id
+// separately. On error it returns a nil map rather than partial views.
+func (s *BitcaskStore) GetViewsMulti(ids []string) (map[string]int64, error) {
+	views := make(map[string]int64, len(ids))
+	for _, id := range ids {
+		n, err := s.GetViews(id)
+		if err != nil {
+			return nil, err
+		}
+		views[id] = n
+	}
+	return views, nil
+}
+
 // IncViews ...
 func (s *BitcaskStore) IncViews(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	views, err := s.GetViews(id)
 	if err != nil {
 		err := fmt.Errorf("error getting existing views for %s: %w", id, err)
@@ -126,3 +195,369 @@ func (s *BitcaskStore) IncViews(id string) error {
 
 	return nil
 }
+
+// SetViews sets the views for id, e.g. to correct or reset them.
+func (s *BitcaskStore) SetViews(id string, views int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(views))
+	if err := s.db.Put([]byte(fmt.Sprintf("/views/%s", id)), buf); err != nil {
+		err := fmt.Errorf("error storing views for %s: %w", id, err)
+		return err
+	}
+
+	return nil
+}
+
+// dayFormat is the layout used for keys of daily view buckets.
+const dayFormat = "2006-01-02"
+
+// IncDailyViews increments the views bucket of the given day for id.
+func (s *BitcaskStore) IncDailyViews(id string, day time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := []byte(fmt.Sprintf("/daily/%s/%s", id, day.Format(dayFormat)))
+
+	var views uint64
+	rawViews, err := s.db.Get(key)
+	if err != nil {
+		if err != bitcask.ErrKeyNotFound {
+			err := fmt.Errorf("error getting daily views for %s: %w", id, err)
+			return err
+		}
+	} else {
+		views = binary.BigEndian.Uint64(rawViews)
+	}
+
+	buf := make([]byte, 8)
+	views++
+	binary.BigEndian.PutUint64(buf, views)
+	if err := s.db.Put(key, buf); err != nil {
+		err := fmt.Errorf("error storing daily views for %s: %w", id, err)
+		return err
+	}
+
+	return nil
+}
+
+// GetDailyViews returns all daily view buckets for id keyed by day (YYYY-MM-DD).
+func (s *BitcaskStore) GetDailyViews(id string) (map[string]int64, error) {
+	prefix := fmt.Sprintf("/daily/%s/", id)
+	days := make(map[string]int64)
+	err := s.db.Scan([]byte(prefix), func(key []byte) error {
+		day := strings.TrimPrefix(string(key), prefix)
+		// ids may contain slashes, skip buckets of ids nested below this one
+		if strings.Contains(day, "/") {
+			return nil
+		}
+		rawViews, err := s.db.Get(key)
+		if err != nil {
+			return err
+		}
+		days[day] = int64(binary.BigEndian.Uint64(rawViews))
+		return nil
+	})
+	if err != nil {
+		err := fmt.Errorf("error getting daily views for %s: %w", id, err)
+		return nil, err
+	}
+	return days, nil
+}
+
+// statKey returns the key of counter key of the statistic name for id on day.
+// Slashes in key are replaced as they are used to separate the components.
+func statKey(id, name string, day time.Time, key string) []byte {
+	key = strings.ReplaceAll(key, "/", "_")
+	return []byte(fmt.Sprintf("/stats/%s/%s/%s/%s", name, id, day.Format(dayFormat), key))
+}
+
+// IncStat increments counter key of the statistic name for id on day by n.
+func (s *BitcaskStore) IncStat(id, name string, day time.Time, key string, n int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	k := statKey(id, name, day, key)
+
+	var value int64
+	rawValue, err := s.db.Get(k)
+	if err != nil {
+		if err != bitcask.ErrKeyNotFound {
+			err := fmt.Errorf("error getting %s stats for %s: %w", name, id, err)
+			return err
+		}
+	} else {
+		value = int64(binary.BigEndian.Uint64(rawValue))
+	}
+
+	buf := make([]byte, 8)
+	value += n
+	binary.BigEndian.PutUint64(buf, uint64(value))
+	if err := s.db.Put(k, buf); err != nil {
+		err := fmt.Errorf("error storing %s stats for %s: %w", name, id, err)
+		return err
+	}
+
+	return nil
+}
+
+// GetStats returns all counters of the statistic name for id keyed by
+// day (YYYY-MM-DD) and counter key.
+func (s *BitcaskStore) GetStats(id, name string) (map[string]map[string]int64, error) {
+	prefix := fmt.Sprintf("/stats/%s/%s/", name, id)
+	stats := make(map[string]map[string]int64)
+	err := s.db.Scan([]byte(prefix), func(key []byte) error {
+		parts := strings.Split(strings.TrimPrefix(string(key), prefix), "/")
+		// ids may contain slashes, skip stats of ids nested below this one
+		if len(parts) != 2 {
+			return nil
+		}
+		rawValue, err := s.db.Get(key)
+		if err != nil {
+			return err
+		}
+		day, k := parts[0], parts[1]
+		if stats[day] == nil {
+			stats[day] = make(map[string]int64)
+		}
+		stats[day][k] = int64(binary.BigEndian.Uint64(rawValue))
+		return nil
+	})
+	if err != nil {
+		err := fmt.Errorf("error getting %s stats for %s: %w", name, id, err)
+		return nil, err
+	}
+	return stats, nil
+}
+
+// SetPosition stores the playback position of viewer in the video id.
+func (s *BitcaskStore) SetPosition(viewer, id string, position Position) error {
+	data, err := json.Marshal(position)
+	if err != nil {
+		return err
+	}
+	viewer = strings.ReplaceAll(viewer, "/", "_")
+	if err := s.db.Put([]byte(fmt.Sprintf("/positions/%s/%s", viewer, id)), data); err != nil {
+		err := fmt.Errorf("error storing position of %s for %s: %w", viewer, id, err)
+		return err
+	}
+	return nil
+}
+
+// GetPositions returns all playback positions of viewer keyed by video id.
+func (s *BitcaskStore) GetPositions(viewer string) (map[string]Position, error) {
+	viewer = strings.ReplaceAll(viewer, "/", "_")
+	prefix := fmt.Sprintf("/positions/%s/", viewer)
+	positions := make(map[string]Position)
+	err := s.db.Scan([]byte(prefix), func(key []byte) error {
+		data, err := s.db.Get(key)
+		if err != nil {
+			return err
+		}
+		var position Position
+		if err := json.Unmarshal(data, &position); err != nil {
+			return err
+		}
+		positions[strings.TrimPrefix(string(key), prefix)] = position
+		return nil
+	})
+	if err != nil {
+		err := fmt.Errorf("error getting positions of %s: %w", viewer, err)
+		return nil, err
+	}
+	return positions, nil
+}
+
+// SetLike records whether viewer likes the video id and updates the no. of
+// likes accordingly.
+func (s *BitcaskStore) SetLike(viewer, id string, like bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	viewer = strings.ReplaceAll(viewer, "/", "_")
+	likedKey := []byte(fmt.Sprintf("/liked/%s/%s", viewer, id))
+	if s.db.Has(likedKey) == like {
+		return nil
+	}
+
+	var likes uint64
+	rawLikes, err := s.db.Get([]byte(fmt.Sprintf("/likes/%s", id)))
+	if err != nil {
+		if err != bitcask.ErrKeyNotFound {
+			err := fmt.Errorf("error getting likes for %s: %w", id, err)
+			return err
+		}
+	} else {
+		likes = binary.BigEndian.Uint64(rawLikes)
+	}
+
+	if like {
+		likes++
+		err = s.db.Put(likedKey, []byte{1})
+	} else {
+		if likes > 0 {
+			likes--
+		}
+		err = s.db.Delete(likedKey)
+	}
+	if err != nil {
+		err := fmt.Errorf("error storing like of %s for %s: %w", viewer, id, err)
+		return err
+	}
+
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, likes)
+	if err := s.db.Put([]byte(fmt.Sprintf("/likes/%s", id)), buf); err != nil {
+		err := fmt.Errorf("error storing likes for %s: %w", id, err)
+		return err
+	}
+
+	return nil
+}
+
+// HasLiked returns whether viewer likes the video id.
+func (s *BitcaskStore) HasLiked(viewer, id string) (bool, error) {
+	viewer = strings.ReplaceAll(viewer, "/", "_")
+	return s.db.Has([]byte(fmt.Sprintf("/liked/%s/%s", viewer, id))), nil
+}
+
+// GetLikes returns the no. of likes of the video id.
+func (s *BitcaskStore) GetLikes(id string) (int64, error) {
+	rawLikes, err := s.db.Get([]byte(fmt.Sprintf("/likes/%s", id)))
+	if err != nil {
+		if err == bitcask.ErrKeyNotFound {
+			return 0, nil
+		}
+		err := fmt.Errorf("error getting likes for %s: %w", id, err)
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(rawLikes)), nil
+}
+
+// PutComment creates or updates a comment.
+func (s *BitcaskStore) PutComment(comment *Comment) error {
+	data, err := json.Marshal(comment)
+	if err != nil {
+		return err
+	}
+	key := []byte(fmt.Sprintf("/comments/%s/%s", comment.VideoID, comment.ID))
+	if err := s.db.Put(key, data); err != nil {
+		err := fmt.Errorf("error storing comment %s for %s: %w", comment.ID, comment.VideoID, err)
+		return err
+	}
+	return nil
+}
+
+// GetComment returns the comment id of the video videoID.
+func (s *BitcaskStore) GetComment(videoID, id string) (*Comment, error) {
+	data, err := s.db.Get([]byte(fmt.Sprintf("/comments/%s/%s", videoID, id)))
+	if err != nil {
+		err := fmt.Errorf("error getting comment %s for %s: %w", id, videoID, err)
+		return nil, err
+	}
+	var comment Comment
+	if err := json.Unmarshal(data, &comment); err != nil {
+		return nil, err
+	}
+	return &comment, nil
+}
+
+// scanComments returns all comments with keys starting with prefix for
+// which filter returns true, sorted by creation time.
+func (s *BitcaskStore) scanComments(prefix string, filter func(c *Comment) bool) ([]*Comment, error) {
+	var comments []*Comment
+	err := s.db.Scan([]byte(prefix), func(key []byte) error {
+		data, err := s.db.Get(key)
+		if err != nil {
+			return err
+		}
+		var comment Comment
+		if err := json.Unmarshal(data, &comment); err != nil {
+			return err
+		}
+		if filter(&comment) {
+			comments = append(comments, &comment)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(comments, func(i, j int) bool {
+		return comments[i].Created.Before(comments[j].Created)
+	})
+	return comments, nil
+}
+
+// GetComments returns all comments (approved or not) of the video videoID.
+func (s *BitcaskStore) GetComments(videoID string) ([]*Comment, error) {
+	comments, err := s.scanComments(
+		fmt.Sprintf("/comments/%s/", videoID),
+		// ids may contain slashes, skip comments of ids nested below this one
+		func(c *Comment) bool { return c.VideoID == videoID },
+	)
+	if err != nil {
+		err := fmt.Errorf("error getting comments for %s: %w", videoID, err)
+		return nil, err
+	}
+	return comments, nil
+}
+
+// GetPendingComments returns all comments awaiting moderation.
+func (s *BitcaskStore) GetPendingComments() ([]*Comment, error) {
+	comments, err := s.scanComments("/comments/", func(c *Comment) bool { return !c.Approved })
+	if err != nil {
+		err := fmt.Errorf("error getting pending comments: %w", err)
+		return nil, err
+	}
+	return comments, nil
+}
+
+// DeleteComment deletes the comment id of the video videoID.
+func (s *BitcaskStore) DeleteComment(videoID, id string) error {
+	if err := s.db.Delete([]byte(fmt.Sprintf("/comments/%s/%s", videoID, id))); err != nil {
+		err := fmt.Errorf("error deleting comment %s for %s: %w", id, videoID, err)
+		return err
+	}
+	return nil
+}
+
+// Ban bans viewer from commenting and liking.
+func (s *BitcaskStore) Ban(viewer string) error {
+	if err := s.db.Put([]byte(fmt.Sprintf("/bans/%s", viewer)), []byte{1}); err != nil {
+		err := fmt.Errorf("error banning %s: %w", viewer, err)
+		return err
+	}
+	return nil
+}
+
+// Unban lifts the ban of viewer.
+func (s *BitcaskStore) Unban(viewer string) error {
+	if err := s.db.Delete([]byte(fmt.Sprintf("/bans/%s", viewer))); err != nil {
+		err := fmt.Errorf("error unbanning %s: %w", viewer, err)
+		return err
+	}
+	return nil
+}
+
+// IsBanned returns whether viewer is banned.
+func (s *BitcaskStore) IsBanned(viewer string) (bool, error) {
+	return s.db.Has([]byte(fmt.Sprintf("/bans/%s", viewer))), nil
+}
+
+// GetBans returns all banned viewers.
+func (s *BitcaskStore) GetBans() ([]string, error) {
+	var bans []string
+	err := s.db.Scan([]byte("/bans/"), func(key []byte) error {
+		bans = append(bans, strings.TrimPrefix(string(key), "/bans/"))
+		return nil
+	})
+	if err != nil {
+		err := fmt.Errorf("error getting bans: %w", err)
+		return nil, err
+	}
+	sort.Strings(bans)
+	return bans, nil
+}
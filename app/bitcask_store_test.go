@@ -0,0 +1,82 @@
+package app
+
+import (
+	"sync"
+	"testing"
+)
+
+func newTestStore(t *testing.T) Store {
+	t.Helper()
+	store, err := NewBitcaskStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("error opening store: %s", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestIncViewsConcurrent(t *testing.T) {
+	const (
+		goroutines = 16
+		increments = 50
+	)
+	store := newTestStore(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				if err := store.IncViews("foo"); err != nil {
+					t.Errorf("error incrementing views: %s", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	views, err := store.GetViews("foo")
+	if err != nil {
+		t.Fatalf("error getting views: %s", err)
+	}
+	if views != goroutines*increments {
+		t.Errorf("expected %d views, got %d", goroutines*increments, views)
+	}
+}
+
+func TestGetViewsMulti(t *testing.T) {
+	store := newTestStore(t)
+	for i := 0; i < 3; i++ {
+		if err := store.IncViews("foo"); err != nil {
+			t.Fatalf("error incrementing views: %s", err)
+		}
+	}
+
+	views, err := store.GetViewsMulti([]string{"foo", "bar"})
+	if err != nil {
+		t.Fatalf("error getting views: %s", err)
+	}
+	if views["foo"] != 3 || views["bar"] != 0 || len(views) != 2 {
+		t.Errorf("expected map[bar:0 foo:3], got %v", views)
+	}
+}
+
+func TestPingWritesRarely(t *testing.T) {
+	s := newTestStore(t).(*BitcaskStore)
+
+	if err := s.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	written, err := s.db.Get([]byte("/health"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.db.Get([]byte("/health")); string(got) != string(written) {
+		t.Errorf("expected Ping not to write again within %s", pingWriteInterval)
+	}
+}
@@ -0,0 +1,87 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"git.mills.io/prologic/tube/media"
+)
+
+// lastChapterEnd ends the last WebVTT cue of videos whose duration isn't
+// known, players stop it at the end of the video.
+const lastChapterEnd = 359999.999
+
+// podcastChapter is a chapter in the Podcasting 2.0 JSON chapters format,
+// see https://github.com/Podcastindex-org/podcast-namespace/blob/main/chapters/jsonChapters.md
+type podcastChapter struct {
+	StartTime float64 `json:"startTime"`
+	EndTime   float64 `json:"endTime,omitempty"`
+	Title     string  `json:"title"`
+}
+
+// HTTP handler for /c/id.vtt and /c/id.json
+func (a *App) chaptersHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	prefix, ok := vars["prefix"]
+	if ok {
+		id = path.Join(prefix, id)
+	}
+	v, ok := a.Library.Videos[id]
+	if !ok || !a.canView(r, v) || len(v.Chapters) == 0 {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	if vars["ext"] == "json" {
+		chapters := make([]podcastChapter, 0, len(v.Chapters))
+		for i, c := range v.Chapters {
+			pc := podcastChapter{StartTime: c.Start, Title: c.Title}
+			if end := media.ChapterEnd(v.Chapters, i); end > 0 {
+				pc.EndTime = end
+			}
+			chapters = append(chapters, pc)
+		}
+		w.Header().Set("Content-Type", "application/json+chapters")
+		if err := json.NewEncoder(w).Encode(struct {
+			Version  string           `json:"version"`
+			Chapters []podcastChapter `json:"chapters"`
+		}{"1.2.0", chapters}); err != nil {
+			logger(r.Context()).WithError(err).Error("error encoding chapters")
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	if err := writeWebVTT(w, v.Chapters); err != nil {
+		logger(r.Context()).WithError(err).Error("error writing chapters")
+	}
+}
+
+// writeWebVTT writes the sorted chapters as a WebVTT chapters track.
+func writeWebVTT(w io.Writer, chapters []media.Chapter) error {
+	if _, err := io.WriteString(w, "WEBVTT\n"); err != nil {
+		return err
+	}
+	for i, c := range chapters {
+		end := media.ChapterEnd(chapters, i)
+		if end < 0 {
+			end = lastChapterEnd
+		}
+		// cue text can't contain blank lines or "-->"
+		title := strings.Join(strings.Fields(strings.ReplaceAll(c.Title, "-->", "->")), " ")
+		if _, err := fmt.Fprintf(
+			w, "\n%d\n%s --> %s\n%s\n",
+			i+1, media.FormatTimestamp(c.Start), media.FormatTimestamp(end), title,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,378 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"git.mills.io/prologic/tube/media"
+
+	"github.com/gorilla/mux"
+	shortuuid "github.com/lithammer/shortuuid/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxAuthorLength is the maximum length of the name of anonymous commenters.
+const maxAuthorLength = 50
+
+// commentIDPattern matches the ids of comments, see shortuuid.
+var commentIDPattern = regexp.MustCompile(`^[A-Za-z0-9]+$`)
+
+// rateLimiter limits the no. of actions per key within a sliding window.
+type rateLimiter struct {
+	mu   sync.Mutex
+	hits map[string][]time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{hits: make(map[string][]time.Time)}
+}
+
+// Allow records an action for key and returns whether it is within limit
+// actions per window.
+func (rl *rateLimiter) Allow(key string, limit int, window time.Duration) bool {
+	if limit <= 0 {
+		return true
+	}
+
+	now := time.Now()
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	var hits []time.Time
+	for _, t := range rl.hits[key] {
+		if now.Sub(t) < window {
+			hits = append(hits, t)
+		}
+	}
+	if len(hits) >= limit {
+		rl.hits[key] = hits
+		return false
+	}
+	rl.hits[key] = append(hits, now)
+
+	// forget about keys that have been quiet for a while
+	for k, ts := range rl.hits {
+		if len(ts) == 0 || now.Sub(ts[len(ts)-1]) > window {
+			delete(rl.hits, k)
+		}
+	}
+
+	return true
+}
+
+// commentThread is a comment with its (approved) replies.
+type commentThread struct {
+	*Comment
+	Replies []*commentThread
+}
+
+// threadComments arranges the approved comments into threads, replies to
+// missing or unapproved comments are dropped.
+func threadComments(comments []*Comment) []*commentThread {
+	threads := make(map[string]*commentThread)
+	for _, c := range comments {
+		if c.Approved {
+			threads[c.ID] = &commentThread{Comment: c}
+		}
+	}
+	var roots []*commentThread
+	for _, c := range comments {
+		t, ok := threads[c.ID]
+		if !ok {
+			continue
+		}
+		if c.ParentID == "" {
+			roots = append(roots, t)
+		} else if parent, ok := threads[c.ParentID]; ok {
+			parent.Replies = append(parent.Replies, t)
+		}
+	}
+	return roots
+}
+
+// isModerator returns whether the user making the request may moderate
+// comments, these are the same users who may access the admin pages.
+func (a *App) isModerator(r *http.Request) bool {
+	if a.config().Auth.Sandstorm {
+		return strings.Contains(r.Header.Get("X-Sandstorm-Permissions"), "admin")
+	}
+	_, _, ok := a.authenticatedUser(r)
+	return ok
+}
+
+// canView returns whether the video v may be shown to the viewer of r:
+// private videos are only shown to moderators.
+func (a *App) canView(r *http.Request, v *media.Video) bool {
+	return !v.IsPrivate() || a.isModerator(r)
+}
+
+// commentsEnabled returns whether comments are enabled for the video v.
+func (a *App) commentsEnabled(v *media.Video) bool {
+	p, ok := a.Library.PathOf(v)
+	return ok && !p.DisableComments
+}
+
+// banKeys returns the keys under which the author of a comment is banned:
+// the client IP address and, if authenticated, the user. Viewer cookies are
+// chosen by the client, so they are no good for bans.
+func banKeys(ip, viewer string) []string {
+	keys := []string{"ip:" + ip}
+	if strings.HasPrefix(viewer, "user:") {
+		keys = append(keys, viewer)
+	}
+	return keys
+}
+
+// allowViewer checks that the viewer making the request isn't banned nor
+// exceeds the rate limit and writes an error response if so.
+func (a *App) allowViewer(w http.ResponseWriter, r *http.Request) bool {
+	ip, viewer := a.clientIP(r), a.viewerID(r)
+	for _, key := range banKeys(ip, viewer) {
+		banned, err := a.Store.IsBanned(key)
+		if err != nil {
+			log.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return false
+		}
+		if banned {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return false
+		}
+	}
+
+	// authenticated users may share an IP address (e.g: behind NAT)
+	key := "ip:" + ip
+	if strings.HasPrefix(viewer, "user:") {
+		key = viewer
+	}
+	cfg := a.config().Comments
+	if !a.limiter.Allow(key, cfg.RateLimit, time.Duration(cfg.RateWindow)*time.Second) {
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// isComment returns whether id is a comment of the video videoID. Only plain
+// ids are accepted, as comments are keyed by video and id others could point
+// at comments of another video.
+func (a *App) isComment(videoID, id string) bool {
+	if !commentIDPattern.MatchString(id) {
+		return false
+	}
+	c, err := a.Store.GetComment(videoID, id)
+	return err == nil && c.VideoID == videoID && c.ID == id
+}
+
+// HTTP handler for /like/id
+func (a *App) likeHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	prefix, ok := vars["prefix"]
+	if ok {
+		id = path.Join(prefix, id)
+	}
+
+	if v, ok := a.Library.Videos[id]; !ok || !a.canView(r, v) {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	if !a.allowViewer(w, r) {
+		return
+	}
+
+	viewer := a.viewerID(r)
+	like := r.FormValue("like") != "false"
+	if err := a.Store.SetLike(viewer, id, like); err != nil {
+		err := fmt.Errorf("error updating like for %s: %w", id, err)
+		logger(r.Context()).Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, fmt.Sprintf("/v/%s", id), http.StatusSeeOther)
+}
+
+// HTTP handler for /comment/id
+func (a *App) commentHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	prefix, ok := vars["prefix"]
+	if ok {
+		id = path.Join(prefix, id)
+	}
+
+	v, ok := a.Library.Videos[id]
+	if !ok || !a.canView(r, v) {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	if !a.commentsEnabled(v) {
+		http.Error(w, "comments are disabled for this video", http.StatusForbidden)
+		return
+	}
+
+	body := strings.TrimSpace(r.FormValue("body"))
+	if body == "" {
+		http.Error(w, "error, no comment supplied", http.StatusBadRequest)
+		return
+	}
+	if utf8.RuneCountInString(body) > a.config().Comments.MaxLength {
+		err := fmt.Errorf("error, comment exceeds %d characters", a.config().Comments.MaxLength)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	parentID := r.FormValue("parent")
+	if parentID != "" && !a.isComment(id, parentID) {
+		http.Error(w, "error, invalid parent comment", http.StatusBadRequest)
+		return
+	}
+
+	if !a.allowViewer(w, r) {
+		return
+	}
+
+	// Comments from authenticated users are approved right away,
+	// everything else goes into the moderation queue.
+	_, author, authenticated := a.authenticatedUser(r)
+	if !authenticated {
+		author = strings.TrimSpace(r.FormValue("name"))
+		if author == "" {
+			author = "Anonymous"
+		}
+		if utf8.RuneCountInString(author) > maxAuthorLength {
+			author = string([]rune(author)[:maxAuthorLength])
+		}
+	}
+
+	comment := &Comment{
+		ID:       shortuuid.New(),
+		VideoID:  id,
+		ParentID: parentID,
+		Author:   author,
+		Viewer:   a.viewerID(r),
+		IP:       a.clientIP(r),
+		Body:     body,
+		Created:  time.Now(),
+		Approved: authenticated,
+	}
+	if err := a.Store.PutComment(comment); err != nil {
+		err := fmt.Errorf("error storing comment for %s: %w", id, err)
+		logger(r.Context()).Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if comment.Approved {
+		http.Redirect(w, r, fmt.Sprintf("/v/%s#comment-%s", id, comment.ID), http.StatusSeeOther)
+	} else {
+		http.Redirect(w, r, fmt.Sprintf("/v/%s?comment=pending#comments", id), http.StatusSeeOther)
+	}
+}
+
+// HTTP handler for /admin/comments
+func (a *App) moderationHandler(w http.ResponseWriter, r *http.Request) {
+	pending, err := a.Store.GetPendingComments()
+	if err != nil {
+		logger(r.Context()).Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	bans, err := a.Store.GetBans()
+	if err != nil {
+		logger(r.Context()).Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ctx := &struct {
+		Config  *Config
+		Playing *media.Video
+		Pending []*Comment
+		Bans    []string
+	}{
+		Config:  a.config(),
+		Playing: &media.Video{ID: ""},
+		Pending: pending,
+		Bans:    bans,
+	}
+	a.render("comments", w, ctx)
+}
+
+// HTTP handler for /admin/comments/{action}
+func (a *App) moderateHandler(w http.ResponseWriter, r *http.Request) {
+	action := mux.Vars(r)["action"]
+	videoID := r.FormValue("video_id")
+	id := r.FormValue("id")
+
+	var err error
+	switch action {
+	case "approve":
+		var comment *Comment
+		comment, err = a.Store.GetComment(videoID, id)
+		if err == nil {
+			comment.Approved = true
+			err = a.Store.PutComment(comment)
+		}
+	case "delete":
+		err = a.Store.DeleteComment(videoID, id)
+	case "ban":
+		// ban the author and throw away the comment
+		var comment *Comment
+		comment, err = a.Store.GetComment(videoID, id)
+		if err == nil && comment.IP == "" {
+			err = fmt.Errorf("comment %s has no IP address to ban", id)
+		}
+		if err == nil {
+			for _, key := range banKeys(comment.IP, comment.Viewer) {
+				if err = a.Store.Ban(key); err != nil {
+					break
+				}
+			}
+		}
+		if err == nil {
+			err = a.Store.DeleteComment(videoID, id)
+		}
+	case "unban":
+		err = a.Store.Unban(r.FormValue("viewer"))
+	default:
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		err := fmt.Errorf("error moderating comments (%s): %w", action, err)
+		logger(r.Context()).Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	redirect := r.FormValue("redirect")
+	if !isLocalRedirect(redirect) {
+		redirect = "/admin/comments"
+	}
+	http.Redirect(w, r, redirect, http.StatusSeeOther)
+}
+
+// isLocalRedirect returns whether redirecting to s stays on this site, i.e:
+// it's an absolute path. Browsers treat backslashes as slashes, so these are
+// rejected too (e.g: /\evil.com is //evil.com).
+func isLocalRedirect(s string) bool {
+	if !strings.HasPrefix(s, "/") || strings.Contains(s, "\\") {
+		return false
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+	return u.Scheme == "" && u.Host == "" && strings.HasPrefix(u.Path, "/")
+}
@@ -0,0 +1,96 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.mills.io/prologic/tube/media"
+	"git.mills.io/prologic/tube/transcoder"
+)
+
+func TestIsLocalRedirect(t *testing.T) {
+	tests := map[string]bool{
+		"/admin/comments":     true,
+		"/v/foo#comments":     true,
+		"/v/foo?sort=views":   true,
+		"":                    false,
+		"admin/comments":      false,
+		"//evil.com":          false,
+		"/\\evil.com":         false,
+		"\\\\evil.com":        false,
+		"https://evil.com/":   false,
+		"/\t/evil.com":        false,
+		"javascript:alert(1)": false,
+	}
+	for redirect, local := range tests {
+		if got := isLocalRedirect(redirect); got != local {
+			t.Errorf("isLocalRedirect(%q) = %t, expected %t", redirect, got, local)
+		}
+	}
+}
+
+func TestIsComment(t *testing.T) {
+	a := &App{Store: newTestStore(t)}
+	if err := a.Store.PutComment(&Comment{ID: "c1", VideoID: "p/xyz", Body: "hi"}); err != nil {
+		t.Fatalf("error storing comment: %s", err)
+	}
+
+	tests := []struct {
+		videoID, id string
+		expected    bool
+	}{
+		{"p/xyz", "c1", true},
+		{"p/xyz", "c2", false},
+		{"p", "xyz/c1", false},
+		{"p/abc", "../xyz/c1", false},
+		{"p/xyz", "", false},
+	}
+	for _, test := range tests {
+		if got := a.isComment(test.videoID, test.id); got != test.expected {
+			t.Errorf("isComment(%q, %q) = %t, expected %t", test.videoID, test.id, got, test.expected)
+		}
+	}
+}
+
+func TestPrivateVideoInteractions(t *testing.T) {
+	a := newPipelineTestApp(t, &transcoder.Fake{})
+	for name, sidecar := range map[string]string{"public": "", "private": "visibility: private\n"} {
+		vf := filepath.Join(a.config().Library[0].Path, name+".mp4")
+		if err := os.WriteFile(vf, testVideo, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if sidecar != "" {
+			if err := os.WriteFile(media.SidecarPath(vf), []byte(sidecar), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := a.Library.Add(vf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	form := url.Values{
+		"like":     {"true"},
+		"body":     {"Hello"},
+		"t":        {"10"},
+		"event":    {"play"},
+		"watched":  {"10"},
+		"duration": {"60"},
+	}
+	for _, route := range []string{"/like/", "/comment/", "/p/", "/b/"} {
+		for id, found := range map[string]bool{"public": true, "private": false} {
+			r := httptest.NewRequest("POST", route+id, strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := httptest.NewRecorder()
+			a.Router.ServeHTTP(w, r)
+			if got := w.Code != http.StatusNotFound; got != found {
+				t.Errorf("POST %s%s: expected found %t, got %d", route, id, found, w.Code)
+			}
+		}
+	}
+}
@@ -1,8 +1,23 @@
 package app
 
 import (
+	"bytes"
 	"encoding/json"
-	"os"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"git.mills.io/prologic/tube/media"
+	"git.mills.io/prologic/tube/transcoder"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
 )
 
 // Config settings for main App.
@@ -12,6 +27,11 @@ type Config struct {
 	Thumbnailer *ThumbnailerConfig `json:"thumbnailer"`
 	Transcoder  *TranscoderConfig  `json:"transcoder"`
 	Feed        *FeedConfig        `json:"feed"`
+	Views       *ViewsConfig       `json:"views"`
+	Comments    *CommentsConfig    `json:"comments"`
+	Auth        *AuthConfig        `json:"auth"`
+	Log         *LogConfig         `json:"log"`
+	Metrics     *MetricsConfig     `json:"metrics"`
 	Copyright   *Copyright         `json:"copyright"`
 }
 
@@ -20,6 +40,8 @@ type PathConfig struct {
 	Path                   string `json:"path"`
 	Prefix                 string `json:"prefix"`
 	PreserveUploadFilename bool   `json:"preserve_upload_filename,omitempty"`
+	DisableComments        bool   `json:"disable_comments,omitempty"`
+	Profile                string `json:"profile,omitempty"`
 }
 
 // ServerConfig settings for App Server.
@@ -30,12 +52,63 @@ type ServerConfig struct {
 	UploadPath             string `json:"upload_path"`
 	PreserveUploadFilename bool   `json:"preserve_upload_filename,omitempty"`
 	MaxUploadSize          int64  `json:"max_upload_size"`
+	MinFreeSpace           int64  `json:"min_free_space"`
+	ShutdownTimeout        int    `json:"shutdown_timeout"`
+	// TrustedProxies are the IP addresses or CIDR ranges of reverse proxies
+	// whose X-Forwarded-For, X-Real-IP and X-Request-ID headers are honoured,
+	// "unix" trusts peers on Unix domain sockets.
+	TrustedProxies []string `json:"trusted_proxies"`
+	// TLS serves HTTPS (and HTTP/2) if configured.
+	TLS *TLSConfig `json:"tls"`
+	// Listen selects the listener: "tcp" on host:port, "unix" on socket or
+	// "systemd" for a socket passed by systemd socket activation.
+	Listen string `json:"listen"`
+	// Socket is the path of the Unix domain socket, SocketMode its octal
+	// permissions (e.g: "0660") and SocketGroup its group (e.g: "www-data").
+	Socket      string `json:"socket"`
+	SocketMode  string `json:"socket_mode"`
+	SocketGroup string `json:"socket_group"`
+}
+
+// TLSConfig settings for serving HTTPS with a certificate from files or
+// obtained via ACME (e.g: Let's Encrypt).
+type TLSConfig struct {
+	// Cert and Key are the PEM encoded certificate (chain) and private key,
+	// reloaded when the files change.
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	// RedirectPort if set serves plain HTTP on this port redirecting to
+	// HTTPS (and answering ACME http-01 challenges).
+	RedirectPort int         `json:"redirect_port"`
+	ACME         *ACMEConfig `json:"acme"`
+}
+
+// ACMEConfig settings for obtaining certificates automatically via ACME.
+type ACMEConfig struct {
+	Enabled bool     `json:"enabled"`
+	Domains []string `json:"domains"`
+	Email   string   `json:"email"`
+	// DirectoryURL of the ACME server, Let's Encrypt's by default.
+	DirectoryURL string `json:"directory_url"`
+	// CacheDir stores the account key and certificates.
+	CacheDir string `json:"cache_dir"`
+	// CACert is an optional PEM file of additional root certificates to
+	// trust for the ACME server (e.g: a local Pebble instance).
+	CACert string `json:"ca_cert"`
+}
+
+// Enabled returns whether HTTPS is to be served.
+func (c *TLSConfig) Enabled() bool {
+	return c != nil && (c.Cert != "" || (c.ACME != nil && c.ACME.Enabled))
 }
 
 // ThumbnailerConfig settings for Transcoder
 type ThumbnailerConfig struct {
 	Timeout           int `json:"timeout"`
 	PositionFromStart int `json:"position_from_start"`
+	// Waveform generates an image of the waveform as the thumbnail of audio
+	// files without cover art.
+	Waveform bool `json:"waveform"`
 }
 
 // Sizes a map of ffmpeg -s option to suffix. e.g: hd720 -> #720p
@@ -45,6 +118,51 @@ type Sizes map[string]string
 type TranscoderConfig struct {
 	Timeout int   `json:"timeout"`
 	Sizes   Sizes `json:"sizes"`
+
+	// DefaultProfile is the profile of collections which don't set one.
+	DefaultProfile string                         `json:"default_profile"`
+	Profiles       map[string]*transcoder.Profile `json:"profiles"`
+
+	Backfill *BackfillConfig `json:"backfill"`
+	Workers  *WorkersConfig  `json:"workers"`
+}
+
+// BackfillConfig settings for reconciling the library with the transcoder
+// settings (see App.Backfill).
+type BackfillConfig struct {
+	// OnStartup runs a backfill when the server starts.
+	OnStartup bool `json:"on_startup"`
+	// Concurrency is the maximum number of videos processed at a time.
+	Concurrency int `json:"concurrency"`
+	// Cleanup removes renditions of sizes and formats no longer configured.
+	Cleanup bool `json:"cleanup"`
+}
+
+// WorkersConfig settings for distributing transcodes to remote workers
+// (tube worker) instead of running ffmpeg on the server.
+type WorkersConfig struct {
+	// Enabled queues all transcodes and thumbnails for the workers, probes
+	// still run on the server (with ffprobe).
+	Enabled bool `json:"enabled"`
+	// Token must be presented by workers as "Authorization: Bearer <token>".
+	Token string `json:"token"`
+	// LeaseTimeout is the seconds after which a task whose worker stopped
+	// reporting progress (e.g: crashed) is reassigned.
+	LeaseTimeout int `json:"lease_timeout"`
+	// MaxAttempts is the no. of times a task is tried before it fails.
+	MaxAttempts int `json:"max_attempts"`
+}
+
+// Profile returns the transcoding profile of the library path p.
+func (c *TranscoderConfig) Profile(p *media.Path) (string, *transcoder.Profile) {
+	name := c.DefaultProfile
+	if p.Profile != "" {
+		name = p.Profile
+	}
+	if profile, ok := c.Profiles[name]; ok {
+		return name, profile
+	}
+	return transcoder.DefaultProfileName, transcoder.DefaultProfile()
 }
 
 // FeedConfig settings for App Feed.
@@ -60,6 +178,45 @@ type FeedConfig struct {
 	Copyright string `json:"copyright"`
 }
 
+// ViewsConfig settings for view accounting.
+type ViewsConfig struct {
+	SessionWindow int `json:"session_window"`
+	MinWatchTime  int `json:"min_watch_time"`
+	MaxSessions   int `json:"max_sessions"`
+}
+
+// CommentsConfig settings for likes and comments.
+type CommentsConfig struct {
+	MaxLength  int `json:"max_length"`
+	RateLimit  int `json:"rate_limit"`
+	RateWindow int `json:"rate_window"`
+}
+
+// AuthConfig settings for authentication of uploaders and admins.
+type AuthConfig struct {
+	// Password required for uploading and the admin pages (username
+	// "uploader"), empty means no authentication is required.
+	Password string `json:"password"`
+	// Sandstorm delegates authentication to Sandstorm's permissions.
+	Sandstorm bool `json:"sandstorm"`
+}
+
+// LogConfig settings for logging.
+type LogConfig struct {
+	// Format of log lines, either "text" or "json".
+	Format string `json:"format"`
+	// AccessLog logs every request served.
+	AccessLog bool `json:"access_log"`
+}
+
+// MetricsConfig settings for the Prometheus /metrics endpoint.
+type MetricsConfig struct {
+	// Enabled serves /metrics, it responds with 404 Not Found otherwise.
+	Enabled bool `json:"enabled"`
+	// Token if set must be presented as "Authorization: Bearer <token>".
+	Token string `json:"token"`
+}
+
 // Copyright text for App.
 type Copyright struct {
 	Content string `json:"content"`
@@ -82,31 +239,425 @@ func DefaultConfig() *Config {
 			UploadPath:             "uploads",
 			PreserveUploadFilename: false,
 			MaxUploadSize:          104857600,
+			MinFreeSpace:           209715200,
+			ShutdownTimeout:        30,
+			TrustedProxies:         []string{},
+			Listen:                 "tcp",
+			Socket:                 "",
+			SocketMode:             "0660",
+			SocketGroup:            "",
+			TLS: &TLSConfig{
+				Cert:         "",
+				Key:          "",
+				RedirectPort: 0,
+				ACME: &ACMEConfig{
+					Enabled:      false,
+					Domains:      []string{},
+					Email:        "",
+					DirectoryURL: "https://acme-v02.api.letsencrypt.org/directory",
+					CacheDir:     "certs",
+					CACert:       "",
+				},
+			},
 		},
 		Thumbnailer: &ThumbnailerConfig{
-			Timeout: 60,
+			Timeout:           60,
 			PositionFromStart: 3,
+			Waveform:          false,
 		},
 		Transcoder: &TranscoderConfig{
 			Timeout: 300,
 			Sizes:   Sizes(nil),
+
+			DefaultProfile: transcoder.DefaultProfileName,
+			Profiles: map[string]*transcoder.Profile{
+				transcoder.DefaultProfileName: transcoder.DefaultProfile(),
+			},
+			Backfill: &BackfillConfig{
+				OnStartup:   false,
+				Concurrency: 1,
+				Cleanup:     true,
+			},
+			Workers: &WorkersConfig{
+				Enabled:      false,
+				Token:        "",
+				LeaseTimeout: 60,
+				MaxAttempts:  3,
+			},
 		},
 		Feed: &FeedConfig{
 			ExternalURL: "http://localhost:8000",
 		},
+		Views: &ViewsConfig{
+			SessionWindow: 1800,
+			MinWatchTime:  0,
+			MaxSessions:   100,
+		},
+		Comments: &CommentsConfig{
+			MaxLength:  2000,
+			RateLimit:  5,
+			RateWindow: 300,
+		},
+		Auth: &AuthConfig{
+			Password:  "",
+			Sandstorm: false,
+		},
+		Log: &LogConfig{
+			Format:    "text",
+			AccessLog: true,
+		},
+		Metrics: &MetricsConfig{
+			Enabled: false,
+			Token:   "",
+		},
 		Copyright: &Copyright{
 			Content: "All Content herein Public Domain and User Contributed.",
 		},
 	}
 }
 
-// ReadFile reads a JSON file into Config.
+// ReadFile reads a configuration file into Config. The format is chosen by
+// extension: .yaml / .yml for YAML, .toml for TOML and JSON otherwise.
 func (c *Config) ReadFile(path string) error {
-	f, err := os.Open(path)
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	d := json.NewDecoder(f)
-	return d.Decode(c)
+
+	// YAML and TOML are converted to JSON first so that all formats share
+	// the same keys (json tags) and strict decoding.
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		var v interface{}
+		if err := yaml.Unmarshal(data, &v); err != nil {
+			return fmt.Errorf("error parsing %s: %w", path, err)
+		}
+		if v == nil {
+			return nil
+		}
+		if data, err = json.Marshal(v); err != nil {
+			return fmt.Errorf("error parsing %s: %w", path, err)
+		}
+	case ".toml":
+		var v map[string]interface{}
+		if _, err := toml.Decode(string(data), &v); err != nil {
+			return fmt.Errorf("error parsing %s: %w", path, err)
+		}
+		if data, err = json.Marshal(v); err != nil {
+			return fmt.Errorf("error parsing %s: %w", path, err)
+		}
+	}
+
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	if err := d.Decode(c); err != nil {
+		if e, ok := err.(*json.UnmarshalTypeError); ok && e.Field != "" {
+			return fmt.Errorf("error parsing %s: %s: expected %s, got %s", path, e.Field, e.Type, e.Value)
+		}
+		return fmt.Errorf("error parsing %s: %w", path, err)
+	}
+	if d.More() {
+		return fmt.Errorf("error parsing %s: unexpected data after configuration", path)
+	}
+	return nil
+}
+
+// ValidationError is a problem with a single configuration item,
+// identified by its JSON path (e.g: library[0].prefix).
+type ValidationError struct {
+	Path    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+// ValidationErrors are all the problems found by Config.Validate.
+type ValidationErrors []*ValidationError
+
+func (errs ValidationErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+	return fmt.Sprintf("invalid configuration:\n  %s", strings.Join(msgs, "\n  "))
+}
+
+// suffixRegexp matches valid transcoder.sizes suffixes.
+var suffixRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Validate checks the configuration for values that would only fail (or
+// silently misbehave) at runtime and returns all problems found as
+// ValidationErrors.
+func (c *Config) Validate() error {
+	var errs ValidationErrors
+	fail := func(path, format string, args ...interface{}) {
+		errs = append(errs, &ValidationError{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if len(c.Library) == 0 {
+		fail("library", "at least one library path is required")
+	}
+	paths := make(map[string]int)
+	prefixes := make(map[string]int)
+	for i, pc := range c.Library {
+		key := fmt.Sprintf("library[%d]", i)
+		if pc == nil {
+			fail(key, "is required")
+			continue
+		}
+		if pc.Path == "" {
+			fail(key+".path", "is required")
+		} else if j, ok := paths[filepath.Clean(pc.Path)]; ok {
+			fail(key+".path", "duplicate library path %q (see library[%d])", pc.Path, j)
+		} else {
+			paths[filepath.Clean(pc.Path)] = i
+		}
+		if strings.Contains(pc.Prefix, "/") {
+			fail(key+".prefix", "must not contain \"/\": %q", pc.Prefix)
+		} else if j, ok := prefixes[pc.Prefix]; ok {
+			fail(key+".prefix", "duplicate library prefix %q (see library[%d])", pc.Prefix, j)
+		} else {
+			prefixes[pc.Prefix] = i
+		}
+	}
+
+	if s := c.Server; s == nil {
+		fail("server", "is required")
+	} else {
+		if s.Port < 0 || s.Port > 65535 {
+			fail("server.port", "must be between 0 (any free port) and 65535, got %d", s.Port)
+		}
+		if s.StorePath == "" {
+			fail("server.store_path", "is required")
+		}
+		if s.UploadPath == "" {
+			fail("server.upload_path", "is required")
+		}
+		if s.MaxUploadSize <= 0 {
+			fail("server.max_upload_size", "must be positive, got %d", s.MaxUploadSize)
+		}
+		if s.MinFreeSpace < 0 {
+			fail("server.min_free_space", "must not be negative (0 disables the check), got %d", s.MinFreeSpace)
+		}
+		if s.ShutdownTimeout < 0 {
+			fail("server.shutdown_timeout", "must not be negative, got %d", s.ShutdownTimeout)
+		}
+		if t := s.TLS; t != nil {
+			if (t.Cert == "") != (t.Key == "") {
+				fail("server.tls", "cert and key must be set together")
+			}
+			if t.RedirectPort < 0 || t.RedirectPort > 65535 {
+				fail("server.tls.redirect_port", "must be between 0 and 65535, got %d", t.RedirectPort)
+			} else if t.RedirectPort != 0 && t.RedirectPort == s.Port {
+				fail("server.tls.redirect_port", "must differ from server.port %d", s.Port)
+			}
+			if a := t.ACME; a != nil && a.Enabled {
+				if t.Cert != "" {
+					fail("server.tls.acme.enabled", "cannot be combined with server.tls.cert")
+				}
+				if len(a.Domains) == 0 {
+					fail("server.tls.acme.domains", "at least one domain is required")
+				}
+				if err := validateURL(a.DirectoryURL); err != nil {
+					fail("server.tls.acme.directory_url", "%s", err)
+				}
+				if a.CacheDir == "" {
+					fail("server.tls.acme.cache_dir", "is required")
+				}
+			}
+		}
+		switch s.Listen {
+		case "tcp", "systemd":
+		case "unix":
+			if s.Socket == "" {
+				fail("server.socket", "is required with server.listen \"unix\"")
+			}
+			if s.SocketMode != "" {
+				if mode, err := strconv.ParseUint(s.SocketMode, 8, 32); err != nil || mode > 0o777 {
+					fail("server.socket_mode", "must be octal permissions (e.g: \"0660\"), got %q", s.SocketMode)
+				}
+			}
+		default:
+			fail("server.listen", "must be \"tcp\", \"unix\" or \"systemd\", got %q", s.Listen)
+		}
+		for i, proxy := range s.TrustedProxies {
+			if proxy == unixProxy {
+				continue
+			} else if strings.Contains(proxy, "/") {
+				if _, _, err := net.ParseCIDR(proxy); err != nil {
+					fail(fmt.Sprintf("server.trusted_proxies[%d]", i), "invalid CIDR range %q", proxy)
+				}
+			} else if net.ParseIP(proxy) == nil {
+				fail(fmt.Sprintf("server.trusted_proxies[%d]", i), "invalid IP address %q", proxy)
+			}
+		}
+	}
+
+	if t := c.Thumbnailer; t == nil {
+		fail("thumbnailer", "is required")
+	} else {
+		if t.Timeout <= 0 {
+			fail("thumbnailer.timeout", "must be positive, got %d", t.Timeout)
+		}
+		if t.PositionFromStart < 0 {
+			fail("thumbnailer.position_from_start", "must not be negative, got %d", t.PositionFromStart)
+		}
+	}
+
+	if t := c.Transcoder; t == nil {
+		fail("transcoder", "is required")
+	} else {
+		if t.Timeout <= 0 {
+			fail("transcoder.timeout", "must be positive, got %d", t.Timeout)
+		}
+		sizes := make([]string, 0, len(t.Sizes))
+		for size := range t.Sizes {
+			sizes = append(sizes, size)
+		}
+		sort.Strings(sizes)
+		suffixes := make(map[string]string)
+		for _, size := range sizes {
+			key := fmt.Sprintf("transcoder.sizes.%s", size)
+			if _, _, ok := transcoder.ParseSize(size); !ok {
+				fail(key, "invalid size %q, expected WIDTHxHEIGHT (e.g: 1280x720) or an ffmpeg abbreviation (e.g: hd720)", size)
+			}
+			suffix := t.Sizes[size]
+			if !suffixRegexp.MatchString(suffix) {
+				fail(key, "invalid suffix %q, expected letters, digits, - or _ (e.g: 720p)", suffix)
+			} else if other, ok := suffixes[suffix]; ok {
+				fail(key, "duplicate suffix %q (see transcoder.sizes.%s)", suffix, other)
+			} else {
+				suffixes[suffix] = size
+			}
+		}
+		names := make([]string, 0, len(t.Profiles))
+		for name := range t.Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			key := fmt.Sprintf("transcoder.profiles.%s", name)
+			if t.Profiles[name] == nil {
+				fail(key, "is required")
+				continue
+			}
+			for _, problem := range t.Profiles[name].Validate() {
+				fail(key, "%s", problem)
+			}
+		}
+		if b := t.Backfill; b == nil {
+			fail("transcoder.backfill", "is required")
+		} else if b.Concurrency <= 0 {
+			fail("transcoder.backfill.concurrency", "must be positive, got %d", b.Concurrency)
+		}
+		if w := t.Workers; w == nil {
+			fail("transcoder.workers", "is required")
+		} else {
+			if w.Enabled && w.Token == "" {
+				fail("transcoder.workers.token", "is required with transcoder.workers.enabled")
+			}
+			if w.LeaseTimeout <= 0 {
+				fail("transcoder.workers.lease_timeout", "must be positive, got %d", w.LeaseTimeout)
+			}
+			if w.MaxAttempts <= 0 {
+				fail("transcoder.workers.max_attempts", "must be positive, got %d", w.MaxAttempts)
+			}
+		}
+		if _, ok := t.Profiles[t.DefaultProfile]; !ok {
+			fail("transcoder.default_profile", "no such profile %q", t.DefaultProfile)
+		}
+		for i, pc := range c.Library {
+			if pc == nil || pc.Profile == "" {
+				continue
+			}
+			if _, ok := t.Profiles[pc.Profile]; !ok {
+				fail(fmt.Sprintf("library[%d].profile", i), "no such profile %q", pc.Profile)
+			}
+		}
+	}
+
+	if f := c.Feed; f == nil {
+		fail("feed", "is required")
+	} else {
+		if f.ExternalURL != "" {
+			if err := validateURL(f.ExternalURL); err != nil {
+				fail("feed.external_url", "%s", err)
+			}
+		}
+		if f.Link != "" {
+			if err := validateURL(f.Link); err != nil {
+				fail("feed.link", "%s", err)
+			}
+		}
+	}
+
+	if v := c.Views; v == nil {
+		fail("views", "is required")
+	} else {
+		if v.SessionWindow <= 0 {
+			fail("views.session_window", "must be positive, got %d", v.SessionWindow)
+		}
+		if v.MinWatchTime < 0 {
+			fail("views.min_watch_time", "must not be negative, got %d", v.MinWatchTime)
+		}
+		if v.MaxSessions < 0 {
+			fail("views.max_sessions", "must not be negative, got %d", v.MaxSessions)
+		}
+	}
+
+	if cc := c.Comments; cc == nil {
+		fail("comments", "is required")
+	} else {
+		if cc.MaxLength <= 0 {
+			fail("comments.max_length", "must be positive, got %d", cc.MaxLength)
+		}
+		if cc.RateLimit < 0 {
+			fail("comments.rate_limit", "must not be negative (0 disables rate limiting), got %d", cc.RateLimit)
+		}
+		if cc.RateLimit > 0 && cc.RateWindow <= 0 {
+			fail("comments.rate_window", "must be positive, got %d", cc.RateWindow)
+		}
+	}
+
+	if c.Auth == nil {
+		fail("auth", "is required")
+	}
+
+	if l := c.Log; l == nil {
+		fail("log", "is required")
+	} else if l.Format != "text" && l.Format != "json" {
+		fail("log.format", "must be \"text\" or \"json\", got %q", l.Format)
+	}
+
+	if c.Metrics == nil {
+		fail("metrics", "is required")
+	}
+
+	if c.Copyright == nil {
+		fail("copyright", "is required")
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateURL checks that s is an absolute http(s) URL. Only its syntax is
+// checked, it isn't resolved (a feed.external_url is usually served by this
+// very server, which isn't up yet).
+func validateURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("invalid URL %q: %w", s, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid URL %q, expected an absolute http:// or https:// URL", s)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid URL %q, missing host", s)
+	}
+	return nil
 }
@@ -0,0 +1,60 @@
+package app
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// isSafeMethod returns whether method doesn't change any state.
+func isSafeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	return false
+}
+
+// isSameOrigin returns whether r was sent by one of our own pages rather
+// than a cross-site form or script, as browsers send credentials (e.g: the
+// admin password) along with those too.
+//
+// Browsers tell with Sec-Fetch-Site, older ones by the Origin (or Referer)
+// header which has to name this host, the host forwarded by one of our
+// proxies or the host of feed.external_url. Requests without any of them
+// aren't from a browser (e.g: curl) and are allowed.
+func (a *App) isSameOrigin(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		// "none" is the user navigating (e.g: from a bookmark)
+		return site == "same-origin" || site == "none"
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		// including the "null" origin of sandboxed or privacy sensitive contexts
+		return false
+	}
+
+	hosts := []string{r.Host}
+	if a.isTrustedPeer(r) {
+		if host := r.Header.Get("X-Forwarded-Host"); host != "" {
+			hosts = append(hosts, strings.TrimSpace(strings.Split(host, ",")[0]))
+		}
+	}
+	if external, err := url.Parse(a.config().Feed.ExternalURL); err == nil && external.Host != "" {
+		hosts = append(hosts, external.Host)
+	}
+	for _, host := range hosts {
+		if strings.EqualFold(u.Host, host) {
+			return true
+		}
+	}
+	return false
+}
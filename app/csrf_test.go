@@ -0,0 +1,64 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAdminSameOrigin(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Auth.Password = "secret"
+	cfg.Feed.ExternalURL = "https://tube.example.com"
+	cfg.Server.TrustedProxies = []string{"198.51.100.1"}
+	a := &App{Config: cfg}
+	handler := a.requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		name, method string
+		headers      map[string]string
+		code         int
+	}{
+		{"same origin", "POST", map[string]string{"Sec-Fetch-Site": "same-origin"}, http.StatusNoContent},
+		{"cross site", "POST", map[string]string{"Sec-Fetch-Site": "cross-site", "Origin": "http://example.com"}, http.StatusForbidden},
+		{"same site", "POST", map[string]string{"Sec-Fetch-Site": "same-site"}, http.StatusForbidden},
+		{"origin", "POST", map[string]string{"Origin": "http://example.com"}, http.StatusNoContent},
+		{"external url", "POST", map[string]string{"Origin": "https://tube.example.com"}, http.StatusNoContent},
+		{"other origin", "POST", map[string]string{"Origin": "https://evil.com"}, http.StatusForbidden},
+		{"null origin", "POST", map[string]string{"Origin": "null"}, http.StatusForbidden},
+		{"referer", "POST", map[string]string{"Referer": "http://example.com/admin/comments"}, http.StatusNoContent},
+		{"other referer", "POST", map[string]string{"Referer": "https://evil.com/"}, http.StatusForbidden},
+		{"untrusted forwarded host", "POST", map[string]string{"Origin": "https://evil.com", "X-Forwarded-Host": "evil.com"}, http.StatusForbidden},
+		{"no browser", "POST", nil, http.StatusNoContent},
+		{"patch", "PATCH", map[string]string{"Origin": "https://evil.com"}, http.StatusForbidden},
+		{"get", "GET", map[string]string{"Sec-Fetch-Site": "cross-site"}, http.StatusNoContent},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "http://example.com/admin/reload", nil)
+		r.SetBasicAuth("uploader", "secret")
+		for k, v := range test.headers {
+			r.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s: expected %d, got %d", test.name, test.code, w.Code)
+		}
+	}
+}
+
+func TestIsSameOriginForwardedHost(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Server.TrustedProxies = []string{"198.51.100.1"}
+	a := &App{Config: cfg}
+
+	r := httptest.NewRequest("POST", "http://127.0.0.1:8000/admin/reload", nil)
+	r.RemoteAddr = "198.51.100.1:1234"
+	r.Header.Set("Origin", "https://tube.example.com")
+	r.Header.Set("X-Forwarded-Host", "tube.example.com")
+	if !a.isSameOrigin(r) {
+		t.Error("expected the host forwarded by a trusted proxy to be allowed")
+	}
+}
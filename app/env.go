@@ -0,0 +1,247 @@
+package app
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// envPrefix is the prefix of environment variables overriding configuration.
+const envPrefix = "TUBE"
+
+// envOverrides applies environment variables onto a Config.
+type envOverrides struct {
+	env  map[string]string
+	used map[string]bool
+}
+
+// ApplyEnv overrides configuration values with the environment variables
+// environ (as returned by os.Environ).
+//
+// Every configuration item has a variable named TUBE_ followed by its JSON
+// path in upper case with "_" as separator, e.g: TUBE_SERVER_PORT,
+// TUBE_FEED_AUTHOR_NAME, TUBE_LIBRARY_0_PATH (library entries by index, the
+// next free index adds an entry) or TUBE_TRANSCODER_SIZES_HD720 (an empty
+// value removes the size). Existing transcoding profiles can be changed (e.g:
+// TUBE_TRANSCODER_PROFILES_DEFAULT_CRF) but not added. Lists of strings such
+// as TUBE_SERVER_TRUSTED_PROXIES are comma separated. Each variable has a _FILE
+// variant naming a file to read the value from, e.g: TUBE_AUTH_PASSWORD_FILE
+// for mounted secrets.
+//
+// The legacy variables auth_password and SANDSTORM=1 are still honoured.
+func (c *Config) ApplyEnv(environ []string) error {
+	e := &envOverrides{
+		env:  make(map[string]string),
+		used: make(map[string]bool),
+	}
+	for _, kv := range environ {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			e.env[k] = v
+		}
+	}
+
+	if c.Auth == nil {
+		c.Auth = &AuthConfig{}
+	}
+	if password := e.env["auth_password"]; password != "" {
+		c.Auth.Password = password
+	}
+	if e.env["SANDSTORM"] == "1" {
+		c.Auth.Sandstorm = true
+	}
+
+	if err := e.apply(reflect.ValueOf(c).Elem(), envPrefix); err != nil {
+		return err
+	}
+
+	var unknown []string
+	for k := range e.env {
+		if strings.HasPrefix(k, envPrefix+"_") && !e.used[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	sort.Strings(unknown)
+	for _, k := range unknown {
+		log.WithField("name", k).Warn("ignoring unknown configuration environment variable")
+	}
+
+	return nil
+}
+
+// lookup returns the value of the variable name or the contents of the
+// file named by name_FILE.
+func (e *envOverrides) lookup(name string) (string, bool, error) {
+	value, ok := e.env[name]
+	file, fileOk := e.env[name+"_FILE"]
+	if ok && fileOk {
+		return "", false, fmt.Errorf("error, both %s and %s_FILE are set", name, name)
+	}
+	if fileOk {
+		e.used[name+"_FILE"] = true
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", false, fmt.Errorf("error reading %s_FILE: %w", name, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), true, nil
+	}
+	if ok {
+		e.used[name] = true
+	}
+	return value, ok, nil
+}
+
+// hasPrefix returns whether any variable starts with prefix.
+func (e *envOverrides) hasPrefix(prefix string) bool {
+	for k := range e.env {
+		if strings.HasPrefix(k, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply sets v (and everything below it) from the variables starting with name.
+func (e *envOverrides) apply(v reflect.Value, name string) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.Type().Elem().Kind() != reflect.Struct {
+			// optional values (e.g: crf) are unset if empty
+			value, ok, err := e.lookup(name)
+			if err != nil || !ok {
+				return err
+			}
+			if value == "" {
+				v.Set(reflect.Zero(v.Type()))
+				return nil
+			}
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			return e.apply(v.Elem(), name)
+		}
+		if v.IsNil() {
+			if !e.hasPrefix(name + "_") {
+				return nil
+			}
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return e.apply(v.Elem(), name)
+
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			tag := v.Type().Field(i).Tag.Get("json")
+			key, _, _ := strings.Cut(tag, ",")
+			if key == "" || key == "-" {
+				continue
+			}
+			if err := e.apply(v.Field(i), name+"_"+strings.ToUpper(key)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.String {
+			// lists of strings are set as a whole, comma separated
+			value, ok, err := e.lookup(name)
+			if err != nil || !ok {
+				return err
+			}
+			items := []string{}
+			for _, item := range strings.Split(value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			v.Set(reflect.ValueOf(items))
+			return nil
+		}
+		for i := 0; i < v.Len() || e.hasPrefix(fmt.Sprintf("%s_%d_", name, i)); i++ {
+			if i >= v.Len() {
+				v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+			}
+			if err := e.apply(v.Index(i), fmt.Sprintf("%s_%d", name, i)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case reflect.Map:
+		if v.Type().Elem().Kind() != reflect.String {
+			// only existing entries can be overridden, their keys may
+			// contain "_" (e.g: TUBE_TRANSCODER_PROFILES_DEFAULT_CRF)
+			keys := v.MapKeys()
+			sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+			for _, k := range keys {
+				entry := v.MapIndex(k)
+				if entry.Kind() == reflect.Ptr && entry.IsNil() {
+					// null entries are left to Validate
+					continue
+				}
+				// map entries aren't addressable, a copy is set back
+				value := reflect.New(entry.Type()).Elem()
+				value.Set(entry)
+				if err := e.apply(value, name+"_"+strings.ToUpper(k.String())); err != nil {
+					return err
+				}
+				v.SetMapIndex(k, value)
+			}
+			return nil
+		}
+		var keys []string
+		for k := range e.env {
+			if strings.HasPrefix(k, name+"_") {
+				keys = append(keys, strings.TrimSuffix(k, "_FILE"))
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			value, ok, err := e.lookup(k)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			if v.IsNil() {
+				v.Set(reflect.MakeMap(v.Type()))
+			}
+			key := reflect.ValueOf(strings.ToLower(strings.TrimPrefix(k, name+"_")))
+			if value == "" {
+				v.SetMapIndex(key, reflect.Value{})
+			} else {
+				v.SetMapIndex(key, reflect.ValueOf(value))
+			}
+		}
+		return nil
+	}
+
+	value, ok, err := e.lookup(name)
+	if err != nil || !ok {
+		return err
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("error parsing %s: expected a boolean, got %q", name, value)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("error parsing %s: expected an integer, got %q", name, value)
+		}
+		v.SetInt(n)
+	default:
+		return fmt.Errorf("error, %s cannot be set from the environment", name)
+	}
+	return nil
+}
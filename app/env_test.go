@@ -0,0 +1,76 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"git.mills.io/prologic/tube/transcoder"
+)
+
+func TestApplyEnv(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(secret, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultConfig()
+	err := cfg.ApplyEnv([]string{
+		"TUBE_SERVER_PORT=8080",
+		"TUBE_SERVER_TRUSTED_PROXIES=10.0.0.1, unix,",
+		"TUBE_SERVER_TLS_ACME_ENABLED=true",
+		"TUBE_LIBRARY_1_PATH=music",
+		"TUBE_TRANSCODER_SIZES_HD720=720p",
+		"TUBE_TRANSCODER_PROFILES_DEFAULT_CRF=20",
+		"TUBE_AUTH_PASSWORD_FILE=" + secret,
+		"TUBE_UNKNOWN=1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Server.Port != 8080 || !cfg.Server.TLS.ACME.Enabled {
+		t.Errorf("unexpected server config %+v", cfg.Server)
+	}
+	if !reflect.DeepEqual(cfg.Server.TrustedProxies, []string{"10.0.0.1", "unix"}) {
+		t.Errorf("unexpected trusted proxies %q", cfg.Server.TrustedProxies)
+	}
+	if len(cfg.Library) != 2 || cfg.Library[0].Path != "videos" || cfg.Library[1].Path != "music" {
+		t.Errorf("expected a library path added, got %+v", cfg.Library)
+	}
+	if cfg.Transcoder.Sizes["hd720"] != "720p" {
+		t.Errorf("expected the hd720 size, got %v", cfg.Transcoder.Sizes)
+	}
+	if crf := cfg.Transcoder.Profiles[transcoder.DefaultProfileName].CRF; crf == nil || *crf != 20 {
+		t.Errorf("expected the default profile's crf overridden, got %v", crf)
+	}
+	if cfg.Auth.Password != "s3cret" {
+		t.Errorf("expected the password read from the file, got %q", cfg.Auth.Password)
+	}
+}
+
+func TestApplyEnvNullProfile(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Transcoder.Profiles["fast"] = nil
+	if err := cfg.ApplyEnv([]string{"TUBE_TRANSCODER_PROFILES_FAST_CRF=20"}); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Transcoder.Profiles["fast"] != nil {
+		t.Errorf("expected the null profile left to validation, got %+v", cfg.Transcoder.Profiles["fast"])
+	}
+}
+
+func TestApplyEnvErrors(t *testing.T) {
+	tests := map[string][]string{
+		"boolean":  {"TUBE_SERVER_TLS_ACME_ENABLED=maybe"},
+		"integer":  {"TUBE_SERVER_PORT=http"},
+		"both set": {"TUBE_AUTH_PASSWORD=a", "TUBE_AUTH_PASSWORD_FILE=b"},
+		"no file":  {"TUBE_AUTH_PASSWORD_FILE=" + filepath.Join(t.TempDir(), "missing")},
+	}
+	for name, environ := range tests {
+		if err := DefaultConfig().ApplyEnv(environ); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
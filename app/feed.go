@@ -1,6 +1,7 @@
 package app
 
 import (
+	"encoding/xml"
 	"fmt"
 	"net/url"
 	"os"
@@ -11,9 +12,46 @@ import (
 	"github.com/wybiral/feeds"
 )
 
+// podcastNamespace is the XML namespace of the Podcasting 2.0 tags.
+const podcastNamespace = "https://podcastindex.org/namespace/1.0"
+
+// rssFeedXML is feeds.RssFeedXml with the podcast namespace.
+type rssFeedXML struct {
+	XMLName          xml.Name `xml:"rss"`
+	Version          string   `xml:"version,attr"`
+	ContentNamespace string   `xml:"xmlns:content,attr"`
+	PodcastNamespace string   `xml:"xmlns:podcast,attr"`
+	Channel          *rssChannel
+}
+
+// rssChannel is feeds.RssFeed with rssItems.
+type rssChannel struct {
+	XMLName xml.Name `xml:"channel"`
+	*feeds.RssFeed
+	Items []*rssItem `xml:"item"`
+}
+
+// rssItem is feeds.RssItem with the tags of the video as categories and its
+// Podcasting 2.0 speakers, license and chapters.
+type rssItem struct {
+	XMLName xml.Name `xml:"item"`
+	*feeds.RssItem
+	Categories []string `xml:"category"`
+	Persons    []string `xml:"podcast:person"`
+	License    string   `xml:"podcast:license,omitempty"`
+	Chapters   *podcastChapters
+}
+
+// podcastChapters links to the chapters of an item (see chaptersHandler).
+type podcastChapters struct {
+	XMLName xml.Name `xml:"podcast:chapters"`
+	URL     string   `xml:"url,attr"`
+	Type    string   `xml:"type,attr"`
+}
+
 // buildFeed creates RSS feed attribute for App based on Library contents.
 func buildFeed(a *App) {
-	cfg := a.Config.Feed
+	cfg := a.config().Feed
 	now := time.Now()
 	f := &feeds.Feed{
 		Title:       cfg.Title,
@@ -32,29 +70,38 @@ func buildFeed(a *App) {
 	} else {
 		hostname, err := os.Hostname()
 		if err != nil {
-			host := a.Config.Server.Host
-			port := a.Config.Server.Port
+			host := a.config().Server.Host
+			port := a.config().Server.Port
 			externalURL = fmt.Sprintf("http://%s:%d", host, port)
 		} else {
 			externalURL = fmt.Sprintf("http://%s", hostname)
 		}
 	}
-	for _, v := range a.Library.Playlist() {
+	videos := a.Library.Playlist().Listed()
+	var chapters []*podcastChapters
+	for _, v := range videos {
 		u, err := url.Parse(externalURL)
 		if err != nil {
 			return
 		}
-		u.Path = path.Join(u.Path, "v", v.ID)
+		base := u.Path
+		u.Path = path.Join(base, "v", v.ID)
 		id := u.String()
+		if len(v.Chapters) > 0 {
+			u.Path = path.Join(base, "c", v.ID) + ".json"
+			chapters = append(chapters, &podcastChapters{URL: u.String(), Type: "application/json+chapters"})
+		} else {
+			chapters = append(chapters, nil)
+		}
 		f.Items = append(f.Items, &feeds.Item{
 			Id:          id,
 			Title:       v.Title,
 			Link:        &feeds.Link{Href: id},
 			Description: v.Description,
 			Enclosure: &feeds.Enclosure{
-				Url:    id + ".mp4",
+				Url:    id + v.Ext(),
 				Length: strconv.FormatInt(v.Size, 10),
-				Type:   "video/mp4",
+				Type:   v.MIMEType(),
 			},
 			Author: &feeds.Author{
 				Name:  cfg.Author.Name,
@@ -63,9 +110,28 @@ func buildFeed(a *App) {
 			Created: v.Timestamp,
 		})
 	}
-	feed, err := f.ToRss()
+
+	rss := (&feeds.Rss{Feed: f}).RssFeed()
+	channel := &rssChannel{RssFeed: rss}
+	for i, item := range rss.Items {
+		channel.Items = append(channel.Items, &rssItem{
+			RssItem:    item,
+			Categories: videos[i].Tags,
+			Persons:    videos[i].Speakers,
+			License:    videos[i].License,
+			Chapters:   chapters[i],
+		})
+	}
+	rss.Items = nil
+	data, err := xml.MarshalIndent(&rssFeedXML{
+		Version:          "2.0",
+		ContentNamespace: "http://purl.org/rss/1.0/modules/content/",
+		PodcastNamespace: podcastNamespace,
+		Channel:          channel,
+	}, "", "  ")
 	if err != nil {
 		return
 	}
-	a.Feed = []byte(feed)
+	// as feeds.ToXML: without the empty line of the default header
+	a.Feed = []byte(xml.Header[:len(xml.Header)-1] + string(data))
 }
@@ -0,0 +1,258 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"git.mills.io/prologic/tube/utils"
+
+	"github.com/dustin/go-humanize"
+	log "github.com/sirupsen/logrus"
+)
+
+// Oldest supported major version of ffmpeg and ffprobe.
+const minFFmpegVersion = 4
+
+// Seconds to wait for `ffmpeg -version` and friends.
+const versionTimeout = 5
+
+// healthCacheTTL is how long the results of the readiness checks are reused,
+// so /readyz can't be used to make tube run them on every request.
+const healthCacheTTL = 10 * time.Second
+
+// ffmpegVersionRegexp matches e.g: "ffmpeg version 4.4.2-0ubuntu0.22.04.1"
+// or "ffprobe version n6.1", builds from git ("N-109876-g...") don't match.
+var ffmpegVersionRegexp = regexp.MustCompile(`^\S+ version n?(\d+)\.(\d+)`)
+
+// HealthCheck is the result of a single health check.
+type HealthCheck struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// healthCache caches the results of health checks for healthCacheTTL.
+type healthCache struct {
+	mu     sync.Mutex
+	checks []HealthCheck
+	at     time.Time
+}
+
+// get returns the cached checks, running them with run if they expired.
+func (c *healthCache) get(run func() []HealthCheck) []HealthCheck {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.checks == nil || time.Since(c.at) >= healthCacheTTL {
+		c.checks = run()
+		c.at = time.Now()
+	}
+	return c.checks
+}
+
+// toolCache caches the passed checks of the ffmpeg tools, first run on
+// preflight: an installed ffmpeg doesn't change while serving.
+type toolCache struct {
+	mu     sync.Mutex
+	passed map[string]HealthCheck
+}
+
+// check returns the cached check of cmd if it passed, or runs it.
+func (c *toolCache) check(ctx context.Context, cmd string) HealthCheck {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if check, ok := c.passed[cmd]; ok {
+		return check
+	}
+	check := checkTool(ctx, cmd)
+	if check.OK {
+		if c.passed == nil {
+			c.passed = make(map[string]HealthCheck)
+		}
+		c.passed[cmd] = check
+	}
+	return check
+}
+
+func healthCheck(name string, err error, ok string) HealthCheck {
+	if err != nil {
+		return HealthCheck{Name: name, OK: false, Message: err.Error()}
+	}
+	return HealthCheck{Name: name, OK: true, Message: ok}
+}
+
+// checkStore checks that the store is readable and writable.
+func (a *App) checkStore() HealthCheck {
+	return healthCheck("store", a.Store.Ping(), "")
+}
+
+// checkWritableDir checks that dir is an existing and writable directory.
+func checkWritableDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("error, %s is not a directory", dir)
+	}
+	f, err := ioutil.TempFile(dir, ".tube-health-*")
+	if err != nil {
+		return fmt.Errorf("error, %s is not writable: %w", dir, err)
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkDiskSpace checks that the upload path has at least
+// server.min_free_space bytes free.
+func (a *App) checkDiskSpace() HealthCheck {
+	cfg := a.config().Server
+	if cfg.MinFreeSpace == 0 {
+		return HealthCheck{Name: "disk_space", OK: true, Message: "check disabled"}
+	}
+	free, err := utils.DiskFree(cfg.UploadPath)
+	if err == utils.ErrDiskFreeUnsupported {
+		return HealthCheck{Name: "disk_space", OK: true, Message: err.Error()}
+	}
+	if err != nil {
+		return healthCheck("disk_space", err, "")
+	}
+	if free < uint64(cfg.MinFreeSpace) {
+		err := fmt.Errorf(
+			"error, only %s free on %s, need at least %s",
+			humanize.Bytes(free), cfg.UploadPath, humanize.Bytes(uint64(cfg.MinFreeSpace)),
+		)
+		return healthCheck("disk_space", err, "")
+	}
+	return healthCheck("disk_space", nil, fmt.Sprintf("%s free", humanize.Bytes(free)))
+}
+
+// checkTool checks that the ffmpeg tool cmd (ffmpeg or ffprobe) is installed
+// in a supported version.
+func checkTool(ctx context.Context, cmd string) HealthCheck {
+	if !utils.CmdExists(cmd) {
+		return healthCheck(cmd, fmt.Errorf("error, %s not found in $PATH", cmd), "")
+	}
+	out, err := utils.CmdOutputContext(ctx, versionTimeout, cmd, "-version")
+	if err != nil {
+		err := fmt.Errorf("error running %s -version: %w", cmd, err)
+		return healthCheck(cmd, err, "")
+	}
+	line := strings.SplitN(string(out), "\n", 2)[0]
+	match := ffmpegVersionRegexp.FindStringSubmatch(line)
+	if match == nil {
+		// most likely a build from git, assume it's recent enough
+		return healthCheck(cmd, nil, fmt.Sprintf("unknown version %q", line))
+	}
+	major, _ := strconv.Atoi(match[1])
+	if major < minFFmpegVersion {
+		err := fmt.Errorf("error, %s %s.%s is not supported, need %d.0 or newer", cmd, match[1], match[2], minFFmpegVersion)
+		return healthCheck(cmd, err, "")
+	}
+	return healthCheck(cmd, nil, fmt.Sprintf("version %s.%s", match[1], match[2]))
+}
+
+// Health runs all health checks: the store, library and upload paths, free
+// disk space and the ffmpeg / ffprobe installation (ffmpeg unless transcoding
+// on workers, only checked until it passed).
+func (a *App) Health(ctx context.Context) []HealthCheck {
+	cfg := a.config()
+
+	checks := []HealthCheck{a.checkStore()}
+	for _, pc := range cfg.Library {
+		checks = append(checks, healthCheck("library:"+pc.Path, checkWritableDir(pc.Path), ""))
+	}
+	checks = append(checks,
+		healthCheck("upload_path", checkWritableDir(cfg.Server.UploadPath), ""),
+		a.checkDiskSpace(),
+	)
+	// workers run ffmpeg instead, probes run locally
+	if !cfg.Transcoder.Workers.Enabled {
+		checks = append(checks, a.tools.check(ctx, "ffmpeg"))
+	}
+	checks = append(checks, a.tools.check(ctx, "ffprobe"))
+	return checks
+}
+
+// preflight logs the result of the health checks on startup.
+func (a *App) preflight() {
+	for _, check := range a.Health(context.Background()) {
+		l := log.WithField("check", check.Name)
+		if check.OK {
+			if check.Message != "" {
+				l = l.WithField("result", check.Message)
+			}
+			l.Info("preflight check passed")
+		} else {
+			l.WithField("error", check.Message).Error("preflight check failed")
+		}
+	}
+}
+
+// publicHealth returns checks without their messages and with library paths
+// replaced by their index, for callers that mustn't learn about the server.
+func publicHealth(checks []HealthCheck) []HealthCheck {
+	public := make([]HealthCheck, 0, len(checks))
+	libraries := 0
+	for _, check := range checks {
+		name := check.Name
+		if strings.HasPrefix(name, "library:") {
+			name = fmt.Sprintf("library:%d", libraries)
+			libraries++
+		}
+		public = append(public, HealthCheck{Name: name, OK: check.OK})
+	}
+	return public
+}
+
+// writeHealth writes checks as JSON with 200 OK if all passed and 503
+// Service Unavailable otherwise. Only administrators and clients on the
+// loopback interface get their details (see publicHealth).
+func (a *App) writeHealth(w http.ResponseWriter, r *http.Request, checks []HealthCheck) {
+	if ip := net.ParseIP(a.clientIP(r)); !ip.IsLoopback() && !a.isModerator(r) {
+		checks = publicHealth(checks)
+	}
+
+	status := "ok"
+	code := http.StatusOK
+	for _, check := range checks {
+		if !check.OK {
+			status = "fail"
+			code = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(&struct {
+		Status string        `json:"status"`
+		Checks []HealthCheck `json:"checks"`
+	}{status, checks}); err != nil {
+		log.WithError(err).Error("error encoding health checks")
+	}
+}
+
+// HTTP handler for /healthz (liveness), only fails if the store does as
+// restarting won't fix missing dependencies.
+func (a *App) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	a.writeHealth(w, r, []HealthCheck{a.checkStore()})
+}
+
+// HTTP handler for /readyz (readiness), fails if any health check does.
+// The results are cached for healthCacheTTL.
+func (a *App) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := a.readiness.get(func() []HealthCheck {
+		return a.Health(detachedContext(r))
+	})
+	a.writeHealth(w, r, checks)
+}
@@ -0,0 +1,45 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"git.mills.io/prologic/tube/transcoder"
+)
+
+// readyz returns the checks of /readyz requested from remoteAddr.
+func readyz(t *testing.T, a *App, remoteAddr string) []HealthCheck {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/readyz", nil)
+	r.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, r)
+	var res struct {
+		Checks []HealthCheck `json:"checks"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	return res.Checks
+}
+
+func TestReadyzDetails(t *testing.T) {
+	a := newPipelineTestApp(t, &transcoder.Fake{})
+	library := a.config().Library[0].Path
+
+	for _, check := range readyz(t, a, "203.0.113.7:1234") {
+		if strings.Contains(check.Name, library) || check.Message != "" {
+			t.Errorf("expected no details for remote clients, got %+v", check)
+		}
+	}
+
+	found := false
+	for _, check := range readyz(t, a, "127.0.0.1:1234") {
+		found = found || check.Name == "library:"+library
+	}
+	if !found {
+		t.Error("expected the library paths for clients on the loopback interface")
+	}
+}
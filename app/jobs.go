@@ -0,0 +1,143 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	shortuuid "github.com/lithammer/shortuuid/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// errShuttingDown is returned when starting a job during shutdown.
+var errShuttingDown = errors.New("error, server is shutting down")
+
+// Job is a running background job such as a transcode.
+type Job struct {
+	ID      string    `json:"id"`
+	Type    string    `json:"type"`
+	Name    string    `json:"name"`
+	Started time.Time `json:"started"`
+	// RequestID is the ID of the request that started the job, if any.
+	RequestID string `json:"request_id,omitempty"`
+
+	cancel context.CancelFunc
+}
+
+// jobRegistry keeps track of running jobs so they can be cancelled and
+// waited for on shutdown.
+type jobRegistry struct {
+	mu       sync.Mutex
+	wg       sync.WaitGroup
+	jobs     map[string]*Job
+	stopping bool
+
+	metrics *appMetrics
+}
+
+func newJobRegistry(metrics *appMetrics) *jobRegistry {
+	return &jobRegistry{jobs: make(map[string]*Job), metrics: metrics}
+}
+
+// Start registers a new job of type typ (e.g: transcode) called name. The
+// returned context is cancelled when ctx is or on shutdown, done must be
+// called with the job's error (if any) when it finished.
+func (jr *jobRegistry) Start(ctx context.Context, typ, name string) (context.Context, func(error), error) {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+
+	if jr.stopping {
+		return nil, nil, errShuttingDown
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	job := &Job{
+		ID:        shortuuid.New(),
+		Type:      typ,
+		Name:      name,
+		Started:   time.Now(),
+		RequestID: requestID(ctx),
+		cancel:    cancel,
+	}
+	ctx = withJobID(ctx, job.ID)
+	jr.jobs[job.ID] = job
+	jr.wg.Add(1)
+	logger(ctx).WithField("name", name).Debug("started job")
+
+	var once sync.Once
+	done := func(err error) {
+		once.Do(func() {
+			status := "succeeded"
+			switch {
+			case err != nil && ctx.Err() != nil:
+				status = "cancelled"
+			case err != nil:
+				status = "failed"
+			}
+			jr.mu.Lock()
+			delete(jr.jobs, job.ID)
+			jr.mu.Unlock()
+			cancel()
+			if jr.metrics != nil {
+				jr.metrics.jobs.Inc(typ, status)
+				jr.metrics.jobDuration.Since(job.Started, typ)
+			}
+			jr.wg.Done()
+			logger(ctx).WithField("name", name).WithField("status", status).Debug("finished job")
+		})
+	}
+	return ctx, done, nil
+}
+
+// Running returns the running jobs sorted by start time.
+func (jr *jobRegistry) Running() []*Job {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+
+	jobs := make([]*Job, 0, len(jr.jobs))
+	for _, job := range jr.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Started.Before(jobs[j].Started)
+	})
+	return jobs
+}
+
+// Stop refuses new jobs from now on.
+func (jr *jobRegistry) Stop() {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	jr.stopping = true
+}
+
+// CancelAll cancels all running jobs.
+func (jr *jobRegistry) CancelAll() {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	for _, job := range jr.jobs {
+		l := log.WithField("job", job.ID)
+		if job.RequestID != "" {
+			l = l.WithField("request_id", job.RequestID)
+		}
+		l.WithField("name", job.Name).Warn("cancelling job")
+		job.cancel()
+	}
+}
+
+// Wait waits for all running jobs to finish or ctx to be done.
+func (jr *jobRegistry) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		jr.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
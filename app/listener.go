@@ -7,10 +7,25 @@ package app
 import (
 	"fmt"
 	"net"
+	"os"
+	"os/user"
+	"strconv"
 	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// newListener returns a listener of the type set by server.listen.
 func newListener(cfg *ServerConfig) (net.Listener, error) {
+	switch cfg.Listen {
+	case "unix":
+		return newUnixListener(cfg)
+	case "systemd":
+		return newSystemdListener()
+	}
 	addr := fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -21,6 +36,86 @@ func newListener(cfg *ServerConfig) (net.Listener, error) {
 	return tcpListener{ln.(*net.TCPListener)}, nil
 }
 
+// newUnixListener listens on the Unix domain socket server.socket with the
+// permissions server.socket_mode and group server.socket_group.
+func newUnixListener(cfg *ServerConfig) (net.Listener, error) {
+	// remove a stale socket left behind by a crash
+	if info, err := os.Lstat(cfg.Socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(cfg.Socket); err != nil {
+			err := fmt.Errorf("error removing stale socket %s: %w", cfg.Socket, err)
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", cfg.Socket)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.SocketMode != "" {
+		mode, _ := strconv.ParseUint(cfg.SocketMode, 8, 32)
+		if err := os.Chmod(cfg.Socket, os.FileMode(mode)); err != nil {
+			ln.Close()
+			err := fmt.Errorf("error setting mode of socket %s: %w", cfg.Socket, err)
+			return nil, err
+		}
+	}
+	if cfg.SocketGroup != "" {
+		group, err := user.LookupGroup(cfg.SocketGroup)
+		if err != nil {
+			ln.Close()
+			err := fmt.Errorf("error looking up socket group: %w", err)
+			return nil, err
+		}
+		gid, _ := strconv.Atoi(group.Gid)
+		if err := os.Chown(cfg.Socket, -1, gid); err != nil {
+			ln.Close()
+			err := fmt.Errorf("error setting group of socket %s: %w", cfg.Socket, err)
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+// newSystemdListener returns the socket passed by systemd socket activation
+// (see sd_listen_fds(3)).
+func newSystemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, fmt.Errorf("error, no sockets passed by systemd (LISTEN_PID not set to our pid)")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("error, no sockets passed by systemd (LISTEN_FDS not set)")
+	}
+	if n > 1 {
+		log.WithField("sockets", n).Warn("systemd passed more than one socket, using the first one")
+	}
+	// don't pass the sockets on to child processes (e.g: ffmpeg)
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(uintptr(listenFDsStart), "LISTEN_FD_3")
+	ln, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		err := fmt.Errorf("error using socket passed by systemd: %w", err)
+		return nil, err
+	}
+	if tl, ok := ln.(*net.TCPListener); ok {
+		return tcpListener{tl}, nil
+	}
+	return ln, nil
+}
+
+// listenerURL returns the URL (or socket path) served on by ln.
+func listenerURL(scheme string, ln net.Listener) string {
+	if addr, ok := ln.Addr().(*net.UnixAddr); ok {
+		return fmt.Sprintf("%s+unix:%s", scheme, addr.Name)
+	}
+	return fmt.Sprintf("%s://%s", scheme, ln.Addr())
+}
+
 // custom TCP listener with keep-alive timeout
 type tcpListener struct {
 	*net.TCPListener
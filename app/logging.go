@@ -0,0 +1,189 @@
+package app
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	shortuuid "github.com/lithammer/shortuuid/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// requestIDHeader is the header carrying the ID of a request.
+const requestIDHeader = "X-Request-ID"
+
+// requestIDRegexp matches request IDs accepted from trusted proxies.
+var requestIDRegexp = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	jobIDKey
+	unixPeerKey
+)
+
+// unixProxy in server.trusted_proxies trusts every peer on a Unix domain
+// socket (e.g: a local nginx), which have no IP address.
+const unixProxy = "unix"
+
+// withRequestID returns a copy of ctx carrying the request ID id.
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// requestID returns the request ID carried by ctx, if any.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// withJobID returns a copy of ctx carrying the job ID id.
+func withJobID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, jobIDKey, id)
+}
+
+// logger returns a log entry with the request and job ID carried by ctx.
+func logger(ctx context.Context) *log.Entry {
+	l := log.NewEntry(log.StandardLogger())
+	if id := requestID(ctx); id != "" {
+		l = l.WithField("request_id", id)
+	}
+	if id, ok := ctx.Value(jobIDKey).(string); ok {
+		l = l.WithField("job", id)
+	}
+	return l
+}
+
+// detachedContext returns a new context carrying the request ID of r but
+// not cancelled with it, for jobs outliving the request (e.g: transcodes).
+func detachedContext(r *http.Request) context.Context {
+	return withRequestID(context.Background(), requestID(r.Context()))
+}
+
+// applyLogConfig sets the log format (text or json).
+func applyLogConfig(cfg *LogConfig) {
+	switch cfg.Format {
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		log.SetFormatter(&log.TextFormatter{})
+	}
+}
+
+// unixConnContext marks the context of connections accepted on Unix domain
+// sockets, see isTrustedPeer.
+func unixConnContext(ctx context.Context, c net.Conn) context.Context {
+	if _, ok := c.LocalAddr().(*net.UnixAddr); ok {
+		return context.WithValue(ctx, unixPeerKey, true)
+	}
+	return ctx
+}
+
+// isTrustedPeer returns whether the peer of r is a trusted proxy: one of
+// server.trusted_proxies or, if they include "unix", on a Unix domain socket.
+func (a *App) isTrustedPeer(r *http.Request) bool {
+	if unix, _ := r.Context().Value(unixPeerKey).(bool); unix {
+		for _, proxy := range a.config().Server.TrustedProxies {
+			if proxy == unixProxy {
+				return true
+			}
+		}
+		return false
+	}
+	return a.isTrustedProxy(net.ParseIP(remoteIP(r)))
+}
+
+// isTrustedProxy returns whether ip is one of server.trusted_proxies (IP
+// addresses or CIDR ranges).
+func (a *App) isTrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range a.config().Server.TrustedProxies {
+		if strings.Contains(proxy, "/") {
+			if _, n, err := net.ParseCIDR(proxy); err == nil && n.Contains(ip) {
+				return true
+			}
+		} else if ip.Equal(net.ParseIP(proxy)) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the IP address of the peer of r.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientIP returns the IP address of the client making the request r. The
+// X-Forwarded-For and X-Real-IP headers are only honoured on requests from
+// trusted proxies.
+func (a *App) clientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if !a.isTrustedPeer(r) {
+		return ip
+	}
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		// the rightmost address not added by one of our proxies
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if parsed := net.ParseIP(hop); parsed != nil {
+				ip = hop
+				if !a.isTrustedProxy(parsed) {
+					break
+				}
+			}
+		}
+		return ip
+	}
+	if real := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(real) != nil {
+		return real
+	}
+	return ip
+}
+
+// accessLogMiddleware assigns every request an ID (honouring a valid
+// X-Request-ID from trusted proxies), returns it in the X-Request-ID header,
+// carries it in the request's context and logs the request once served.
+func (a *App) accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDRegexp.MatchString(id) || !a.isTrustedPeer(r) {
+			id = shortuuid.New()
+		}
+		w.Header().Set(requestIDHeader, id)
+		r = r.WithContext(withRequestID(r.Context(), id))
+
+		rr := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rr, r)
+
+		if !a.config().Log.AccessLog {
+			return
+		}
+		l := logger(r.Context()).WithFields(log.Fields{
+			"method":    r.Method,
+			"route":     routeTemplate(r),
+			"path":      r.URL.Path,
+			"status":    rr.Status(),
+			"bytes":     rr.bytes,
+			"duration":  time.Since(start).Seconds(),
+			"client_ip": a.clientIP(r),
+		})
+		if user, _, ok := a.authenticatedUser(r); ok {
+			l = l.WithField("user", user)
+		}
+		l.Info("request")
+	})
+}
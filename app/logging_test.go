@@ -0,0 +1,63 @@
+package app
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+// unixClientIP serves clientIP on a Unix domain socket and returns the one
+// of a request forwarded for 203.0.113.7.
+func unixClientIP(t *testing.T, a *App) string {
+	t.Helper()
+	cfg := &ServerConfig{Listen: "unix", Socket: filepath.Join(t.TempDir(), "tube.sock")}
+	ln, err := newUnixListener(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, a.clientIP(r))
+		}),
+		ConnContext: unixConnContext,
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", cfg.Socket)
+		},
+	}}
+	r, err := http.NewRequest("GET", "http://tube/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("X-Forwarded-For", "203.0.113.7")
+	res, err := client.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestClientIPUnixSocket(t *testing.T) {
+	cfg := DefaultConfig()
+	a := &App{Config: cfg}
+	if ip := unixClientIP(t, a); ip == "203.0.113.7" {
+		t.Error("expected X-Forwarded-For to be ignored from untrusted Unix socket peers")
+	}
+
+	cfg.Server.TrustedProxies = []string{"unix"}
+	if ip := unixClientIP(t, a); ip != "203.0.113.7" {
+		t.Errorf("expected the forwarded client IP from a trusted Unix socket peer, got %q", ip)
+	}
+}
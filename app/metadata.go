@@ -0,0 +1,165 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"git.mills.io/prologic/tube/media"
+)
+
+// videoEdit is the body of PATCH /api/videos/id, fields left out are kept
+// and empty ones are removed from the sidecar (see media.Sidecar).
+type videoEdit struct {
+	Title       *string           `json:"title"`
+	Description *string           `json:"description"`
+	Tags        *[]string         `json:"tags"`
+	Speakers    *[]string         `json:"speakers"`
+	Recorded    *media.Date       `json:"recorded"`
+	Published   *media.Date       `json:"published"`
+	License     *string           `json:"license"`
+	Language    *string           `json:"language"`
+	Source      *string           `json:"source"`
+	Visibility  *media.Visibility `json:"visibility"`
+	Chapters    *[]media.Chapter  `json:"chapters"`
+}
+
+// sidecar returns the yml sidecar keys set by the edit (nil to remove
+// them), or an error describing why it is invalid.
+func (e *videoEdit) sidecar() (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	set := func(key string, value interface{}, empty bool) {
+		if empty {
+			values[key] = nil
+		} else {
+			values[key] = value
+		}
+	}
+
+	var s media.Sidecar
+	if e.Title != nil {
+		if strings.TrimSpace(*e.Title) == "" {
+			return nil, fmt.Errorf("title must not be empty")
+		}
+		s.Title = *e.Title
+	}
+	if e.Description != nil {
+		s.Description = *e.Description
+	}
+	if e.Tags != nil {
+		s.Tags = *e.Tags
+	}
+	if e.Speakers != nil {
+		s.Speakers = *e.Speakers
+	}
+	if e.License != nil {
+		s.License = strings.TrimSpace(*e.License)
+	}
+	if e.Language != nil {
+		s.Language = strings.TrimSpace(*e.Language)
+	}
+	if e.Source != nil {
+		s.Source = strings.TrimSpace(*e.Source)
+	}
+	if e.Visibility != nil {
+		s.Visibility = *e.Visibility
+	}
+	if problems := s.Validate(); len(problems) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(problems, ", "))
+	}
+
+	if e.Title != nil {
+		set("title", s.Title, false)
+	}
+	if e.Description != nil {
+		set("description", s.Description, s.Description == "")
+	}
+	if e.Tags != nil {
+		set("tags", s.Tags, len(s.Tags) == 0)
+	}
+	if e.Speakers != nil {
+		set("speakers", s.Speakers, len(s.Speakers) == 0)
+	}
+	if e.Recorded != nil {
+		set("recorded", *e.Recorded, e.Recorded.IsZero())
+	}
+	if e.Published != nil {
+		set("published", *e.Published, e.Published.IsZero())
+	}
+	if e.License != nil {
+		set("license", s.License, s.License == "")
+	}
+	if e.Language != nil {
+		set("language", s.Language, s.Language == "")
+	}
+	if e.Source != nil {
+		set("source", s.Source, s.Source == "")
+	}
+	if e.Visibility != nil {
+		set("visibility", s.Visibility, s.Visibility == "")
+	}
+	if e.Chapters != nil {
+		chapters := append([]media.Chapter{}, *e.Chapters...)
+		for _, c := range chapters {
+			if c.Start < 0 || (c.End != 0 && c.End <= c.Start) {
+				return nil, fmt.Errorf("invalid times of chapter %q", c.Title)
+			}
+			if strings.TrimSpace(c.Title) == "" {
+				return nil, fmt.Errorf("chapter at %s has no title", media.FormatTimestamp(c.Start))
+			}
+		}
+		media.SortChapters(chapters)
+		set("chapters", chapters, len(chapters) == 0)
+	}
+	return values, nil
+}
+
+// HTTP handler for PATCH /api/videos/id, it saves the metadata to the yml
+// sidecar of the video and returns the updated video.
+func (a *App) videoEditHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	prefix, ok := vars["prefix"]
+	if ok {
+		id = path.Join(prefix, id)
+	}
+	v, ok := a.Library.Videos[id]
+	if !ok {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	var edit videoEdit
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&edit); err != nil {
+		http.Error(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+	values, err := edit.sidecar()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Bad Request: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	if len(values) > 0 {
+		if err := media.UpdateSidecar(v.Path, values); err != nil {
+			err := fmt.Errorf("error updating metadata: %w", err)
+			logger(r.Context()).WithField("video", id).Error(err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		// the watcher ignores sidecars
+		if err := a.Library.Add(v.Path); err != nil {
+			logger(r.Context()).WithError(err).WithField("video", id).Warn("error reloading video")
+		}
+		buildFeed(a)
+		logger(r.Context()).WithField("video", id).Info("updated video metadata")
+	}
+
+	a.videoAPIHandler(w, r)
+}
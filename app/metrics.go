@@ -0,0 +1,478 @@
+package app
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Buckets (in seconds) of the latency histograms.
+var (
+	httpBuckets  = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	jobBuckets   = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800, 3600}
+	storeBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1}
+)
+
+// collector is a metric family that can write itself in the Prometheus
+// text exposition format.
+type collector interface {
+	write(w io.Writer)
+}
+
+// sample is a single value of a metric family with its label values.
+type sample struct {
+	labels []string
+	value  float64
+}
+
+// labelValueEscaper escapes label values as the text exposition format
+// does, unlike Go's %q it leaves everything else (e.g: UTF-8) as is.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels formats names and values as {name="value",...}.
+func formatLabels(names, values []string, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(names)+len(extra)/2)
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, labelValueEscaper.Replace(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], labelValueEscaper.Replace(extra[i+1])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, typ)
+}
+
+// labelKey joins label values into a map key.
+func labelKey(values []string) string {
+	return strings.Join(values, "\x00")
+}
+
+// counterVec is a counter partitioned by labels.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*sample
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]*sample),
+	}
+}
+
+// Add adds n to the counter with the given label values.
+func (c *counterVec) Add(n float64, values ...string) {
+	key := labelKey(values)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.values[key]
+	if !ok {
+		s = &sample{labels: values}
+		c.values[key] = s
+	}
+	s.value += n
+}
+
+// Inc increments the counter with the given label values.
+func (c *counterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	writeHeader(w, c.name, c.help, "counter")
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := c.values[k]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, s.labels), formatValue(s.value))
+	}
+}
+
+// histogram is a single histogram of a histogramVec.
+type histogram struct {
+	labels []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// histogramVec is a histogram partitioned by labels.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  make(map[string]*histogram),
+	}
+}
+
+// Observe records the observation v with the given label values.
+func (h *histogramVec) Observe(v float64, values ...string) {
+	key := labelKey(values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{labels: values, counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			hist.counts[i]++
+		}
+	}
+	hist.sum += v
+	hist.count++
+}
+
+// Since observes the seconds elapsed since start.
+func (h *histogramVec) Since(start time.Time, values ...string) {
+	h.Observe(time.Since(start).Seconds(), values...)
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		hist := h.values[k]
+		for i, le := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, hist.labels, "le", formatValue(le)), hist.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, hist.labels, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, hist.labels), formatValue(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, hist.labels), hist.count)
+	}
+}
+
+// gaugeFunc is a gauge whose samples are computed on collection.
+type gaugeFunc struct {
+	name   string
+	help   string
+	labels []string
+	fn     func() []sample
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	samples := g.fn()
+	sort.Slice(samples, func(i, j int) bool {
+		return labelKey(samples[i].labels) < labelKey(samples[j].labels)
+	})
+	writeHeader(w, g.name, g.help, "gauge")
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, s.labels), formatValue(s.value))
+	}
+}
+
+// appMetrics are the metrics of an App exposed on /metrics.
+type appMetrics struct {
+	httpRequests    *counterVec
+	httpDuration    *histogramVec
+	videoBytes      *counterVec
+	jobs            *counterVec
+	jobDuration     *histogramVec
+	watcherEvents   *counterVec
+	storeOperations *histogramVec
+
+	collectors []collector
+}
+
+func newAppMetrics() *appMetrics {
+	m := &appMetrics{
+		httpRequests: newCounterVec(
+			"tube_http_requests_total",
+			"Total number of HTTP requests by route, method and status code.",
+			"route", "method", "code",
+		),
+		httpDuration: newHistogramVec(
+			"tube_http_request_duration_seconds",
+			"Latency of HTTP requests by route.",
+			httpBuckets, "route",
+		),
+		videoBytes: newCounterVec(
+			"tube_video_bytes_served_total",
+			"Total number of bytes of videos served by quality.",
+			"quality",
+		),
+		jobs: newCounterVec(
+			"tube_jobs_total",
+			"Total number of finished jobs by type and status (succeeded, failed or cancelled).",
+			"type", "status",
+		),
+		jobDuration: newHistogramVec(
+			"tube_job_duration_seconds",
+			"Duration of finished jobs by type.",
+			jobBuckets, "type",
+		),
+		watcherEvents: newCounterVec(
+			"tube_watcher_events_total",
+			"Total number of file system events seen by the library watcher by operation.",
+			"op",
+		),
+		storeOperations: newHistogramVec(
+			"tube_store_operation_duration_seconds",
+			"Latency of store operations by operation.",
+			storeBuckets, "operation",
+		),
+	}
+	m.collectors = []collector{
+		m.httpRequests,
+		m.httpDuration,
+		m.videoBytes,
+		m.jobs,
+		m.jobDuration,
+		m.watcherEvents,
+		m.storeOperations,
+	}
+	return m
+}
+
+// register adds further collectors (e.g: gauges depending on the App).
+func (m *appMetrics) register(c ...collector) {
+	m.collectors = append(m.collectors, c...)
+}
+
+// write writes all metrics in the Prometheus text exposition format.
+func (m *appMetrics) write(w io.Writer) {
+	for _, c := range m.collectors {
+		c.write(w)
+	}
+}
+
+// libraryCollectors returns gauges for the size of the library per
+// collection and the no. of running jobs.
+func (a *App) libraryCollectors() []collector {
+	return []collector{
+		&gaugeFunc{
+			name:   "tube_library_videos",
+			help:   "Number of videos in the library by collection.",
+			labels: []string{"collection"},
+			fn: func() []sample {
+				videos, _ := a.librarySize()
+				return videos
+			},
+		},
+		&gaugeFunc{
+			name:   "tube_library_bytes",
+			help:   "Size of the videos in the library in bytes by collection.",
+			labels: []string{"collection"},
+			fn: func() []sample {
+				_, bytes := a.librarySize()
+				return bytes
+			},
+		},
+		&gaugeFunc{
+			name:   "tube_worker_tasks",
+			help:   "Number of tasks queued for workers by state (pending or leased).",
+			labels: []string{"state"},
+			fn: func() []sample {
+				if a.work == nil {
+					return nil
+				}
+				pending, leased := a.work.size()
+				return []sample{
+					{labels: []string{"pending"}, value: float64(pending)},
+					{labels: []string{"leased"}, value: float64(leased)},
+				}
+			},
+		},
+		&gaugeFunc{
+			name: "tube_jobs_running",
+			help: "Number of running jobs.",
+			fn: func() []sample {
+				return []sample{{value: float64(len(a.jobs.Running()))}}
+			},
+		},
+	}
+}
+
+// librarySize returns the no. of videos and their size per collection.
+func (a *App) librarySize() ([]sample, []sample) {
+	videos := make(map[string]float64)
+	bytes := make(map[string]float64)
+	for _, p := range a.Library.Paths {
+		videos[p.Path] = 0
+		bytes[p.Path] = 0
+	}
+	for _, v := range a.Library.Playlist() {
+		if p, ok := a.Library.PathOf(v); ok {
+			videos[p.Path]++
+			bytes[p.Path] += float64(v.Size)
+		}
+	}
+	var vs, bs []sample
+	for p := range videos {
+		vs = append(vs, sample{labels: []string{p}, value: videos[p]})
+		bs = append(bs, sample{labels: []string{p}, value: bytes[p]})
+	}
+	return vs, bs
+}
+
+// responseRecorder records the status code and no. of bytes of a response.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if rr.status == 0 {
+		rr.status = status
+	}
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	n, err := rr.ResponseWriter.Write(b)
+	rr.bytes += int64(n)
+	return n, err
+}
+
+// ReadFrom keeps http.ServeFile's use of sendfile(2) when wrapped.
+func (rr *responseRecorder) ReadFrom(r io.Reader) (int64, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	var (
+		n   int64
+		err error
+	)
+	if rf, ok := rr.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(rr.ResponseWriter, r)
+	}
+	rr.bytes += n
+	return n, err
+}
+
+// Flush sends any buffered data to the client, if the wrapped
+// ResponseWriter supports it (e.g: for streamed responses).
+func (rr *responseRecorder) Flush() {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	if f, ok := rr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the wrapped ResponseWriter, for http.ResponseController.
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
+
+// Status returns the status code of the response (200 if none was written).
+func (rr *responseRecorder) Status() int {
+	if rr.status == 0 {
+		return http.StatusOK
+	}
+	return rr.status
+}
+
+// routeTemplate returns the path template of the route matching r, e.g:
+// /v/{id}, or "unknown" if no route matched.
+func routeTemplate(r *http.Request) string {
+	if cr := mux.CurrentRoute(r); cr != nil {
+		if tpl, err := cr.GetPathTemplate(); err == nil {
+			return tpl
+		}
+	}
+	return "unknown"
+}
+
+// metricsMiddleware records the no. and latency of requests per route.
+func (a *App) metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+
+		start := time.Now()
+		// reuse the access log's recorder, if any
+		rr, ok := w.(*responseRecorder)
+		if !ok {
+			rr = &responseRecorder{ResponseWriter: w}
+		}
+		next.ServeHTTP(rr, r)
+
+		a.metrics.httpRequests.Inc(route, r.Method, strconv.Itoa(rr.Status()))
+		a.metrics.httpDuration.Since(start, route)
+	})
+}
+
+// HTTP handler for /metrics
+func (a *App) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := a.config().Metrics
+	if !cfg.Enabled {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+	if cfg.Token != "" {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="tube metrics"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	a.metrics.write(bw)
+	if err := bw.Flush(); err != nil {
+		logger(r.Context()).WithError(err).Debug("error writing metrics")
+	}
+}
@@ -0,0 +1,180 @@
+package app
+
+import (
+	"time"
+)
+
+// instrumentedStore is a Store recording the latency of its operations.
+type instrumentedStore struct {
+	store   Store
+	metrics *appMetrics
+}
+
+func newInstrumentedStore(store Store, metrics *appMetrics) *instrumentedStore {
+	return &instrumentedStore{store: store, metrics: metrics}
+}
+
+func (s *instrumentedStore) observe(operation string, start time.Time) {
+	s.metrics.storeOperations.Since(start, operation)
+}
+
+// Close ...
+func (s *instrumentedStore) Close() error {
+	return s.store.Close()
+}
+
+// Ping ...
+func (s *instrumentedStore) Ping() error {
+	defer s.observe("ping", time.Now())
+	return s.store.Ping()
+}
+
+// Migrate ...
+func (s *instrumentedStore) Migrate(collection, id string) error {
+	defer s.observe("migrate", time.Now())
+	return s.store.Migrate(collection, id)
+}
+
+// GetViews_ ...
+func (s *instrumentedStore) GetViews_(collection, id string) (int64, error) {
+	defer s.observe("get_views_legacy", time.Now())
+	return s.store.GetViews_(collection, id)
+}
+
+// IncView_ ...
+func (s *instrumentedStore) IncView_(collection, id string) error {
+	defer s.observe("inc_view_legacy", time.Now())
+	return s.store.IncView_(collection, id)
+}
+
+// GetViews ...
+func (s *instrumentedStore) GetViews(id string) (int64, error) {
+	defer s.observe("get_views", time.Now())
+	return s.store.GetViews(id)
+}
+
+// GetViewsMulti ...
+func (s *instrumentedStore) GetViewsMulti(ids []string) (map[string]int64, error) {
+	defer s.observe("get_views_multi", time.Now())
+	return s.store.GetViewsMulti(ids)
+}
+
+// IncViews ...
+func (s *instrumentedStore) IncViews(id string) error {
+	defer s.observe("inc_views", time.Now())
+	return s.store.IncViews(id)
+}
+
+// SetViews ...
+func (s *instrumentedStore) SetViews(id string, views int64) error {
+	defer s.observe("set_views", time.Now())
+	return s.store.SetViews(id, views)
+}
+
+// IncDailyViews ...
+func (s *instrumentedStore) IncDailyViews(id string, day time.Time) error {
+	defer s.observe("inc_daily_views", time.Now())
+	return s.store.IncDailyViews(id, day)
+}
+
+// GetDailyViews ...
+func (s *instrumentedStore) GetDailyViews(id string) (map[string]int64, error) {
+	defer s.observe("get_daily_views", time.Now())
+	return s.store.GetDailyViews(id)
+}
+
+// IncStat ...
+func (s *instrumentedStore) IncStat(id, name string, day time.Time, key string, n int64) error {
+	defer s.observe("inc_stat", time.Now())
+	return s.store.IncStat(id, name, day, key, n)
+}
+
+// GetStats ...
+func (s *instrumentedStore) GetStats(id, name string) (map[string]map[string]int64, error) {
+	defer s.observe("get_stats", time.Now())
+	return s.store.GetStats(id, name)
+}
+
+// SetPosition ...
+func (s *instrumentedStore) SetPosition(viewer, id string, position Position) error {
+	defer s.observe("set_position", time.Now())
+	return s.store.SetPosition(viewer, id, position)
+}
+
+// GetPositions ...
+func (s *instrumentedStore) GetPositions(viewer string) (map[string]Position, error) {
+	defer s.observe("get_positions", time.Now())
+	return s.store.GetPositions(viewer)
+}
+
+// SetLike ...
+func (s *instrumentedStore) SetLike(viewer, id string, like bool) error {
+	defer s.observe("set_like", time.Now())
+	return s.store.SetLike(viewer, id, like)
+}
+
+// HasLiked ...
+func (s *instrumentedStore) HasLiked(viewer, id string) (bool, error) {
+	defer s.observe("has_liked", time.Now())
+	return s.store.HasLiked(viewer, id)
+}
+
+// GetLikes ...
+func (s *instrumentedStore) GetLikes(id string) (int64, error) {
+	defer s.observe("get_likes", time.Now())
+	return s.store.GetLikes(id)
+}
+
+// PutComment ...
+func (s *instrumentedStore) PutComment(comment *Comment) error {
+	defer s.observe("put_comment", time.Now())
+	return s.store.PutComment(comment)
+}
+
+// GetComment ...
+func (s *instrumentedStore) GetComment(videoID, id string) (*Comment, error) {
+	defer s.observe("get_comment", time.Now())
+	return s.store.GetComment(videoID, id)
+}
+
+// GetComments ...
+func (s *instrumentedStore) GetComments(videoID string) ([]*Comment, error) {
+	defer s.observe("get_comments", time.Now())
+	return s.store.GetComments(videoID)
+}
+
+// GetPendingComments ...
+func (s *instrumentedStore) GetPendingComments() ([]*Comment, error) {
+	defer s.observe("get_pending_comments", time.Now())
+	return s.store.GetPendingComments()
+}
+
+// DeleteComment ...
+func (s *instrumentedStore) DeleteComment(videoID, id string) error {
+	defer s.observe("delete_comment", time.Now())
+	return s.store.DeleteComment(videoID, id)
+}
+
+// Ban ...
+func (s *instrumentedStore) Ban(viewer string) error {
+	defer s.observe("ban", time.Now())
+	return s.store.Ban(viewer)
+}
+
+// Unban ...
+func (s *instrumentedStore) Unban(viewer string) error {
+	defer s.observe("unban", time.Now())
+	return s.store.Unban(viewer)
+}
+
+// IsBanned ...
+func (s *instrumentedStore) IsBanned(viewer string) (bool, error) {
+	defer s.observe("is_banned", time.Now())
+	return s.store.IsBanned(viewer)
+}
+
+// GetBans ...
+func (s *instrumentedStore) GetBans() ([]string, error) {
+	defer s.observe("get_bans", time.Now())
+	return s.store.GetBans()
+}
@@ -0,0 +1,37 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFormatLabels(t *testing.T) {
+	tests := []struct {
+		values   []string
+		expected string
+	}{
+		{[]string{"/srv/vidéos", "GET"}, `{path="/srv/vidéos",method="GET"}`},
+		{[]string{`C:\videos`, `say "hi"`}, `{path="C:\\videos",method="say \"hi\""}`},
+		{[]string{"a\nb", "\x00"}, "{path=\"a\\nb\",method=\"\x00\"}"},
+	}
+	for _, test := range tests {
+		if got := formatLabels([]string{"path", "method"}, test.values); got != test.expected {
+			t.Errorf("formatLabels(%q) = %s, expected %s", test.values, got, test.expected)
+		}
+	}
+}
+
+func TestResponseRecorderFlush(t *testing.T) {
+	w := httptest.NewRecorder()
+	var rw http.ResponseWriter = &responseRecorder{ResponseWriter: w}
+
+	f, ok := rw.(http.Flusher)
+	if !ok {
+		t.Fatal("expected responseRecorder to be an http.Flusher")
+	}
+	f.Flush()
+	if !w.Flushed {
+		t.Error("expected Flush to flush the wrapped ResponseWriter")
+	}
+}
@@ -50,6 +50,21 @@ func OptionallyRequireAdminAuth(handler http.HandlerFunc, password string) http.
 	}
 }
 
+// RequireAdminAuth wraps a handler requiring HTTP basic auth using
+// "uploader" as the username.
+// Unlike OptionallyRequireAdminAuth it denies access if a password isn't set.
+func RequireAdminAuth(handler http.HandlerFunc, password string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if password == "" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			log.Debugln("No admin password set")
+			return
+		}
+
+		OptionallyRequireAdminAuth(handler, password)(w, r)
+	}
+}
+
 func RequireSandstormPermission(handler http.HandlerFunc, permissionNeeded string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		
@@ -0,0 +1,38 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAdminAuth(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+
+	tests := []struct {
+		name     string
+		password string
+		user     string
+		pass     string
+		status   int
+	}{
+		{"no password set", "", "uploader", "", http.StatusForbidden},
+		{"no credentials", "secret", "", "", http.StatusUnauthorized},
+		{"wrong password", "secret", "uploader", "wrong", http.StatusUnauthorized},
+		{"wrong user", "secret", "admin", "secret", http.StatusUnauthorized},
+		{"authenticated", "secret", "uploader", "secret", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/admin/analytics", nil)
+			if test.user != "" {
+				r.SetBasicAuth(test.user, test.pass)
+			}
+			w := httptest.NewRecorder()
+			RequireAdminAuth(ok, test.password)(w, r)
+			if w.Code != test.status {
+				t.Errorf("expected status %d, got %d", test.status, w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,462 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"git.mills.io/prologic/tube/media"
+	"git.mills.io/prologic/tube/transcoder"
+	"git.mills.io/prologic/tube/utils"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"github.com/dustin/go-humanize"
+	shortuuid "github.com/lithammer/shortuuid/v3"
+)
+
+// Collection returns the library path (collection) with the given path or
+// prefix. An empty name returns the first collection (sorted by path).
+func (a *App) Collection(name string) (*media.Path, error) {
+	if len(a.Library.Paths) == 0 {
+		return nil, fmt.Errorf("error, no library paths configured")
+	}
+	if name == "" {
+		keys := make([]string, 0, len(a.Library.Paths))
+		for k := range a.Library.Paths {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return a.Library.Paths[keys[0]], nil
+	}
+	if p, ok := a.Library.Paths[filepath.Clean(name)]; ok {
+		return p, nil
+	}
+	for _, p := range a.Library.Paths {
+		if p.Prefix == strings.Trim(name, "/") {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("error, no such collection: %s", name)
+}
+
+// AddVideo transcodes the video file src into the library path p and
+// generates a thumbnail as well as the configured lower quality sizes.
+// The original file name name is used if upload file names are preserved.
+// It returns the path of the new video.
+//
+// It runs as a job, cancelling ctx (or shutting down) kills ffmpeg and
+// removes any temporary files.
+func (a *App) AddVideo(ctx context.Context, src string, p *media.Path, name, title, description string) (string, error) {
+	ctx, done, err := a.jobs.Start(ctx, "transcode", fmt.Sprintf("add %s", filepath.Base(src)))
+	if err != nil {
+		return "", err
+	}
+
+	vf, err := a.addVideo(ctx, src, "", p, name, title, description)
+	done(err)
+	return vf, err
+}
+
+// addVideo is AddVideo with an optional existing thumbnail thumb, which
+// is moved into the library instead of generating one.
+func (a *App) addVideo(ctx context.Context, src, thumb string, p *media.Path, name, title, description string) (string, error) {
+	// settings are fixed for the duration of the job, even if reloaded
+	cfg := a.config()
+
+	if err := a.ensureUploadPath(); err != nil {
+		return "", err
+	}
+
+	profileName, profile := cfg.Transcoder.Profile(p)
+	metadata := map[string]string{"title": title, "comment": description}
+
+	probe, err := a.transcoder().Probe(ctx, src, cfg.Transcoder.Timeout)
+	if err != nil {
+		logger(ctx).WithError(err).Warn("error probing video, transcoding it")
+	}
+	strategy, reason := profile.Plan(probe)
+	// e.g: .mp4 for videos, .mp3 for MP3s
+	ext := probe.Ext(strategy)
+
+	tf, err := ioutil.TempFile(
+		cfg.Server.UploadPath,
+		fmt.Sprintf("tube-transcode-*%s", ext),
+	)
+	if err != nil {
+		err := fmt.Errorf("error creating temporary file for transcoding: %w", err)
+		return "", err
+	}
+	tf.Close()
+	defer os.Remove(tf.Name())
+
+	// Here we set the final filename for the video file after transcoding.
+	var vf string
+	if name != "" && (cfg.Server.PreserveUploadFilename || p.PreserveUploadFilename) {
+		vf, err = securejoin.SecureJoin(
+			p.Path,
+			fmt.Sprintf("%s%s", filenameWithoutExtension(name), ext),
+		)
+	} else {
+		vf, err = securejoin.SecureJoin(
+			p.Path,
+			fmt.Sprintf("%s%s", shortuuid.New(), ext),
+		)
+	}
+	if err != nil {
+		err := fmt.Errorf("error creating file name in target library: %w", err)
+		return "", err
+	}
+	// If the (sanitized) original filename collides with an existing file,
+	// we try to add a shortuuid() to it until we find one that doesn't exist.
+	for {
+		taken, err := stemTaken(vf)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			break
+		}
+		logger(ctx).Warn("File '" + vf + "' (or one with its name) already exists.")
+		vf, err = securejoin.SecureJoin(
+			p.Path,
+			fmt.Sprintf("%s_%s%s", filenameWithoutExtension(vf), shortuuid.New(), ext),
+		)
+		if err != nil {
+			err := fmt.Errorf("error creating file name in target library: %w", err)
+			return "", err
+		}
+		logger(ctx).Warn("Using filename '" + vf + "' instead.")
+	}
+
+	thumbFn := fmt.Sprintf("%s.jpg", strings.TrimSuffix(tf.Name(), filepath.Ext(tf.Name())))
+	defer os.Remove(thumbFn)
+	vThumbFn := fmt.Sprintf("%s.jpg", strings.TrimSuffix(vf, filepath.Ext(vf)))
+
+	logger(ctx).
+		WithField("profile", profileName).
+		WithField("strategy", strategy).
+		WithField("reason", reason).
+		WithField("args", strings.Join(profile.StrategyArgs(strategy), " ")).
+		Info("transcoding video")
+
+	// TODO: Use a proper Job Queue and make this async
+	if err := a.transcoder().Transcode(ctx, src, tf.Name(), transcoder.Options{
+		Profile:  profile,
+		Strategy: strategy,
+		Metadata: metadata,
+		Timeout:  cfg.Transcoder.Timeout,
+	}); err != nil {
+		err := fmt.Errorf("error transcoding video: %w", err)
+		return "", err
+	}
+
+	audio := probe.IsAudio()
+	switch {
+	case thumb != "":
+		thumbFn = thumb
+	case audio && (probe.CoverArt || !cfg.Thumbnailer.Waveform):
+		// the cover art or the default thumbnail is shown
+		thumbFn = ""
+	case audio:
+		if err := a.transcoder().Waveform(ctx, src, thumbFn, cfg.Thumbnailer.Timeout); err != nil {
+			err := fmt.Errorf("error generating waveform: %w", err)
+			return "", err
+		}
+	default:
+		if err := a.transcoder().Thumbnail(
+			ctx, src, thumbFn,
+			cfg.Thumbnailer.PositionFromStart,
+			cfg.Thumbnailer.Timeout,
+		); err != nil {
+			err := fmt.Errorf("error generating thumbnail: %w", err)
+			return "", err
+		}
+	}
+
+	if thumbFn != "" {
+		if err := os.Rename(thumbFn, vThumbFn); err != nil {
+			err := fmt.Errorf("error renaming generated thumbnail: %w", err)
+			return "", err
+		}
+	}
+
+	// chapters of the container, written before the video is picked up
+	if chapters := containerChapters(probe); len(chapters) > 0 {
+		if err := media.UpdateSidecar(vf, map[string]interface{}{"chapters": chapters}); err != nil {
+			logger(ctx).WithError(err).Warn("error saving chapters")
+		}
+	}
+
+	if err := os.Rename(tf.Name(), vf); err != nil {
+		err := fmt.Errorf("error renaming transcoded video: %w", err)
+		return "", err
+	}
+
+	// TODO: Make this a background job
+	// Resize for lower quality options and additional formats
+	if audio {
+		return vf, nil
+	}
+	if err := a.transcodeRenditions(ctx, cfg, p, vf, metadata, false); err != nil {
+		return "", err
+	}
+
+	return vf, nil
+}
+
+// stemTaken returns whether a file sharing the stem of the video file vf
+// exists next to it: a media file of any extension (which would have the
+// same ID), a thumbnail or a sidecar.
+func stemTaken(vf string) (bool, error) {
+	stem := filenameWithoutExtension(vf)
+	files, err := ioutil.ReadDir(filepath.Dir(vf))
+	if err != nil {
+		return false, err
+	}
+	for _, info := range files {
+		name := info.Name()
+		if filenameWithoutExtension(name) != stem {
+			continue
+		}
+		if ext := filepath.Ext(name); media.IsMediaFile(name) || ext == ".jpg" || media.IsSidecarFile(name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// containerChapters returns the chapters of the container of probe, if any.
+func containerChapters(probe *transcoder.ProbeResult) []media.Chapter {
+	if probe == nil || len(probe.Chapters) == 0 {
+		return nil
+	}
+	chapters := make([]media.Chapter, 0, len(probe.Chapters))
+	for _, c := range probe.Chapters {
+		chapters = append(chapters, media.Chapter{Start: c.Start, End: c.End, Title: c.Title})
+	}
+	return chapters
+}
+
+// rendition is a lower quality (size) and/or additional format of a video.
+type rendition struct {
+	size   string // e.g: hd720, empty for the video's
+	suffix string // e.g: 720p, empty for the video's size
+	format string // e.g: vp9, empty for the MP4
+}
+
+// transcodeRenditions transcodes the video file vf of the library path p
+// into the configured sizes smaller than it (resizing never upscales) and
+// the additional formats of its profile. With missingOnly renditions that
+// already exist are skipped.
+func (a *App) transcodeRenditions(ctx context.Context, cfg *Config, p *media.Path, vf string, metadata map[string]string, missingOnly bool) error {
+	_, profile := cfg.Transcoder.Profile(p)
+
+	sizes := make([]string, 0, len(cfg.Transcoder.Sizes))
+	for size := range cfg.Transcoder.Sizes {
+		sizes = append(sizes, size)
+	}
+	sort.Strings(sizes)
+
+	var renditions []rendition
+	for _, size := range sizes {
+		renditions = append(renditions, rendition{size, cfg.Transcoder.Sizes[size], ""})
+	}
+	for _, format := range profile.Formats {
+		renditions = append(renditions, rendition{"", "", format.Name})
+		for _, size := range sizes {
+			renditions = append(renditions, rendition{size, cfg.Transcoder.Sizes[size], format.Name})
+		}
+	}
+
+	var todo []rendition
+	resize := false
+	for _, r := range renditions {
+		if missingOnly && utils.FileExists(media.RenditionPath(vf, r.suffix, r.format)) {
+			continue
+		}
+		todo = append(todo, r)
+		resize = resize || r.size != ""
+	}
+
+	// Only sizes smaller than the video
+	var probe *transcoder.ProbeResult
+	if resize {
+		var err error
+		probe, err = a.transcoder().Probe(ctx, vf, cfg.Transcoder.Timeout)
+		if err != nil {
+			logger(ctx).WithError(err).Warn("error probing transcoded video, resizing it to all sizes")
+		}
+	}
+	skipped := make(map[string]bool)
+
+	for _, r := range todo {
+		if r.size != "" && probe != nil && probe.Video != nil && transcoder.Fits(r.size, probe.Video.Width, probe.Video.Height) {
+			if !skipped[r.size] {
+				logger(ctx).
+					WithField("size", r.size).
+					WithField("resolution", fmt.Sprintf("%dx%d", probe.Video.Width, probe.Video.Height)).
+					Info("skipping size not smaller than the video")
+				skipped[r.size] = true
+			}
+			continue
+		}
+
+		opts := transcoder.Options{
+			Profile:  profile,
+			Metadata: metadata,
+			Timeout:  cfg.Transcoder.Timeout,
+		}
+		l := logger(ctx).WithField("size", r.size).WithField("vf", filepath.Base(vf))
+		if r.format == "" {
+			l.Info("resizing video for lower quality playback")
+		} else {
+			for _, format := range profile.Formats {
+				if format.Name == r.format {
+					opts.Profile = format.Profile(profile)
+				}
+			}
+			l.WithField("format", r.format).Info("transcoding video into additional format")
+		}
+
+		if err := a.transcodeRendition(ctx, vf, r, opts); err != nil {
+			if r.format != "" {
+				err := fmt.Errorf("error transcoding video to %s: %w", r.format, err)
+				return err
+			}
+			err := fmt.Errorf("error transcoding video: %w", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// transcodeRendition transcodes the video file vf into the rendition r. It's
+// encoded into a temporary file next to it, renamed into place only once
+// done, so a failed or cancelled encode never leaves a partial rendition
+// behind (which a backfill would take as done).
+func (a *App) transcodeRendition(ctx context.Context, vf string, r rendition, opts transcoder.Options) error {
+	dst := media.RenditionPath(vf, r.suffix, r.format)
+	tf, err := ioutil.TempFile(filepath.Dir(dst), ".tube-rendition-*"+filepath.Ext(dst))
+	if err != nil {
+		err := fmt.Errorf("error creating temporary file for transcoding: %w", err)
+		return err
+	}
+	tf.Close()
+	defer os.Remove(tf.Name())
+
+	if r.size != "" {
+		err = a.transcoder().Resize(ctx, vf, tf.Name(), r.size, opts)
+	} else {
+		err = a.transcoder().Transcode(ctx, vf, tf.Name(), opts)
+	}
+	if err != nil {
+		return err
+	}
+	// as written by ffmpeg, not TempFile's 0600
+	if err := os.Chmod(tf.Name(), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tf.Name(), dst); err != nil {
+		err := fmt.Errorf("error renaming transcoded rendition: %w", err)
+		return err
+	}
+	return nil
+}
+
+// ImportVideo downloads the video at url (see importers) and adds it to the
+// library path p like AddVideo. It returns the path of the new video.
+func (a *App) ImportVideo(ctx context.Context, url string, p *media.Path) (string, error) {
+	ctx, done, err := a.jobs.Start(ctx, "import", fmt.Sprintf("import %s", url))
+	if err != nil {
+		return "", err
+	}
+
+	vf, err := a.importVideo(ctx, url, p)
+	done(err)
+	return vf, err
+}
+
+// importVideo is the job run by ImportVideo.
+func (a *App) importVideo(ctx context.Context, url string, p *media.Path) (string, error) {
+	cfg := a.config()
+
+	videoImporter, err := a.NewImporter(url)
+	if err != nil {
+		err := fmt.Errorf("error creating video importer for %s: %w", url, err)
+		return "", err
+	}
+
+	videoInfo, err := videoImporter.GetVideoInfo(url)
+	if err != nil {
+		err := fmt.Errorf("error retriving video info for %s: %w", url, err)
+		return "", err
+	}
+
+	if err := a.ensureUploadPath(); err != nil {
+		return "", err
+	}
+
+	uf, err := ioutil.TempFile(
+		cfg.Server.UploadPath,
+		fmt.Sprintf("tube-import-*.mp4"),
+	)
+	if err != nil {
+		err := fmt.Errorf("error creating temporary file for importing: %w", err)
+		return "", err
+	}
+	uf.Close()
+	defer os.Remove(uf.Name())
+
+	logger(ctx).WithField("video_url", videoInfo.VideoURL).Info("requesting video size")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, videoInfo.VideoURL, nil)
+	if err != nil {
+		err := fmt.Errorf("error getting size of video %w", err)
+		return "", err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		err := fmt.Errorf("error getting size of video %w", err)
+		return "", err
+	}
+	res.Body.Close()
+	contentLength := utils.SafeParseInt64(res.Header.Get("Content-Length"), -1)
+	if contentLength == -1 {
+		err := fmt.Errorf("error calculating size of video")
+		logger(ctx).WithField("contentLength", contentLength).Error(err)
+		return "", err
+	}
+	if contentLength > cfg.Server.MaxUploadSize {
+		err := fmt.Errorf(
+			"imported video would exceed maximum upload size of %s",
+			humanize.Bytes(uint64(cfg.Server.MaxUploadSize)),
+		)
+		logger(ctx).
+			WithField("contentLength", contentLength).
+			WithField("max_upload_size", cfg.Server.MaxUploadSize).
+			Error(err)
+		return "", err
+	}
+
+	logger(ctx).WithField("contentLength", contentLength).Info("downloading video")
+
+	if err := utils.DownloadContext(ctx, videoInfo.VideoURL, uf.Name()); err != nil {
+		err := fmt.Errorf("error downloading video %s: %w", url, err)
+		return "", err
+	}
+
+	thumbFn := fmt.Sprintf("%s.jpg", strings.TrimSuffix(uf.Name(), filepath.Ext(uf.Name())))
+	defer os.Remove(thumbFn)
+
+	if err := utils.DownloadContext(ctx, videoInfo.ThumbnailURL, thumbFn); err != nil {
+		err := fmt.Errorf("error downloading thumbnail: %w", err)
+		return "", err
+	}
+
+	return a.addVideo(ctx, uf.Name(), thumbFn, p, "", videoInfo.Title, videoInfo.Description)
+}
@@ -0,0 +1,189 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.mills.io/prologic/tube/importers"
+	"git.mills.io/prologic/tube/media"
+	"git.mills.io/prologic/tube/transcoder"
+)
+
+// testVideo is an ID3v2 tag of only padding, a file the library can parse
+// (the fake transcoder copies it as is).
+var testVideo = []byte("ID3\x03\x00\x00\x00\x00\x00\x0a" + strings.Repeat("\x00", 10))
+
+// testProbe is the probe of a 1080p MP4 which is remuxed.
+var testProbe = &transcoder.ProbeResult{
+	Format: "mov,mp4,m4a,3gp,3g2,mj2",
+	Video:  &transcoder.Stream{CodecName: "h264", PixelFormat: "yuv420p", Width: 1920, Height: 1080},
+	Audio:  &transcoder.Stream{CodecName: "aac"},
+}
+
+// newPipelineTestApp returns a test App with its library loaded and upload
+// path created as Run does, resizing videos to 720p and 1080p.
+func newPipelineTestApp(t *testing.T, fake *transcoder.Fake) *App {
+	t.Helper()
+	a := newTestApp(t, fake)
+	t.Cleanup(func() { a.Close() })
+	a.Config.Transcoder.Sizes = map[string]string{"hd720": "720p", "hd1080": "1080p"}
+	if err := a.LoadLibrary(); err != nil {
+		t.Fatalf("error loading library: %s", err)
+	}
+	if err := a.ensureUploadPath(); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// addedVideo returns the video added to the library path of a, adding it
+// to the Library as the watcher would.
+func addedVideo(t *testing.T, a *App) *media.Video {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(a.config().Library[0].Path, "*.mp4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vfs []string
+	for _, m := range matches {
+		if !strings.Contains(filepath.Base(m), "#") {
+			vfs = append(vfs, m)
+		}
+	}
+	if len(vfs) != 1 {
+		t.Fatalf("expected 1 video in the library path, got %v", matches)
+	}
+	if err := a.Library.Add(vfs[0]); err != nil {
+		t.Fatalf("error adding %s to the library: %s", vfs[0], err)
+	}
+	id := strings.TrimSuffix(filepath.Base(vfs[0]), ".mp4")
+	v, ok := a.Library.Videos[id]
+	if !ok {
+		t.Fatalf("expected video %s in the library", id)
+	}
+	return v
+}
+
+// assertRenditions checks v was resized to 720p only (1080p isn't smaller
+// than the video).
+func assertRenditions(t *testing.T, v *media.Video) {
+	t.Helper()
+	renditions, err := media.Renditions(v.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(renditions) != 1 || renditions[0].Quality != "720p" || renditions[0].Path != media.RenditionPath(v.Path, "720p", "") {
+		t.Errorf("expected a 720p rendition, got %+v", renditions)
+	}
+}
+
+func TestUploadHandler(t *testing.T) {
+	fake := &transcoder.Fake{ProbeResult: testProbe}
+	a := newPipelineTestApp(t, fake)
+
+	r := newUploadRequest(t, "", a.config().Library[0].Path, "test.mp4", testVideo)
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "Video successfully uploaded!" {
+		t.Fatalf("expected upload to succeed, got %d %q", w.Code, w.Body.String())
+	}
+
+	v := addedVideo(t, a)
+	if string(v.Thumb) != "fake thumbnail" {
+		t.Errorf("expected the generated thumbnail, got %q", v.Thumb)
+	}
+	assertRenditions(t, v)
+
+	var methods []string
+	for _, c := range fake.Calls() {
+		methods = append(methods, c.Method)
+	}
+	if got, want := strings.Join(methods, ","), "Probe,Transcode,Thumbnail,Probe,Resize"; got != want {
+		t.Errorf("expected calls %s, got %s", want, got)
+	}
+}
+
+// testImporter imports every URL from a local server.
+type testImporter struct {
+	url string
+}
+
+func (i testImporter) GetVideoInfo(url string) (importers.VideoInfo, error) {
+	return importers.VideoInfo{
+		Title:        "Imported Video",
+		VideoURL:     i.url + "/video.mp4",
+		ThumbnailURL: i.url + "/thumb.jpg",
+	}, nil
+}
+
+func TestImportHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/video.mp4", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(testVideo)
+	})
+	mux.HandleFunc("/thumb.jpg", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("imported thumbnail"))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	fake := &transcoder.Fake{ProbeResult: testProbe}
+	a := newPipelineTestApp(t, fake)
+	a.NewImporter = func(url string) (importers.Importer, error) {
+		return testImporter{srv.URL}, nil
+	}
+
+	form := url.Values{"url": {"https://www.youtube.com/watch?v=test"}}
+	r := httptest.NewRequest("POST", "/import", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	a.Router.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "Video successfully imported!" {
+		t.Fatalf("expected import to succeed, got %d %q", w.Code, w.Body.String())
+	}
+
+	v := addedVideo(t, a)
+	if string(v.Thumb) != "imported thumbnail" {
+		t.Errorf("expected the imported thumbnail, got %q", v.Thumb)
+	}
+	assertRenditions(t, v)
+
+	for _, c := range fake.Calls() {
+		if c.Method == "Thumbnail" {
+			t.Error("expected the imported thumbnail to be used, got a generated one")
+		}
+	}
+}
+
+func TestUploadNameCollisions(t *testing.T) {
+	for _, existing := range []string{"talk.mp3", "talk.jpg", "talk.yml", "talk.MP4"} {
+		a := newPipelineTestApp(t, &transcoder.Fake{ProbeResult: testProbe})
+		a.Config.Server.PreserveUploadFilename = true
+		dir := a.config().Library[0].Path
+		if err := os.WriteFile(filepath.Join(dir, existing), []byte("existing"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		r := newUploadRequest(t, "", dir, "talk.mp4", testVideo)
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected upload to succeed, got %d %q", w.Code, w.Body.String())
+		}
+
+		if data, err := os.ReadFile(filepath.Join(dir, existing)); err != nil || string(data) != "existing" {
+			t.Errorf("%s: expected the existing file to be kept, got %q %v", existing, data, err)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "talk.mp4")); !os.IsNotExist(err) {
+			t.Errorf("%s: expected the upload to be renamed, got talk.mp4", existing)
+		}
+		if v := addedVideo(t, a); !strings.HasPrefix(v.ID, "talk_") {
+			t.Errorf("%s: expected the upload as talk_<uuid>.mp4, got %s", existing, v.ID)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// config returns the current configuration, which may be swapped by Reload.
+func (a *App) config() *Config {
+	a.configMu.RLock()
+	defer a.configMu.RUnlock()
+	return a.Config
+}
+
+// Reload re-reads the configuration with Loader and applies it live: library
+// paths are added to or removed from the Library and Watcher, the feed and
+// templates are rebuilt and new jobs use the new transcoder settings.
+//
+// Changes to settings that can only take effect on restart are ignored and
+// returned by their JSON path.
+func (a *App) Reload() ([]string, error) {
+	if a.Loader == nil {
+		return nil, fmt.Errorf("error, reloading the configuration is not supported")
+	}
+
+	a.reloadMu.Lock()
+	defer a.reloadMu.Unlock()
+
+	cfg, err := a.Loader()
+	if err != nil {
+		err := fmt.Errorf("error reloading configuration: %w", err)
+		return nil, err
+	}
+	old := a.config()
+
+	var restart []string
+	if cfg.Server.Host != old.Server.Host {
+		restart = append(restart, "server.host")
+		cfg.Server.Host = old.Server.Host
+	}
+	if cfg.Server.Port != old.Server.Port {
+		restart = append(restart, "server.port")
+		cfg.Server.Port = old.Server.Port
+	}
+	if cfg.Server.StorePath != old.Server.StorePath {
+		restart = append(restart, "server.store_path")
+		cfg.Server.StorePath = old.Server.StorePath
+	}
+	if cfg.Server.Listen != old.Server.Listen || cfg.Server.Socket != old.Server.Socket ||
+		cfg.Server.SocketMode != old.Server.SocketMode || cfg.Server.SocketGroup != old.Server.SocketGroup {
+		restart = append(restart, "server.listen")
+		cfg.Server.Listen = old.Server.Listen
+		cfg.Server.Socket = old.Server.Socket
+		cfg.Server.SocketMode = old.Server.SocketMode
+		cfg.Server.SocketGroup = old.Server.SocketGroup
+	}
+	if !reflect.DeepEqual(cfg.Server.TLS, old.Server.TLS) {
+		restart = append(restart, "server.tls")
+		cfg.Server.TLS = old.Server.TLS
+	}
+	for _, key := range restart {
+		log.WithField("key", key).Warn("configuration change requires a restart to take effect")
+	}
+
+	oldPaths := make(map[string]*PathConfig)
+	for _, pc := range old.Library {
+		oldPaths[filepath.Clean(pc.Path)] = pc
+	}
+	newPaths := make(map[string]*PathConfig)
+	for _, pc := range cfg.Library {
+		pc.Path = filepath.Clean(pc.Path)
+		newPaths[pc.Path] = pc
+	}
+
+	// Paths whose settings changed (e.g: prefix) are removed and added
+	// again as the IDs of their videos change.
+	for p, pc := range oldPaths {
+		if npc, ok := newPaths[p]; ok && *npc == *pc {
+			continue
+		}
+		a.Watcher.Remove(p)
+		a.Library.RemovePath(p)
+		log.WithField("path", p).Info("removed library path")
+	}
+	var errs []error
+	for p, pc := range newPaths {
+		if opc, ok := oldPaths[p]; ok && *opc == *pc {
+			continue
+		}
+		if err := a.addPath(pc); err != nil {
+			err := fmt.Errorf("error adding library path %s: %w", p, err)
+			log.Error(err)
+			errs = append(errs, err)
+			continue
+		}
+		a.Watcher.Add(p)
+		log.WithField("path", p).Info("added library path")
+	}
+
+	a.configMu.Lock()
+	a.Config = cfg
+	a.configMu.Unlock()
+
+	applyLogConfig(cfg.Log)
+	a.loadTemplates()
+	buildFeed(a)
+
+	if len(errs) > 0 {
+		return restart, errs[0]
+	}
+	log.Info("reloaded configuration")
+	return restart, nil
+}
+
+// reloadOnSIGHUP reloads the configuration whenever SIGHUP is received
+// until ctx is done.
+func (a *App) reloadOnSIGHUP(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Info("received SIGHUP, reloading configuration")
+			if _, err := a.Reload(); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
+
+// HTTP handler for /admin/reload
+func (a *App) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	restart, err := a.Reload()
+	if err != nil {
+		logger(r.Context()).Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if restart == nil {
+		restart = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&struct {
+		RestartRequired []string `json:"restart_required"`
+	}{restart}); err != nil {
+		logger(r.Context()).WithError(err).Error("error encoding reload result")
+	}
+}
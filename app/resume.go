@@ -0,0 +1,74 @@
+package app
+
+import (
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// watchedThreshold is the fraction of a video that has to be played back
+// for it to be considered watched (the credits don't matter).
+const watchedThreshold = 0.95
+
+// Progress returns the playback progress in percent (0-100).
+func (p Position) Progress() int {
+	if p.Duration <= 0 {
+		return 0
+	}
+	progress := int(p.Position * 100 / p.Duration)
+	if progress > 100 {
+		return 100
+	}
+	return progress
+}
+
+// Watched returns whether the video has been watched (almost) to the end.
+func (p Position) Watched() bool {
+	return p.Duration > 0 && p.Position >= p.Duration*watchedThreshold
+}
+
+// HTTP handler for /p/id
+func (a *App) positionHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	prefix, ok := vars["prefix"]
+	if ok {
+		id = path.Join(prefix, id)
+	}
+
+	if v, ok := a.Library.Videos[id]; !ok || !a.canView(r, v) {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	position, err := strconv.ParseFloat(r.FormValue("t"), 64)
+	if err != nil || position < 0 || math.IsNaN(position) || math.IsInf(position, 0) {
+		http.Error(w, "invalid position", http.StatusBadRequest)
+		return
+	}
+	duration, err := strconv.ParseFloat(r.FormValue("d"), 64)
+	if err == nil && (math.IsNaN(duration) || math.IsInf(duration, 0)) {
+		http.Error(w, "invalid duration", http.StatusBadRequest)
+		return
+	}
+	if err != nil || duration < 0 {
+		duration = 0
+	}
+
+	p := Position{
+		Position: position,
+		Duration: duration,
+		Updated:  time.Now(),
+	}
+	if err := a.Store.SetPosition(a.viewerID(r), id, p); err != nil {
+		logger(r.Context()).WithField("id", id).Warn(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,59 @@
+package app
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"git.mills.io/prologic/tube/transcoder"
+)
+
+func TestPositionHandler(t *testing.T) {
+	a := newPipelineTestApp(t, &transcoder.Fake{})
+	vf := filepath.Join(a.config().Library[0].Path, "video.mp4")
+	if err := os.WriteFile(vf, testVideo, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Library.Add(vf); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		t, d string
+		code int
+	}{
+		{"10", "60", http.StatusNoContent},
+		{"10", "", http.StatusNoContent},
+		{"10", "-1", http.StatusNoContent},
+		{"", "60", http.StatusBadRequest},
+		{"-1", "60", http.StatusBadRequest},
+		{"NaN", "60", http.StatusBadRequest},
+		{"Inf", "60", http.StatusBadRequest},
+		{"-Inf", "60", http.StatusBadRequest},
+		{"10", "NaN", http.StatusBadRequest},
+		{"10", "+Inf", http.StatusBadRequest},
+		{"10", "-Inf", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		form := url.Values{"t": {test.t}, "d": {test.d}}
+		r := httptest.NewRequest("POST", "/p/video", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		a.Router.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("t=%q d=%q: expected %d, got %d", test.t, test.d, test.code, w.Code)
+		}
+	}
+
+	positions, err := a.Store.GetPositions(a.viewerID(httptest.NewRequest("GET", "/", nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := positions["video"]; !ok || p.Position != 10 || p.Duration != 0 {
+		t.Errorf("expected the last valid position, got %+v", p)
+	}
+}
@@ -1,11 +1,56 @@
 package app
 
+import (
+	"time"
+)
+
+// Position is the playback position of a viewer in a video.
+type Position struct {
+	Position float64   `json:"position"`
+	Duration float64   `json:"duration"`
+	Updated  time.Time `json:"updated"`
+}
+
+// Comment is a comment on a video, ParentID is set for replies.
+type Comment struct {
+	ID       string    `json:"id"`
+	VideoID  string    `json:"video_id"`
+	ParentID string    `json:"parent_id,omitempty"`
+	Author   string    `json:"author"`
+	Viewer   string    `json:"viewer"`
+	IP       string    `json:"ip,omitempty"`
+	Body     string    `json:"body"`
+	Created  time.Time `json:"created"`
+	Approved bool      `json:"approved"`
+}
+
 // Store ...
 type Store interface {
 	Close() error
+	Ping() error
 	Migrate(collection, id string) error
 	GetViews_(collection, id string) (int64, error)
 	IncView_(collection, id string) error
 	GetViews(id string) (int64, error)
+	GetViewsMulti(ids []string) (map[string]int64, error)
 	IncViews(id string) error
+	SetViews(id string, views int64) error
+	IncDailyViews(id string, day time.Time) error
+	GetDailyViews(id string) (map[string]int64, error)
+	IncStat(id, name string, day time.Time, key string, n int64) error
+	GetStats(id, name string) (map[string]map[string]int64, error)
+	SetPosition(viewer, id string, position Position) error
+	GetPositions(viewer string) (map[string]Position, error)
+	SetLike(viewer, id string, like bool) error
+	HasLiked(viewer, id string) (bool, error)
+	GetLikes(id string) (int64, error)
+	PutComment(comment *Comment) error
+	GetComment(videoID, id string) (*Comment, error)
+	GetComments(videoID string) ([]*Comment, error)
+	GetPendingComments() ([]*Comment, error)
+	DeleteComment(videoID, id string) error
+	Ban(viewer string) error
+	Unban(viewer string) error
+	IsBanned(viewer string) (bool, error)
+	GetBans() ([]string, error)
 }
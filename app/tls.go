@@ -0,0 +1,213 @@
+package app
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certCheckInterval is how often the certificate files are checked for
+// changes (on handshakes).
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves the certificate loaded from a cert and key file and
+// reloads it when either file changes, e.g: after renewal by certbot.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+	checked time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// reload loads the certificate if either file changed since the last load
+// and returns whether it did.
+func (cr *certReloader) reload() (bool, error) {
+	certInfo, err := os.Stat(cr.certFile)
+	if err != nil {
+		return false, err
+	}
+	keyInfo, err := os.Stat(cr.keyFile)
+	if err != nil {
+		return false, err
+	}
+	if certInfo.ModTime().Equal(cr.certMod) && keyInfo.ModTime().Equal(cr.keyMod) {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		err := fmt.Errorf("error loading TLS certificate %s: %w", cr.certFile, err)
+		return false, err
+	}
+	cr.cert = &cert
+	cr.certMod = certInfo.ModTime()
+	cr.keyMod = keyInfo.ModTime()
+	return true, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if time.Since(cr.checked) >= certCheckInterval {
+		cr.checked = time.Now()
+		reloaded, err := cr.reload()
+		if err != nil {
+			log.WithError(err).Warn("error reloading TLS certificate, keeping the current one")
+		} else if reloaded {
+			log.WithField("cert", cr.certFile).Info("reloaded TLS certificate")
+		}
+	}
+	return cr.cert, nil
+}
+
+// acmeHTTPClient returns the HTTP client used to talk to the ACME server,
+// trusting the certificates in caCert in addition to the system's.
+func acmeHTTPClient(caCert string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caCert != "" {
+		pem, err := ioutil.ReadFile(caCert)
+		if err != nil {
+			err := fmt.Errorf("error reading ACME CA certificate: %w", err)
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("error, no certificates found in %s", caCert)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{Transport: &orderTransport{
+		base:   transport,
+		orders: make(map[string]string),
+	}}, nil
+}
+
+// orderTransport works around acme.Client expecting a Location header on
+// the response to finalizing an order, which CAs finalizing asynchronously
+// (e.g: Pebble) don't send, leaving it unable to poll the order. It
+// remembers the order URL of each finalize URL from new order responses and
+// adds the header if missing.
+type orderTransport struct {
+	base http.RoundTripper
+
+	mu     sync.Mutex
+	orders map[string]string
+}
+
+func (t *orderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.base.RoundTrip(req)
+	if err != nil || req.Method != http.MethodPost {
+		return res, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if order, ok := t.orders[req.URL.String()]; ok {
+		if res.StatusCode == http.StatusOK {
+			if res.Header.Get("Location") == "" {
+				res.Header.Set("Location", order)
+			}
+			delete(t.orders, req.URL.String())
+		}
+		return res, nil
+	}
+
+	location := res.Header.Get("Location")
+	if res.StatusCode != http.StatusCreated || location == "" {
+		return res, nil
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return res, nil
+	}
+	var order struct {
+		Finalize string `json:"finalize"`
+	}
+	if json.Unmarshal(body, &order) == nil && order.Finalize != "" {
+		t.orders[order.Finalize] = location
+	}
+	return res, nil
+}
+
+// newTLSConfig returns the TLS configuration for serving HTTPS and the
+// handler for the plain HTTP redirect listener (which also answers ACME
+// http-01 challenges).
+func newTLSConfig(cfg *ServerConfig) (*tls.Config, http.Handler, error) {
+	redirect := redirectHandler(cfg.Port)
+
+	if acmeCfg := cfg.TLS.ACME; acmeCfg != nil && acmeCfg.Enabled {
+		client, err := acmeHTTPClient(acmeCfg.CACert)
+		if err != nil {
+			return nil, nil, err
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(acmeCfg.CacheDir),
+			HostPolicy: autocert.HostWhitelist(acmeCfg.Domains...),
+			Email:      acmeCfg.Email,
+			Client: &acme.Client{
+				DirectoryURL: acmeCfg.DirectoryURL,
+				HTTPClient:   client,
+			},
+		}
+		// includes h2 and the tls-alpn-01 challenge protocol
+		return m.TLSConfig(), m.HTTPHandler(redirect), nil
+	}
+
+	cr, err := newCertReloader(cfg.TLS.Cert, cfg.TLS.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &tls.Config{
+		GetCertificate: cr.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+		MinVersion:     tls.VersionTLS12,
+	}, redirect, nil
+}
+
+// redirectHandler redirects requests to the same URL on HTTPS on port.
+func redirectHandler(port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -0,0 +1,284 @@
+package app
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	shortuuid "github.com/lithammer/shortuuid/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// viewerCookie is the name of the cookie identifying anonymous viewers.
+const viewerCookie = "tube_viewer"
+
+// authenticatedUser returns the id and display name of the user making the
+// request, if authenticated via Sandstorm or basic auth with the uploader
+// password.
+func (a *App) authenticatedUser(r *http.Request) (string, string, bool) {
+	if a.config().Auth.Sandstorm {
+		id := r.Header.Get("X-Sandstorm-User-Id")
+		if id == "" {
+			return "", "", false
+		}
+		name, err := url.PathUnescape(r.Header.Get("X-Sandstorm-Username"))
+		if err != nil || name == "" {
+			name = id
+		}
+		return id, name, true
+	}
+	password := a.config().Auth.Password
+	user, pass, ok := r.BasicAuth()
+	if !ok || password == "" || subtle.ConstantTimeCompare([]byte(pass), []byte(password)) != 1 {
+		return "", "", false
+	}
+	return user, user, true
+}
+
+// viewerID returns an identifier for the viewer making the request. Users
+// (authenticated via Sandstorm or basic auth) are identified by their user,
+// anonymous viewers by the viewer cookie. Without either we fall back to a
+// hash of the client's IP address and User-Agent.
+func (a *App) viewerID(r *http.Request) string {
+	if id, _, ok := a.authenticatedUser(r); ok {
+		return "user:" + id
+	}
+	if c, err := r.Cookie(viewerCookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+	sum := sha256.Sum256([]byte(a.clientIP(r) + "\x00" + r.UserAgent()))
+	return hex.EncodeToString(sum[:16])
+}
+
+// setViewerCookie hands out a viewer cookie if the request doesn't carry one.
+func setViewerCookie(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(viewerCookie); err == nil && c.Value != "" {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     viewerCookie,
+		Value:    shortuuid.New(),
+		Path:     "/",
+		MaxAge:   365 * 24 * 60 * 60,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// beacon is a playback event reported by the player.
+type beacon struct {
+	// Event is one of "play", "progress" or "ended".
+	Event string
+	// Watched is the number of seconds actually played back since the
+	// page was loaded (seeking does not count).
+	Watched float64
+	// Duration is the duration of the video in seconds (if known).
+	Duration float64
+	// Quality is the quality being played back ("" for the source).
+	Quality string
+}
+
+// viewSession tracks the playback activity of a single viewer on a single video.
+type viewSession struct {
+	last    time.Time
+	counted bool
+	played  bool
+	// permille is the watch-through (in 1/1000) recorded for this session.
+	permille int64
+}
+
+// viewCounter decides which playback beacons count as a view. A view is
+// counted at most once per viewer session, where a session ends after
+// SessionWindow seconds without any beacons from that viewer. As viewers
+// are free to drop their cookie, at most MaxSessions sessions are started
+// per client IP address within SessionWindow.
+//
+// Besides views it records the quality played and the watch-through of
+// each session as "quality" and "watch" statistics in the Store.
+type viewCounter struct {
+	mu       sync.Mutex
+	store    Store
+	sessions map[string]*viewSession
+	pruned   time.Time
+	limiter  *rateLimiter
+}
+
+func newViewCounter(store Store) *viewCounter {
+	return &viewCounter{
+		store:    store,
+		sessions: make(map[string]*viewSession),
+		pruned:   time.Now(),
+		limiter:  newRateLimiter(),
+	}
+}
+
+// Record accounts for a beacon of viewer, from the client IP address ip,
+// for the video id and returns whether it resulted in a new view.
+func (vc *viewCounter) Record(cfg *ViewsConfig, viewer, ip, id string, b beacon) (bool, error) {
+	// the player can't have watched more than the whole video
+	if b.Duration > 0 && b.Watched > b.Duration {
+		b.Watched = b.Duration
+	}
+
+	// videos shorter than the minimum watch time count when watched through
+	minWatchTime := float64(cfg.MinWatchTime)
+	short := b.Duration > 0 && b.Duration < minWatchTime
+	if short {
+		minWatchTime = b.Duration
+	}
+
+	var qualifies bool
+	switch b.Event {
+	case "play":
+		qualifies = cfg.MinWatchTime <= 0
+	case "progress":
+		qualifies = b.Watched >= minWatchTime
+	case "ended":
+		qualifies = short || b.Watched >= minWatchTime
+	}
+
+	now := time.Now()
+	window := time.Duration(cfg.SessionWindow) * time.Second
+
+	vc.mu.Lock()
+	key := viewer + "\x00" + id
+	s, ok := vc.sessions[key]
+	if !ok || now.Sub(s.last) > window {
+		if !vc.limiter.Allow(ip, cfg.MaxSessions, window) {
+			vc.mu.Unlock()
+			return false, nil
+		}
+		s = &viewSession{}
+		vc.sessions[key] = s
+	}
+	s.last = now
+	count := qualifies && !s.counted
+	if count {
+		s.counted = true
+	}
+	firstPlay := b.Event == "play" && !s.played
+	if firstPlay {
+		s.played = true
+	}
+	var watched int64
+	if b.Duration > 0 {
+		permille := int64(math.Min(b.Watched/b.Duration, 1) * 1000)
+		if permille > s.permille {
+			watched = permille - s.permille
+			s.permille = permille
+		}
+	}
+	if now.Sub(vc.pruned) > window {
+		for k, s := range vc.sessions {
+			if now.Sub(s.last) > window {
+				delete(vc.sessions, k)
+			}
+		}
+		vc.pruned = now
+	}
+	vc.mu.Unlock()
+
+	if firstPlay {
+		quality := b.Quality
+		if quality == "" {
+			quality = "source"
+		}
+		if err := vc.store.IncStat(id, "quality", now, quality, 1); err != nil {
+			return false, err
+		}
+	}
+
+	if watched > 0 {
+		if err := vc.store.IncStat(id, "watch", now, "permille", watched); err != nil {
+			return false, err
+		}
+	}
+
+	if !count {
+		return false, nil
+	}
+
+	if err := vc.store.IncViews(id); err != nil {
+		err := fmt.Errorf("error updating view for %s: %w", id, err)
+		return false, err
+	}
+	if err := vc.store.IncDailyViews(id, now); err != nil {
+		err := fmt.Errorf("error updating daily views for %s: %w", id, err)
+		return true, err
+	}
+	return true, nil
+}
+
+// HTTP handler for /b/id
+func (a *App) beaconHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	prefix, ok := vars["prefix"]
+	if ok {
+		id = path.Join(prefix, id)
+	}
+
+	v, ok := a.Library.Videos[id]
+	if !ok || !a.canView(r, v) {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	watched, err := strconv.ParseFloat(r.FormValue("watched"), 64)
+	if err != nil || math.IsNaN(watched) || math.IsInf(watched, 0) {
+		watched = 0
+	}
+	duration, err := strconv.ParseFloat(r.FormValue("duration"), 64)
+	if err != nil || math.IsNaN(duration) || math.IsInf(duration, 0) {
+		duration = 0
+	}
+	quality, _ := a.videoQuality(v, r.FormValue("quality"))
+	b := beacon{
+		Event:    r.FormValue("event"),
+		Watched:  watched,
+		Duration: duration,
+		Quality:  quality,
+	}
+	switch b.Event {
+	case "play", "progress", "ended":
+	default:
+		http.Error(w, fmt.Sprintf("invalid beacon event: %s", b.Event), http.StatusBadRequest)
+		return
+	}
+
+	counted, err := a.views.Record(a.config().Views, a.viewerID(r), a.clientIP(r), id, b)
+	if err != nil {
+		logger(r.Context()).WithField("id", id).Warn(err)
+	}
+	if counted {
+		logger(r.Context()).WithField("id", id).Debug("counted view")
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// recordReferrer records where a viewer of the video id came from as
+// "referrers" statistic, by host of the referring page.
+func (a *App) recordReferrer(r *http.Request, id string) {
+	referrer := "direct"
+	if u, err := url.Parse(r.Referer()); err == nil && u.Host != "" {
+		if u.Host == r.Host {
+			referrer = "internal"
+		} else {
+			referrer = strings.ToLower(u.Host)
+		}
+	}
+	if err := a.Store.IncStat(id, "referrers", time.Now(), referrer, 1); err != nil {
+		log.WithField("id", id).Warn(err)
+	}
+}
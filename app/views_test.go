@@ -0,0 +1,87 @@
+package app
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestViewCounterLimitsSessionsPerIP(t *testing.T) {
+	store := newTestStore(t)
+	vc := newViewCounter(store)
+	cfg := &ViewsConfig{SessionWindow: 60, MaxSessions: 3}
+
+	for i := 0; i < 10; i++ {
+		viewer := fmt.Sprintf("viewer%d", i)
+		if _, err := vc.Record(cfg, viewer, "192.0.2.1", "foo", beacon{Event: "play"}); err != nil {
+			t.Fatalf("error recording beacon: %s", err)
+		}
+	}
+	if _, err := vc.Record(cfg, "other", "192.0.2.2", "foo", beacon{Event: "play"}); err != nil {
+		t.Fatalf("error recording beacon: %s", err)
+	}
+
+	views, err := store.GetViews("foo")
+	if err != nil {
+		t.Fatalf("error getting views: %s", err)
+	}
+	if views != 4 {
+		t.Errorf("expected 4 views, got %d", views)
+	}
+}
+
+func TestViewCounterCapsWatched(t *testing.T) {
+	store := newTestStore(t)
+	vc := newViewCounter(store)
+	cfg := &ViewsConfig{SessionWindow: 60, MinWatchTime: 30}
+
+	b := beacon{Event: "progress", Watched: 1000, Duration: 60}
+	counted, err := vc.Record(cfg, "viewer", "192.0.2.1", "foo", b)
+	if err != nil {
+		t.Fatalf("error recording beacon: %s", err)
+	}
+	if !counted {
+		t.Error("expected a view for a 60s video watched beyond its duration")
+	}
+	stats, err := store.GetStats("foo", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var permille int64
+	for _, bucket := range stats {
+		permille += bucket["permille"]
+	}
+	if permille != 1000 {
+		t.Errorf("expected the watch-through capped at 1000, got %d", permille)
+	}
+}
+
+func TestViewCounterShortVideos(t *testing.T) {
+	cfg := &ViewsConfig{SessionWindow: 60, MinWatchTime: 30}
+	tests := []struct {
+		name    string
+		beacons []beacon
+		counted bool
+	}{
+		{"watched through", []beacon{{Event: "progress", Watched: 10, Duration: 10}}, true},
+		{"watched beyond", []beacon{{Event: "progress", Watched: 1000, Duration: 10}}, true},
+		{"ended", []beacon{{Event: "ended", Watched: 9.9, Duration: 10}}, true},
+		{"partially", []beacon{{Event: "progress", Watched: 5, Duration: 10}}, false},
+		{"play", []beacon{{Event: "play", Duration: 10}}, false},
+		{"long video ended early", []beacon{{Event: "ended", Watched: 20, Duration: 60}}, false},
+		{"unknown duration", []beacon{{Event: "ended", Watched: 10}}, false},
+	}
+	for _, test := range tests {
+		vc := newViewCounter(newTestStore(t))
+		var counted bool
+		for _, b := range test.beacons {
+			ok, err := vc.Record(cfg, "viewer", "192.0.2.1", "foo", b)
+			if err != nil {
+				t.Fatalf("%s: error recording beacon: %s", test.name, err)
+			}
+			counted = counted || ok
+		}
+		if counted != test.counted {
+			t.Errorf("%s: expected counted %t, got %t", test.name, test.counted, counted)
+		}
+	}
+}
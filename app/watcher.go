@@ -1,20 +1,22 @@
 package app
 
 import (
-	"path/filepath"
 	"strings"
 	"time"
 
 	fs "github.com/fsnotify/fsnotify"
 	log "github.com/sirupsen/logrus"
+
+	"git.mills.io/prologic/tube/media"
 )
 
 // This is the amount of time to wait after changes before reacting to them.
 // Debounce is done because moving files into the watched directories causes
 // many rapid "Write" events to fire which would cause excessive Remove/Add
 // method calls on the Library. To avoid this we accumulate the changes and
-// only perform them once the events have stopped for this amount of time.
-const debounceTimeout = time.Second * 5
+// only perform them once the events have stopped for this amount of time
+// (shortened by tests).
+var debounceTimeout = time.Second * 5
 
 // create, write, and chmod all require an add event
 const addFlags = fs.Create | fs.Write | fs.Chmod
@@ -23,14 +25,28 @@ const addFlags = fs.Create | fs.Write | fs.Chmod
 const removeFlags = fs.Remove | fs.Rename | fs.Write | fs.Chmod
 
 // watch library paths and update Library with changes.
+// Returns when the Watcher is closed.
 func startWatcher(a *App) {
 	timer := time.NewTimer(debounceTimeout)
+	defer timer.Stop()
 	addEvents := make(map[string]struct{})
 	removeEvents := make(map[string]struct{})
+	// yml sidecars whose media file is re-added
+	sidecarEvents := make(map[string]struct{})
 	for {
 		select {
-		case e := <-a.Watcher.Events:
-			if strings.ContainsAny(e.Name, "#") || filepath.Ext(e.Name) != ".mp4" {
+		case e, ok := <-a.Watcher.Events:
+			if !ok {
+				return
+			}
+			countWatcherEvent(a, e)
+			if media.IsSidecarFile(e.Name) {
+				log.Debugf("fsnotify sidecar event: %s", e)
+				sidecarEvents[e.Name] = struct{}{}
+				timer.Reset(debounceTimeout)
+				continue
+			}
+			if !media.IsMediaFile(e.Name) {
 				continue
 			}
 			log.Debugf("fsnotify event: %s", e)
@@ -43,7 +59,14 @@ func startWatcher(a *App) {
 			// reset timer
 			timer.Reset(debounceTimeout)
 		case <-timer.C:
-			eventCount := len(removeEvents) + len(addEvents)
+			eventCount := len(removeEvents) + len(addEvents) + len(sidecarEvents)
+			// a changed (or removed) sidecar changes its media file's metadata
+			for p := range sidecarEvents {
+				if vf, ok := media.SidecarMediaFile(p); ok {
+					addEvents[vf] = struct{}{}
+				}
+			}
+			sidecarEvents = make(map[string]struct{})
 			// handle remove events first
 			if len(removeEvents) > 0 {
 				for p := range removeEvents {
@@ -68,3 +91,15 @@ func startWatcher(a *App) {
 		}
 	}
 }
+
+// watcherOps are the operations of fsnotify events counted by metrics.
+var watcherOps = []fs.Op{fs.Create, fs.Write, fs.Remove, fs.Rename, fs.Chmod}
+
+// countWatcherEvent counts e per operation it carries.
+func countWatcherEvent(a *App, e fs.Event) {
+	for _, op := range watcherOps {
+		if e.Op&op != 0 {
+			a.metrics.watcherEvents.Inc(strings.ToLower(op.String()))
+		}
+	}
+}
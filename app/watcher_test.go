@@ -0,0 +1,68 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.mills.io/prologic/tube/media"
+	"git.mills.io/prologic/tube/transcoder"
+)
+
+// waitForVideo waits until the library has a video matching ok.
+func waitForVideo(t *testing.T, a *App, ok func(v *media.Video) bool) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, v := range a.Library.Playlist() {
+			if ok(v) {
+				return
+			}
+		}
+	}
+	t.Fatal("library wasn't updated")
+}
+
+func TestWatcherSidecarChanges(t *testing.T) {
+	defer func(d time.Duration) { debounceTimeout = d }(debounceTimeout)
+	debounceTimeout = 50 * time.Millisecond
+
+	a := newPipelineTestApp(t, &transcoder.Fake{})
+	dir := a.config().Library[0].Path
+	if err := a.Watcher.Add(dir); err != nil {
+		t.Fatal(err)
+	}
+	watcherDone := make(chan struct{})
+	go func() {
+		startWatcher(a)
+		close(watcherDone)
+	}()
+	// stopped before debounceTimeout is restored
+	defer func() {
+		a.Watcher.Close()
+		<-watcherDone
+	}()
+
+	vf := filepath.Join(dir, "foo.mp4")
+	if err := os.WriteFile(vf, testVideo, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitForVideo(t, a, func(v *media.Video) bool { return v.ID == "foo" && !v.IsPrivate() })
+
+	// edited by hand
+	if err := os.WriteFile(media.SidecarPath(vf), []byte("visibility: private\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitForVideo(t, a, func(v *media.Video) bool { return v.ID == "foo" && v.IsPrivate() })
+
+	// by the API
+	if err := media.UpdateSidecar(vf, map[string]interface{}{"visibility": nil, "title": "Foo"}); err != nil {
+		t.Fatal(err)
+	}
+	waitForVideo(t, a, func(v *media.Video) bool { return v.ID == "foo" && !v.IsPrivate() && v.Title == "Foo" })
+
+	if err := os.Remove(media.SidecarPath(vf)); err != nil {
+		t.Fatal(err)
+	}
+	waitForVideo(t, a, func(v *media.Video) bool { return v.ID == "foo" && v.Title == "foo" })
+}
@@ -0,0 +1,394 @@
+package app
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	shortuuid "github.com/lithammer/shortuuid/v3"
+	log "github.com/sirupsen/logrus"
+
+	"git.mills.io/prologic/tube/transcoder"
+	"git.mills.io/prologic/tube/worker"
+)
+
+// errLeaseExpired fails an attempt whose worker stopped reporting progress.
+var errLeaseExpired = errors.New("error, worker lease expired")
+
+// workTask is a transcoder call queued for the workers.
+type workTask struct {
+	worker.Task
+	src, dst string
+
+	attempts int
+	worker   string    // of the current lease
+	expires  time.Time // of the current lease
+
+	done chan error // receives the result once
+}
+
+// workQueue hands transcoder calls to remote workers (tube worker), see
+// WorkersConfig. It implements transcoder.Transcoder, each call blocks until
+// a worker uploaded its result, failed too often or ctx is cancelled. Probes
+// run on the local transcoder, they only read the source's headers.
+type workQueue struct {
+	mu      sync.Mutex
+	pending []*workTask
+	leased  map[string]*workTask // by lease
+
+	config func() *WorkersConfig
+	local  transcoder.Transcoder
+}
+
+var _ transcoder.Transcoder = (*workQueue)(nil)
+
+func newWorkQueue(config func() *WorkersConfig, local transcoder.Transcoder) *workQueue {
+	return &workQueue{leased: make(map[string]*workTask), config: config, local: local}
+}
+
+// Probe runs Probe on the local transcoder, rather than uploading the
+// source to a worker for it.
+func (q *workQueue) Probe(ctx context.Context, src string, timeout int) (*transcoder.ProbeResult, error) {
+	return q.local.Probe(ctx, src, timeout)
+}
+
+// Transcode runs Transcode on a worker.
+func (q *workQueue) Transcode(ctx context.Context, src, dst string, opts transcoder.Options) error {
+	return q.run(ctx, &workTask{Task: worker.Task{Op: worker.OpTranscode, Options: opts}, src: src, dst: dst})
+}
+
+// Resize runs Resize on a worker.
+func (q *workQueue) Resize(ctx context.Context, src, dst, size string, opts transcoder.Options) error {
+	return q.run(ctx, &workTask{Task: worker.Task{Op: worker.OpResize, Options: opts, Size: size}, src: src, dst: dst})
+}
+
+// Thumbnail runs Thumbnail on a worker.
+func (q *workQueue) Thumbnail(ctx context.Context, src, dst string, position, timeout int) error {
+	t := &workTask{Task: worker.Task{Op: worker.OpThumbnail, Position: position, Timeout: timeout}, src: src, dst: dst}
+	return q.run(ctx, t)
+}
+
+// Waveform runs Waveform on a worker.
+func (q *workQueue) Waveform(ctx context.Context, src, dst string, timeout int) error {
+	return q.run(ctx, &workTask{Task: worker.Task{Op: worker.OpWaveform, Timeout: timeout}, src: src, dst: dst})
+}
+
+// run queues t and waits for its result.
+func (q *workQueue) run(ctx context.Context, t *workTask) error {
+	t.SrcExt = filepath.Ext(t.src)
+	t.DstExt = filepath.Ext(t.dst)
+	t.done = make(chan error, 1)
+
+	q.mu.Lock()
+	q.pending = append(q.pending, t)
+	q.mu.Unlock()
+	logger(ctx).WithField("op", t.Op).WithField("src", filepath.Base(t.src)).Debug("queued task for workers")
+
+	select {
+	case err := <-t.done:
+		return err
+	case <-ctx.Done():
+		q.cancel(t)
+		return ctx.Err()
+	}
+}
+
+// cancel removes t from the queue, its worker is told on its next report.
+func (q *workQueue) cancel(t *workTask) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, p := range q.pending {
+		if p == t {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			return
+		}
+	}
+	if q.leased[t.Lease] == t {
+		delete(q.leased, t.Lease)
+	}
+}
+
+// lease assigns the oldest pending task to the worker name and returns it as
+// sent to the worker, false if there is none.
+func (q *workQueue) lease(name string) (worker.Task, bool) {
+	cfg := q.config()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) == 0 {
+		return worker.Task{}, false
+	}
+	t := q.pending[0]
+	q.pending = q.pending[1:]
+
+	t.attempts++
+	t.Lease = shortuuid.New()
+	t.LeaseTimeout = cfg.LeaseTimeout
+	t.Attempt = t.attempts
+	t.worker = name
+	t.expires = time.Now().Add(time.Duration(cfg.LeaseTimeout) * time.Second)
+	q.leased[t.Lease] = t
+	return t.Task, true
+}
+
+// get returns the task leased as lease, if the lease is still valid. Only
+// its fields set by run may be used without holding mu.
+func (q *workQueue) get(lease string) (*workTask, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	t, ok := q.leased[lease]
+	return t, ok
+}
+
+// extend extends the lease, it returns false if it's no longer valid.
+func (q *workQueue) extend(lease string) bool {
+	cfg := q.config()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	t, ok := q.leased[lease]
+	if ok {
+		t.expires = time.Now().Add(time.Duration(cfg.LeaseTimeout) * time.Second)
+	}
+	return ok
+}
+
+// finish ends the lease with the attempt's error err, nil if it succeeded.
+// Failed tasks are retried, by any worker, up to
+// max_attempts times. It returns false if the lease is no longer valid.
+func (q *workQueue) finish(lease string, err error) bool {
+	cfg := q.config()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	t, ok := q.leased[lease]
+	if !ok {
+		return false
+	}
+	q.end(cfg, t, err)
+	return true
+}
+
+// finishResult ends the lease with the result received into the temporary
+// file tmp. tmp is renamed to the task's destination
+// while holding mu, so the lease can't expire or be cancelled between the
+// check and the rename, or removed if the lease is no longer valid. It
+// returns false in that case, or the error renaming tmp the attempt failed
+// with.
+func (q *workQueue) finishResult(lease, tmp string) (bool, error) {
+	cfg := q.config()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	t, ok := q.leased[lease]
+	if !ok {
+		os.Remove(tmp)
+		return false, nil
+	}
+	err := os.Rename(tmp, t.dst)
+	if err != nil {
+		os.Remove(tmp)
+		err = fmt.Errorf("error renaming result: %w", err)
+	}
+	q.end(cfg, t, err)
+	return true, err
+}
+
+// end ends the lease of t, see finish. It must be called holding mu.
+func (q *workQueue) end(cfg *WorkersConfig, t *workTask, err error) {
+	delete(q.leased, t.Lease)
+
+	l := log.WithField("lease", t.Lease).WithField("worker", t.worker).WithField("op", t.Op).WithField("attempt", t.attempts)
+	switch {
+	case err == nil:
+		t.done <- nil
+	case t.attempts < cfg.MaxAttempts:
+		l.WithError(err).Warn("task failed, retrying")
+		// ahead of newer tasks
+		q.pending = append([]*workTask{t}, q.pending...)
+	default:
+		l.WithError(err).Warn("task failed, giving up")
+		t.done <- fmt.Errorf("error running %s on worker %s (attempt %d): %w", t.Op, t.worker, t.attempts, err)
+	}
+}
+
+// expireLeases fails the attempts of workers that stopped reporting
+// progress, every second until ctx is cancelled.
+func (q *workQueue) expireLeases(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			var expired []string
+			q.mu.Lock()
+			for lease, t := range q.leased {
+				if now.After(t.expires) {
+					expired = append(expired, lease)
+				}
+			}
+			q.mu.Unlock()
+			for _, lease := range expired {
+				q.finish(lease, errLeaseExpired)
+			}
+		}
+	}
+}
+
+// size returns the no. of pending and leased tasks.
+func (q *workQueue) size() (int, int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending), len(q.leased)
+}
+
+// transcoder returns the Transcoder for new calls: the workers if enabled
+// while serving, the local Transcoder otherwise.
+func (a *App) transcoder() transcoder.Transcoder {
+	if a.work != nil && a.config().Transcoder.Workers.Enabled {
+		return a.work
+	}
+	return a.Transcoder
+}
+
+// requireWorker wraps handler requiring the workers' bearer token.
+func (a *App) requireWorker(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := a.config().Transcoder.Workers
+		if !cfg.Enabled || a.work == nil {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="tube workers"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// HTTP handler for /api/worker/lease
+func (a *App) workerLeaseHandler(w http.ResponseWriter, r *http.Request) {
+	var req worker.LeaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	t, ok := a.work.lease(req.Worker)
+	if !ok {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	logger(r.Context()).
+		WithField("lease", t.Lease).
+		WithField("worker", req.Worker).
+		WithField("op", t.Op).
+		WithField("attempt", t.Attempt).
+		Info("leased task to worker")
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&t); err != nil {
+		logger(r.Context()).WithError(err).Error("error encoding task")
+	}
+}
+
+// HTTP handler for /api/worker/leases/{lease}/{action}
+func (a *App) workerLeaseActionHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	lease, action := vars["lease"], vars["action"]
+	t, ok := a.work.get(lease)
+	if !ok {
+		http.Error(w, "lease expired or task cancelled", http.StatusGone)
+		return
+	}
+	l := logger(r.Context()).WithField("lease", lease)
+
+	switch {
+	case action == "source" && r.Method == "GET":
+		http.ServeFile(w, r, t.src)
+		return
+
+	case action == "progress" && r.Method == "POST":
+		var p worker.Progress
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		ok = a.work.extend(lease)
+		l.WithField("worker", p.Worker).WithField("stage", p.Stage).Debug("worker reported progress")
+
+	case action == "fail" && r.Method == "POST":
+		var f worker.Failure
+		if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		ok = a.work.finish(lease, errors.New(f.Error))
+
+	case action == "result" && r.Method == "PUT":
+		tmp, err := receiveWorkResult(t, r.Body)
+		if err == nil {
+			ok, err = a.work.finishResult(lease, tmp)
+		} else {
+			ok = a.work.finish(lease, err)
+		}
+		if err != nil {
+			l.WithError(err).Error("error saving worker result")
+		}
+		if err != nil && ok {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	if !ok {
+		http.Error(w, "lease expired or task cancelled", http.StatusGone)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// receiveWorkResult receives the output file of t read from body into a
+// temporary file next to its destination, whose name is returned (see
+// finishResult).
+func receiveWorkResult(t *workTask, body io.Reader) (string, error) {
+	tf, err := os.CreateTemp(filepath.Dir(t.dst), ".tube-worker-*"+t.DstExt)
+	if err != nil {
+		err := fmt.Errorf("error creating temporary file: %w", err)
+		return "", err
+	}
+	if _, err = io.Copy(tf, body); err != nil {
+		err = fmt.Errorf("error receiving result: %w", err)
+	}
+	if cerr := tf.Close(); err == nil {
+		err = cerr
+	}
+	// as written by ffmpeg, not CreateTemp's 0600
+	if err == nil {
+		err = os.Chmod(tf.Name(), 0o644)
+	}
+	if err != nil {
+		os.Remove(tf.Name())
+		return "", err
+	}
+	return tf.Name(), nil
+}
@@ -0,0 +1,93 @@
+package app
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.mills.io/prologic/tube/transcoder"
+	"git.mills.io/prologic/tube/worker"
+)
+
+// leaseTranscode queues a transcode of src to dst on q, leases it and
+// returns the task and the transcode's result.
+func leaseTranscode(t *testing.T, ctx context.Context, q *workQueue, src, dst string) (worker.Task, chan error) {
+	t.Helper()
+	result := make(chan error, 1)
+	go func() { result <- q.Transcode(ctx, src, dst, transcoder.Options{}) }()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if task, ok := q.lease("test"); ok {
+			return task, result
+		}
+	}
+	t.Fatal("transcode wasn't queued")
+	return worker.Task{}, nil
+}
+
+// writeResult writes a worker's result to a temporary file in dir.
+func writeResult(t *testing.T, dir string) string {
+	t.Helper()
+	tmp := filepath.Join(dir, ".tube-worker-result.mp4")
+	if err := os.WriteFile(tmp, []byte("result"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return tmp
+}
+
+func TestFinishResult(t *testing.T) {
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "video.mp4")
+	q := newWorkQueue(func() *WorkersConfig { return &WorkersConfig{LeaseTimeout: 60, MaxAttempts: 1} }, &transcoder.Fake{})
+
+	task, result := leaseTranscode(t, context.Background(), q, filepath.Join(dir, "src.mp4"), dst)
+	tmp := writeResult(t, dir)
+	if ok, err := q.finishResult(task.Lease, tmp); !ok || err != nil {
+		t.Fatalf("expected the result to be saved, got %t %v", ok, err)
+	}
+	if err := <-result; err != nil {
+		t.Errorf("expected the transcode to succeed, got %s", err)
+	}
+	if data, err := os.ReadFile(dst); err != nil || string(data) != "result" {
+		t.Errorf("expected the result at %s, got %q %v", dst, data, err)
+	}
+}
+
+func TestFinishResultCancelled(t *testing.T) {
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "video.mp4")
+	q := newWorkQueue(func() *WorkersConfig { return &WorkersConfig{LeaseTimeout: 60, MaxAttempts: 1} }, &transcoder.Fake{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	task, result := leaseTranscode(t, ctx, q, filepath.Join(dir, "src.mp4"), dst)
+	cancel()
+	<-result
+
+	tmp := writeResult(t, dir)
+	if ok, _ := q.finishResult(task.Lease, tmp); ok {
+		t.Error("expected the cancelled lease to be invalid")
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("expected no result at %s, got %v", dst, err)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("expected the result to be discarded, got %v", err)
+	}
+}
+
+func TestProbeRunsLocally(t *testing.T) {
+	fake := &transcoder.Fake{ProbeResult: &transcoder.ProbeResult{Format: "mov,mp4,m4a,3gp,3g2,mj2"}}
+	q := newWorkQueue(func() *WorkersConfig { return &WorkersConfig{LeaseTimeout: 60, MaxAttempts: 1} }, fake)
+
+	probe, err := q.Probe(context.Background(), "video.mp4", 0)
+	if err != nil || probe.Format != fake.ProbeResult.Format {
+		t.Fatalf("expected the local probe result, got %+v %v", probe, err)
+	}
+	if pending, leased := q.size(); pending != 0 || leased != 0 {
+		t.Errorf("expected no tasks for the workers, got %d pending and %d leased", pending, leased)
+	}
+	if calls := fake.Calls(); len(calls) != 1 || calls[0].Method != "Probe" {
+		t.Errorf("expected a local probe, got %+v", calls)
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	flag "github.com/spf13/pflag"
+
+	"git.mills.io/prologic/tube/app"
+	"git.mills.io/prologic/tube/media"
+	"git.mills.io/prologic/tube/worker"
+)
+
+// serveCmd starts the server.
+func serveCmd(args []string) error {
+	fs := newFlagSet("serve")
+	fs.Parse(args)
+	if !setup() {
+		return nil
+	}
+
+	cfg, err := readConfig(fs)
+	if err != nil {
+		return err
+	}
+	a, err := app.NewApp(cfg)
+	if err != nil {
+		return err
+	}
+	a.Loader = func() (*app.Config, error) {
+		return loadConfig(fs)
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+	return a.Run(ctx)
+}
+
+// signalContext returns a context that is cancelled on SIGINT or SIGTERM.
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// openApp reads the configuration and loads the library for the offline
+// commands add, backfill and import, these fail if a server holds the store
+// open.
+func openApp(fs *flag.FlagSet) (*app.App, error) {
+	cfg, err := readConfig(fs)
+	if err != nil {
+		return nil, err
+	}
+	a, err := app.NewApp(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.LoadLibrary(); err != nil {
+		a.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// importCmd imports a video from a url into a collection.
+func importCmd(args []string) error {
+	fs := newFlagSet("import")
+	collection := fs.String("collection", "", "path or prefix of the collection to import into (default first library path)")
+	fs.Parse(args)
+	if !setup() {
+		return nil
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	a, err := openApp(fs)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	p, err := a.Collection(*collection)
+	if err != nil {
+		return err
+	}
+	ctx, stop := signalContext()
+	defer stop()
+	vf, err := a.ImportVideo(ctx, fs.Arg(0), p)
+	if err != nil {
+		return err
+	}
+	fmt.Println(vf)
+	return nil
+}
+
+// addCmd transcodes a video file and adds it to a collection.
+func addCmd(args []string) error {
+	fs := newFlagSet("add")
+	collection := fs.String("collection", "", "path or prefix of the collection to add to (default first library path)")
+	title := fs.String("title", "", "title of the video")
+	description := fs.String("description", "", "description of the video")
+	fs.Parse(args)
+	if !setup() {
+		return nil
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	src := fs.Arg(0)
+	if _, err := os.Stat(src); err != nil {
+		return err
+	}
+
+	a, err := openApp(fs)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	p, err := a.Collection(*collection)
+	if err != nil {
+		return err
+	}
+	ctx, stop := signalContext()
+	defer stop()
+	vf, err := a.AddVideo(ctx, src, p, src, *title, *description)
+	if err != nil {
+		return err
+	}
+	fmt.Println(vf)
+	return nil
+}
+
+// backfillCmd generates the missing renditions and thumbnails of the
+// library's videos.
+func backfillCmd(args []string) error {
+	fs := newFlagSet("backfill")
+	fs.Parse(args)
+	if !setup() {
+		return nil
+	}
+
+	a, err := openApp(fs)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+
+	ctx, stop := signalContext()
+	defer stop()
+	return a.Backfill(ctx)
+}
+
+// workerCmd runs transcodes for a server until interrupted.
+func workerCmd(args []string) error {
+	hostname, _ := os.Hostname()
+	fs := newFlagSet("worker")
+	server := fs.String("server", "", "base URL of the server (e.g: https://tube.example)")
+	token := fs.String("token", os.Getenv("TUBE_WORKER_TOKEN"), "transcoder.workers.token of the server (default $TUBE_WORKER_TOKEN)")
+	name := fs.String("name", hostname, "name of the worker reported to the server")
+	dir := fs.String("dir", "", "directory for temporary files (default the system's)")
+	poll := fs.Duration("poll", 5*time.Second, "wait between requests for tasks while idle")
+	fs.Parse(args)
+	if !setup() {
+		return nil
+	}
+	if *server == "" || *token == "" || fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	w := &worker.Worker{
+		Server: *server,
+		Token:  *token,
+		Name:   *name,
+		Dir:    *dir,
+		Poll:   *poll,
+	}
+	ctx, stop := signalContext()
+	defer stop()
+	return w.Run(ctx)
+}
+
+// scanCmd lists the videos of all library paths and the files which
+// failed to parse.
+func scanCmd(args []string) error {
+	fs := newFlagSet("scan")
+	fs.Parse(args)
+	if !setup() {
+		return nil
+	}
+
+	cfg, err := readConfig(fs)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, pc := range cfg.Library {
+		p := &media.Path{Path: pc.Path, Prefix: pc.Prefix}
+		results, err := media.Scan(p)
+		if err != nil {
+			err := fmt.Errorf("error scanning %s: %w", pc.Path, err)
+			return err
+		}
+		sort.Slice(results, func(i, j int) bool {
+			return results[i].Name < results[j].Name
+		})
+		fmt.Printf("%s (prefix %q): %d files\n", pc.Path, pc.Prefix, len(results))
+		for _, res := range results {
+			if res.Err != nil {
+				failed++
+				fmt.Printf("  ERROR %s: %s\n", res.Name, res.Err)
+				continue
+			}
+			fmt.Printf("  %s\t%s\n", res.Video.ID, res.Video.Title)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("error parsing %d files", failed)
+	}
+	return nil
+}
+
+// viewsCmd shows or changes the views of a video in the store.
+func viewsCmd(args []string) error {
+	fs := newFlagSet("views")
+	fs.Parse(args)
+	if !setup() {
+		return nil
+	}
+
+	action, nargs := fs.Arg(0), 2
+	if action == "set" {
+		nargs = 3
+	}
+	if fs.NArg() != nargs || (action != "get" && action != "set" && action != "reset") {
+		fs.Usage()
+		os.Exit(2)
+	}
+	id := fs.Arg(1)
+
+	cfg, err := readConfig(fs)
+	if err != nil {
+		return err
+	}
+	store, err := app.NewBitcaskStore(cfg.Server.StorePath)
+	if err != nil {
+		err := fmt.Errorf("error opening store %s: %w", cfg.Server.StorePath, err)
+		return err
+	}
+	defer store.Close()
+
+	switch action {
+	case "set":
+		views, err := strconv.ParseInt(fs.Arg(2), 10, 64)
+		if err != nil || views < 0 {
+			return fmt.Errorf("error, invalid no. of views: %s", fs.Arg(2))
+		}
+		if err := store.SetViews(id, views); err != nil {
+			return err
+		}
+	case "reset":
+		if err := store.SetViews(id, 0); err != nil {
+			return err
+		}
+	}
+
+	views, err := store.GetViews(id)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\t%d\n", id, views)
+	return nil
+}
+
+// configCmd checks the configuration file.
+func configCmd(args []string) error {
+	fs := newFlagSet("config")
+	fs.Parse(args)
+	if !setup() {
+		return nil
+	}
+	if fs.NArg() != 1 || fs.Arg(0) != "check" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	cfg := app.DefaultConfig()
+	if err := cfg.ReadFile(config); err != nil {
+		err := fmt.Errorf("error reading configuration %s: %w", config, err)
+		return err
+	}
+	if err := cfg.ApplyEnv(os.Environ()); err != nil {
+		return err
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	for _, pc := range cfg.Library {
+		if info, err := os.Stat(pc.Path); err != nil {
+			log.WithField("path", pc.Path).Warn("library path does not exist")
+		} else if !info.IsDir() {
+			return fmt.Errorf("error, library path %s is not a directory", pc.Path)
+		}
+	}
+	fmt.Printf("%s: ok\n", config)
+	return nil
+}
+
+// healthcheckTimeout is the seconds a healthcheck waits for the server.
+const healthcheckTimeout = 10
+
+// healthcheckCmd requests /healthz of the server on the listener of its
+// configuration (TCP, HTTPS or a Unix domain socket), or at --url, and
+// fails unless it's healthy.
+func healthcheckCmd(args []string) error {
+	fs := newFlagSet("healthcheck")
+	url := fs.String("url", "", "URL of /healthz (required with server.listen set to systemd)")
+	fs.Parse(args)
+	if !setup() {
+		return nil
+	}
+	// only errors are of interest
+	log.SetLevel(log.WarnLevel)
+
+	cfg, err := readConfig(fs)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: healthcheckTimeout * time.Second}
+	if *url == "" {
+		*url, client.Transport, err = healthcheckTarget(cfg.Server)
+		if err != nil {
+			return err
+		}
+	}
+
+	res, err := client.Get(*url)
+	if err != nil {
+		err := fmt.Errorf("error checking health: %w", err)
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("error, server is unhealthy: %s", res.Status)
+	}
+	return nil
+}
+
+// healthcheckTarget returns the URL of /healthz on the listener of cfg and
+// the transport to reach it.
+func healthcheckTarget(cfg *app.ServerConfig) (string, http.RoundTripper, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	scheme := "http"
+	if cfg.TLS.Enabled() {
+		scheme = "https"
+		// the certificate is for the public name, not the local address
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	switch cfg.Listen {
+	case "unix":
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", cfg.Socket)
+		}
+		return scheme + "://tube/healthz", transport, nil
+	case "systemd":
+		return "", nil, fmt.Errorf("error, the socket passed by systemd is unknown, use --url")
+	}
+
+	host := cfg.Host
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	u := fmt.Sprintf("%s://%s/healthz", scheme, net.JoinHostPort(host, strconv.Itoa(cfg.Port)))
+	return u, transport, nil
+}
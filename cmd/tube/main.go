@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 
@@ -12,54 +14,230 @@ import (
 )
 
 var (
-	debug   bool
-	version bool
-	config  string
+	debug       bool
+	version     bool
+	config      string
+	printConfig bool
 )
 
+// command is a tube subcommand.
+type command struct {
+	Name  string
+	Usage string
+	Help  string
+	Run   func(args []string) error
+}
+
+// commands are the available subcommands, set up in init.
+var commands []*command
+
 func init() {
+	commands = []*command{
+		{
+			Name:  "serve",
+			Usage: "serve",
+			Help:  "start the server (default)",
+			Run:   serveCmd,
+		},
+		{
+			Name:  "import",
+			Usage: "import [--collection name] <url>",
+			Help:  "import a video from a supported url (see importers)",
+			Run:   importCmd,
+		},
+		{
+			Name:  "add",
+			Usage: "add [--collection name] [--title title] [--description text] <file>",
+			Help:  "transcode and add a video file to a collection",
+			Run:   addCmd,
+		},
+		{
+			Name:  "backfill",
+			Usage: "backfill",
+			Help:  "generate missing renditions and thumbnails of the library",
+			Run:   backfillCmd,
+		},
+		{
+			Name:  "worker",
+			Usage: "worker --server <url> [--token token] [--name name]",
+			Help:  "run transcodes for a server with transcoder.workers enabled",
+			Run:   workerCmd,
+		},
+		{
+			Name:  "scan",
+			Usage: "scan",
+			Help:  "list the videos found in the library and files that failed to parse",
+			Run:   scanCmd,
+		},
+		{
+			Name:  "views",
+			Usage: "views get <id> | views set <id> <views> | views reset <id>",
+			Help:  "show or change the views of a video",
+			Run:   viewsCmd,
+		},
+		{
+			Name:  "healthcheck",
+			Usage: "healthcheck [--url url]",
+			Help:  "check the liveness of the server on its configured listener (e.g: for Docker)",
+			Run:   healthcheckCmd,
+		},
+		{
+			Name:  "config",
+			Usage: "config check",
+			Help:  "check the configuration file",
+			Run:   configCmd,
+		},
+	}
+
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [options] [file]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] [command] [arguments]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nCommands:\n")
+		for _, cmd := range commands {
+			fmt.Fprintf(os.Stderr, "  %-12s %s\n", cmd.Name, cmd.Help)
+		}
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
 		flag.PrintDefaults()
 	}
 
-	flag.BoolVarP(&version, "version", "v", false, "display version information")
-	flag.BoolVarP(&debug, "debug", "d", false, "enable debug logging")
-	flag.StringVarP(&config, "config", "c", "config.json", "path to configuration file")
+	config = "config.json"
+	addGlobalFlags(flag.CommandLine)
+	// stop parsing at the command, it parses its own flags
+	flag.CommandLine.SetInterspersed(false)
 }
 
-func main() {
-	flag.Parse()
-
-	if debug {
-		log.SetLevel(log.DebugLevel)
-	} else {
-		log.SetLevel(log.InfoLevel)
-	}
+// addGlobalFlags adds the options shared by all commands to fs, keeping
+// the values of options given before the command.
+func addGlobalFlags(fs *flag.FlagSet) {
+	fs.BoolVarP(&version, "version", "v", version, "display version information")
+	fs.BoolVarP(&debug, "debug", "d", debug, "enable debug logging")
+	fs.StringVarP(&config, "config", "c", config, "path to configuration file")
+	fs.BoolVar(&printConfig, "print-config", printConfig, "print the effective configuration and exit")
+}
 
-	if version {
-		fmt.Printf("tube version %s", tube.FullVersion())
-		os.Exit(0)
+// newFlagSet returns a FlagSet for the command cmd including the global options.
+func newFlagSet(cmd string) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	fs.Usage = func() {
+		for _, c := range commands {
+			if c.Name == cmd {
+				fmt.Fprintf(os.Stderr, "Usage: %s %s\n\n%s\n\nOptions:\n", os.Args[0], c.Usage, c.Help)
+			}
+		}
+		fs.PrintDefaults()
 	}
+	addGlobalFlags(fs)
+	return fs
+}
 
+// loadConfig reads the configuration file on top of the builtin defaults,
+// applies environment overrides and validates the result. The file is
+// optional unless the --config option was given explicitly, but a file
+// that exists must be valid.
+func loadConfig(fs *flag.FlagSet) (*app.Config, error) {
 	cfg := app.DefaultConfig()
 	log.Infof("Reading configuration from %s", config)
 	err := cfg.ReadFile(config)
 	if err != nil {
-		if flag.Lookup("config").Changed {
-			log.Fatal(err)
+		explicit := flag.CommandLine.Changed("config") || (fs != nil && fs.Changed("config"))
+		if explicit || !os.IsNotExist(err) {
+			return nil, err
 		}
 		log.WithError(err).Infof("Reading %s failed. Starting with builtin defaults.", config)
 	}
-	// I'd like to add something like this here: log.Debug("Active config: %s", cfg.toJson())
-	a, err := app.NewApp(cfg)
-	if err != nil {
-		log.Fatal(err)
+	if err := cfg.ApplyEnv(os.Environ()); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// readConfig loads the configuration (see loadConfig). With --print-config
+// the effective configuration is printed and the program exits.
+func readConfig(fs *flag.FlagSet) (*app.Config, error) {
+	cfg, err := loadConfig(fs)
+	if !printConfig || cfg == nil {
+		if err != nil {
+			return nil, err
+		}
+		return cfg, nil
+	}
+
+	// don't leak secrets
+	printed := *cfg
+	if cfg.Auth != nil && cfg.Auth.Password != "" {
+		auth := *cfg.Auth
+		auth.Password = "********"
+		printed.Auth = &auth
 	}
-	addr := fmt.Sprintf("%s:%d", cfg.Server.Host, cfg.Server.Port)
-	log.Printf("Local server: http://%s", addr)
-	err = a.Run()
+	if cfg.Transcoder != nil && cfg.Transcoder.Workers != nil && cfg.Transcoder.Workers.Token != "" {
+		transcoderCfg, workers := *cfg.Transcoder, *cfg.Transcoder.Workers
+		workers.Token = "********"
+		transcoderCfg.Workers = &workers
+		printed.Transcoder = &transcoderCfg
+	}
+	if cfg.Metrics != nil && cfg.Metrics.Token != "" {
+		metrics := *cfg.Metrics
+		metrics.Token = "********"
+		printed.Metrics = &metrics
+	}
+	data, jsonErr := json.MarshalIndent(printed, "", "    ")
+	if jsonErr != nil {
+		return nil, jsonErr
+	}
+	fmt.Println(string(data))
 	if err != nil {
+		return nil, err
+	}
+	os.Exit(0)
+	return cfg, nil
+}
+
+func main() {
+	flag.Parse()
+
+	args := flag.Args()
+	name := "serve"
+	if len(args) > 0 {
+		name, args = args[0], args[1:]
+	}
+
+	var cmd *command
+	for _, c := range commands {
+		if c.Name == name {
+			cmd = c
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n\n", name)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := cmd.Run(args); err != nil {
+		var verrs app.ValidationErrors
+		if errors.As(err, &verrs) {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 		log.Fatal(err)
 	}
 }
+
+// setup applies the global options once the command parsed its flags and
+// returns whether the command should continue.
+func setup() bool {
+	if debug {
+		log.SetLevel(log.DebugLevel)
+	} else {
+		log.SetLevel(log.InfoLevel)
+	}
+
+	if version {
+		fmt.Printf("tube version %s", tube.FullVersion())
+		return false
+	}
+
+	return true
+}
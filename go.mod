@@ -6,6 +6,7 @@ require (
 	git.mills.io/prologic/bitcask v1.0.2
 	git.mills.io/prologic/vimeodl v0.0.0-20210827153510-f28ed0158ec3
 	github.com/Andreychik32/ytdl v1.0.4
+	github.com/BurntSushi/toml v1.3.2
 	github.com/cyphar/filepath-securejoin v0.2.3
 	github.com/dhowden/tag v0.0.0-20220618230019-adf36e896086
 	github.com/dustin/go-humanize v1.0.1
@@ -16,6 +17,7 @@ require (
 	github.com/sirupsen/logrus v1.9.0
 	github.com/spf13/pflag v1.0.5
 	github.com/wybiral/feeds v1.1.1
+	golang.org/x/crypto v0.17.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -34,5 +36,7 @@ require (
 	github.com/plar/go-adaptive-radix-tree v1.0.5 // indirect
 	github.com/rs/zerolog v1.28.0 // indirect
 	golang.org/x/exp v0.0.0-20230118134722-a68e582fa157 // indirect
-	golang.org/x/sys v0.4.0 // indirect
+	golang.org/x/net v0.10.0 // indirect
+	golang.org/x/sys v0.15.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
 )
@@ -0,0 +1,110 @@
+package media
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Chapter is a chapter marker of a video.
+type Chapter struct {
+	Start float64 `json:"start"`         // in seconds
+	End   float64 `json:"end,omitempty"` // in seconds, 0 until the next chapter
+	Title string  `json:"title"`
+}
+
+// yamlChapter is a Chapter in a yml sidecar, with timestamps (see
+// ParseTimestamp) rather than seconds, e.g: {start: "1:30", title: Intro}.
+type yamlChapter struct {
+	Start string `yaml:"start"`
+	End   string `yaml:"end,omitempty"`
+	Title string `yaml:"title"`
+}
+
+// UnmarshalYAML decodes a chapter of a yml sidecar.
+func (c *Chapter) UnmarshalYAML(n *yaml.Node) error {
+	var y yamlChapter
+	if err := n.Decode(&y); err != nil {
+		return err
+	}
+	start, err := ParseTimestamp(y.Start)
+	if err != nil {
+		return fmt.Errorf("error parsing start of chapter %q: %w", y.Title, err)
+	}
+	var end float64
+	if y.End != "" {
+		if end, err = ParseTimestamp(y.End); err != nil {
+			return fmt.Errorf("error parsing end of chapter %q: %w", y.Title, err)
+		}
+	}
+	*c = Chapter{Start: start, End: end, Title: y.Title}
+	return nil
+}
+
+// MarshalYAML encodes a chapter for a yml sidecar.
+func (c Chapter) MarshalYAML() (interface{}, error) {
+	y := yamlChapter{Start: FormatTimestamp(c.Start), Title: c.Title}
+	if c.End > 0 {
+		y.End = FormatTimestamp(c.End)
+	}
+	return y, nil
+}
+
+// ParseTimestamp parses a timestamp in seconds, minutes:seconds or
+// hours:minutes:seconds (seconds may have a fraction), e.g: 90, 1:30 or
+// 01:01:30.500, into seconds.
+func ParseTimestamp(s string) (float64, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	var seconds float64
+	for i, part := range parts {
+		var (
+			n   float64
+			err error
+		)
+		if i == len(parts)-1 {
+			n, err = strconv.ParseFloat(part, 64)
+		} else {
+			var m int
+			m, err = strconv.Atoi(part)
+			n = float64(m)
+		}
+		if err != nil || n < 0 || math.IsInf(n, 0) || math.IsNaN(n) {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+		seconds = seconds*60 + n
+	}
+	return seconds, nil
+}
+
+// FormatTimestamp formats seconds as hours:minutes:seconds.milliseconds,
+// e.g: 00:01:30.000, as used by WebVTT.
+func FormatTimestamp(seconds float64) string {
+	ms := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// SortChapters sorts chapters by their start.
+func SortChapters(chapters []Chapter) {
+	sort.SliceStable(chapters, func(i, j int) bool {
+		return chapters[i].Start < chapters[j].Start
+	})
+}
+
+// ChapterEnd returns the end of the i-th of the sorted chapters: its own,
+// the start of the next one or, for the last one without an end, -1.
+func ChapterEnd(chapters []Chapter, i int) float64 {
+	switch {
+	case chapters[i].End > chapters[i].Start:
+		return chapters[i].End
+	case i+1 < len(chapters):
+		return chapters[i+1].Start
+	}
+	return -1
+}
@@ -51,22 +51,52 @@ func (lib *Library) AddPath(p *Path) error {
 	return nil
 }
 
-// Import adds all valid videos from a given path.
-func (lib *Library) Import(p *Path) error {
+// ScanResult is the result of parsing a single file of a media path.
+type ScanResult struct {
+	Name  string
+	Video *Video
+	Err   error
+}
+
+// Scan parses all files of a given path that Import would consider and
+// returns the parsed video or the error for each of them.
+func Scan(p *Path) ([]ScanResult, error) {
 	files, err := ioutil.ReadDir(p.Path)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	var results []ScanResult
 	for _, info := range files {
-		if strings.ContainsAny(info.Name(), "#") {
+		if info.IsDir() || strings.ContainsAny(info.Name(), "#") {
 			// ignore resized videos e.g: #240p.mp4
 			continue
 		}
-		err = lib.Add(path.Join(p.Path, info.Name()))
-		if err != nil {
+		switch filepath.Ext(info.Name()) {
+		case ".jpg", ".yml":
+			// ignore thumbnails and metadata of videos
+			continue
+		}
+		v, err := ParseVideo(p, info.Name())
+		results = append(results, ScanResult{Name: info.Name(), Video: v, Err: err})
+	}
+	return results, nil
+}
+
+// Import adds all valid videos from a given path.
+func (lib *Library) Import(p *Path) error {
+	results, err := Scan(p)
+	if err != nil {
+		return err
+	}
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+	for _, result := range results {
+		if result.Err != nil {
 			// Ignore files that can't be parsed
 			continue
 		}
+		lib.Videos[result.Video.ID] = result.Video
+		log.Debug("Added:", result.Video.Path)
 	}
 	return nil
 }
@@ -118,6 +148,30 @@ func (lib *Library) Remove(fp string) {
 	}
 }
 
+// RemovePath removes a media path and all its videos from the library.
+func (lib *Library) RemovePath(p string) {
+	lib.mu.Lock()
+	defer lib.mu.Unlock()
+	if _, ok := lib.Paths[p]; !ok {
+		return
+	}
+	for id, v := range lib.Videos {
+		if path.Dir(filepath.ToSlash(v.Path)) == p {
+			delete(lib.Videos, id)
+			log.Debug("Removed:", v.Path)
+		}
+	}
+	delete(lib.Paths, p)
+}
+
+// PathOf returns the library path (collection) the video v belongs to.
+func (lib *Library) PathOf(v *Video) (*Path, bool) {
+	lib.mu.RLock()
+	defer lib.mu.RUnlock()
+	p, ok := lib.Paths[path.Dir(filepath.ToSlash(v.Path))]
+	return p, ok
+}
+
 // Playlist returns a sorted Playlist of all videos.
 func (lib *Library) Playlist() Playlist {
 	lib.mu.RLock()
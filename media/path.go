@@ -5,4 +5,6 @@ type Path struct {
 	Path                   string
 	Prefix                 string
 	PreserveUploadFilename bool
+	DisableComments        bool
+	Profile                string // transcoding profile, empty for the default
 }
@@ -6,6 +6,18 @@ import (
 
 type Playlist []*Video
 
+// Listed returns the videos of the playlist that are listed (see
+// Video.Listed).
+func (pl Playlist) Listed() Playlist {
+	listed := make(Playlist, 0, len(pl))
+	for _, v := range pl {
+		if v.Listed() {
+			listed = append(listed, v)
+		}
+	}
+	return listed
+}
+
 // By is the type of a "less" function that defines the ordering of its Playlist arguments.
 type By func(v1, v2 *Video) bool
 
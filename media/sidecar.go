@@ -0,0 +1,370 @@
+package media
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SidecarVersion is the version of the yml sidecar schema, sidecars without
+// a version are read as this one.
+const SidecarVersion = 1
+
+// Visibility is who a video is shown to.
+type Visibility string
+
+const (
+	// Public videos are listed in the playlist and the feed.
+	Public Visibility = "public"
+	// Unlisted videos are only shown to those who have their link.
+	Unlisted Visibility = "unlisted"
+	// Private videos are only shown to administrators.
+	Private Visibility = "private"
+)
+
+// Sidecar is the metadata of a video in its yml sidecar (see SidecarPath),
+// it overrides the tags of the video file.
+type Sidecar struct {
+	Version     int        `yaml:"version,omitempty"`
+	Title       string     `yaml:"title,omitempty"`
+	Album       string     `yaml:"album,omitempty"`
+	Description string     `yaml:"description,omitempty"`
+	Tags        []string   `yaml:"tags,omitempty"`
+	Speakers    []string   `yaml:"speakers,omitempty"`  // or authors
+	Recorded    Date       `yaml:"recorded,omitempty"`  // when it was recorded
+	Published   Date       `yaml:"published,omitempty"` // overrides the file's modification time
+	License     string     `yaml:"license,omitempty"`   // e.g: CC-BY-4.0
+	Language    string     `yaml:"language,omitempty"`  // e.g: en or pt-BR
+	Source      string     `yaml:"source,omitempty"`    // URL of the original
+	Visibility  Visibility `yaml:"visibility,omitempty"`
+	Chapters    []Chapter  `yaml:"chapters,omitempty"`
+}
+
+// sidecarKeys are the keys of the yml sidecar schema.
+var sidecarKeys = func() map[string]bool {
+	keys := make(map[string]bool)
+	t := reflect.TypeOf(Sidecar{})
+	for i := 0; i < t.NumField(); i++ {
+		keys[strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]] = true
+	}
+	return keys
+}()
+
+// languagePattern matches BCP 47 language tags, e.g: en, pt-BR or zh-Hant.
+var languagePattern = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+
+// Date is a date, or a time, of a yml sidecar: 2006-01-02 or RFC 3339.
+type Date struct {
+	time.Time
+}
+
+// ParseDate parses a date as 2006-01-02 or RFC 3339.
+func ParseDate(s string) (Date, error) {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return Date{t}, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return Date{}, fmt.Errorf("invalid date %q, expected e.g: 2006-01-02", s)
+	}
+	return Date{t}, nil
+}
+
+// String formats d as 2006-01-02 if it's midnight UTC, as RFC 3339
+// otherwise.
+func (d Date) String() string {
+	if d.Equal(d.Truncate(24*time.Hour)) && d.Location() == time.UTC {
+		return d.Format("2006-01-02")
+	}
+	return d.Format(time.RFC3339)
+}
+
+// UnmarshalYAML decodes a date of a yml sidecar.
+func (d *Date) UnmarshalYAML(n *yaml.Node) error {
+	date, err := ParseDate(n.Value)
+	if err != nil {
+		return err
+	}
+	*d = date
+	return nil
+}
+
+// MarshalYAML encodes a date for a yml sidecar.
+func (d Date) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+// UnmarshalJSON decodes a date of the API, "" for none.
+func (d *Date) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if s == "" {
+		*d = Date{}
+		return nil
+	}
+	date, err := ParseDate(s)
+	if err != nil {
+		return err
+	}
+	*d = date
+	return nil
+}
+
+// Validate returns the problems of the metadata, resetting its invalid
+// values: visibility to private (better hidden than leaked), source and
+// language to empty.
+func (s *Sidecar) Validate() []string {
+	var problems []string
+	if s.Version > SidecarVersion {
+		problems = append(problems, fmt.Sprintf("version %d is newer than the supported %d", s.Version, SidecarVersion))
+	}
+	switch s.Visibility {
+	case "", Public, Unlisted, Private:
+	default:
+		problems = append(problems, fmt.Sprintf("invalid visibility %q (public, unlisted or private), treating it as private", s.Visibility))
+		s.Visibility = Private
+	}
+	if s.Source != "" {
+		if u, err := url.Parse(s.Source); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Sprintf("invalid source %q, expected an http(s) URL", s.Source))
+			s.Source = ""
+		}
+	}
+	if s.Language != "" && !languagePattern.MatchString(s.Language) {
+		problems = append(problems, fmt.Sprintf("invalid language %q, expected e.g: en or pt-BR", s.Language))
+		s.Language = ""
+	}
+	s.Tags = trimList(s.Tags)
+	s.Speakers = trimList(s.Speakers)
+	return problems
+}
+
+// trimList returns the items of list trimmed, without empty ones.
+func trimList(list []string) []string {
+	var trimmed []string
+	for _, item := range list {
+		if item = strings.TrimSpace(item); item != "" {
+			trimmed = append(trimmed, item)
+		}
+	}
+	return trimmed
+}
+
+// ReadSidecar reads the yml sidecar of the video file pth, nil if there is
+// none, and returns the warnings about its unknown keys and invalid values.
+func ReadSidecar(pth string) (*Sidecar, []string, error) {
+	data, err := ioutil.ReadFile(SidecarPath(pth))
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, err
+	}
+	if len(doc.Content) == 0 {
+		// empty
+		return &Sidecar{}, nil, nil
+	}
+	m := doc.Content[0]
+	if m.Kind != yaml.MappingNode {
+		return nil, nil, fmt.Errorf("line %d: expected a mapping", m.Line)
+	}
+
+	// key by key, so that an invalid value only loses its key
+	var (
+		s        Sidecar
+		warnings []string
+	)
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		key, value := m.Content[i], m.Content[i+1]
+		if !sidecarKeys[key.Value] {
+			warnings = append(warnings, fmt.Sprintf("line %d: unknown key %q", key.Line, key.Value))
+			continue
+		}
+		pair := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: []*yaml.Node{key, value}}
+		if err := pair.Decode(&s); err != nil {
+			warning := fmt.Sprintf("line %d: invalid %s: %s", key.Line, key.Value, err)
+			if te, ok := err.(*yaml.TypeError); ok {
+				warning = fmt.Sprintf("invalid %s: %s", key.Value, strings.Join(te.Errors, "; "))
+			}
+			if key.Value == "visibility" {
+				warning += ", treating it as private"
+				s.Visibility = Private
+			}
+			warnings = append(warnings, warning)
+		}
+	}
+	return &s, append(warnings, s.Validate()...), nil
+}
+
+// apply sets the metadata of the video v to the one of the sidecar.
+func (s *Sidecar) apply(v *Video) {
+	if s.Title != "" {
+		v.Title = s.Title
+	}
+	if s.Album != "" {
+		v.Album = s.Album
+	}
+	if s.Description != "" {
+		v.Description = s.Description
+	}
+	v.Tags = s.Tags
+	v.Speakers = s.Speakers
+	v.Recorded = s.Recorded.Time
+	v.Published = s.Published.Time
+	v.License = s.License
+	v.Language = s.Language
+	v.Source = s.Source
+	v.Visibility = s.Visibility
+	v.Chapters = s.Chapters
+
+	switch {
+	case !v.Published.IsZero():
+		v.Timestamp = v.Published
+	case !v.Recorded.IsZero():
+		v.Timestamp = v.Recorded
+	}
+	v.Modified = v.Timestamp.Format("2006-01-02 03:04 PM")
+}
+
+// SidecarPath returns the path of the yml sidecar of the video file pth,
+// e.g: videos/foo.yml.
+func SidecarPath(pth string) string {
+	return fmt.Sprintf("%s.yml", strings.TrimSuffix(pth, filepath.Ext(pth)))
+}
+
+// UpdateSidecar sets the keys of the yml sidecar of the video file pth to
+// values, or removes those whose value is nil, creating it if needed. Its
+// other keys are kept as they are and its version is set to SidecarVersion.
+func UpdateSidecar(pth string, values map[string]interface{}) error {
+	fn := SidecarPath(pth)
+	data, err := ioutil.ReadFile(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		err := fmt.Errorf("error parsing %s: %w", fn, err)
+		return err
+	}
+	if len(doc.Content) == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	m := doc.Content[0]
+	if m.Kind != yaml.MappingNode {
+		return fmt.Errorf("error updating %s: not a mapping", fn)
+	}
+
+	// the version goes first
+	version := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: fmt.Sprint(SidecarVersion)}
+	found := false
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == "version" {
+			m.Content[i+1] = version
+			found = true
+		}
+	}
+	if !found {
+		m.Content = append([]*yaml.Node{{Kind: yaml.ScalarNode, Value: "version"}, version}, m.Content...)
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if values[key] == nil {
+			for i := 0; i+1 < len(m.Content); i += 2 {
+				if m.Content[i].Value == key {
+					m.Content = append(m.Content[:i], m.Content[i+2:]...)
+					break
+				}
+			}
+			continue
+		}
+		var value yaml.Node
+		if err := value.Encode(values[key]); err != nil {
+			err := fmt.Errorf("error encoding %s: %w", key, err)
+			return err
+		}
+		found := false
+		for i := 0; i+1 < len(m.Content); i += 2 {
+			if m.Content[i].Value == key {
+				m.Content[i+1] = &value
+				found = true
+			}
+		}
+		if !found {
+			m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, &value)
+		}
+	}
+
+	data, err = yaml.Marshal(&doc)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fn, data)
+}
+
+// writeFileAtomic writes data to the file fn through a temporary file renamed
+// over it, so readers (e.g: the library watcher) never see it half written.
+func writeFileAtomic(fn string, data []byte) error {
+	tf, err := os.CreateTemp(filepath.Dir(fn), ".tube-sidecar-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tf.Name())
+	if _, err := tf.Write(data); err != nil {
+		tf.Close()
+		return err
+	}
+	if err := tf.Close(); err != nil {
+		return err
+	}
+	// as ioutil.WriteFile would, not CreateTemp's 0600
+	if err := os.Chmod(tf.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tf.Name(), fn)
+}
+
+// IsSidecarFile returns whether the file name is a yml sidecar.
+func IsSidecarFile(name string) bool {
+	return filepath.Ext(name) == ".yml"
+}
+
+// SidecarMediaFile returns the media file (see IsMediaFile) of the yml
+// sidecar pth, false if there is none next to it.
+func SidecarMediaFile(pth string) (string, bool) {
+	dir := filepath.Dir(pth)
+	stem := strings.TrimSuffix(filepath.Base(pth), filepath.Ext(pth))
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", false
+	}
+	for _, info := range files {
+		name := info.Name()
+		if !info.IsDir() && IsMediaFile(name) && strings.TrimSuffix(name, filepath.Ext(name)) == stem {
+			return filepath.Join(dir, name), true
+		}
+	}
+	return "", false
+}
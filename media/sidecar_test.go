@@ -0,0 +1,172 @@
+package media
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testVideo is an ID3v2 tag of only padding, a file ParseVideo can parse.
+var testVideo = []byte("ID3\x03\x00\x00\x00\x00\x00\x0a" + strings.Repeat("\x00", 10))
+
+// writeVideo writes the video file name with the yml sidecar sidecar (none
+// if empty) into dir and returns its path.
+func writeVideo(t *testing.T, dir, name, sidecar string) string {
+	t.Helper()
+	pth := filepath.Join(dir, name)
+	if err := os.WriteFile(pth, testVideo, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if sidecar != "" {
+		if err := os.WriteFile(SidecarPath(pth), []byte(sidecar), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return pth
+}
+
+func TestReadSidecar(t *testing.T) {
+	dir := t.TempDir()
+	pth := writeVideo(t, dir, "foo.mp4", `title: Foo
+tags: [" go ", ""]
+recorded: 2021-03-04
+visibility: hidden
+language: not a language
+chapters:
+  - start: "1:30"
+    title: Interview
+  - start: 0
+    title: Intro
+unknown: true
+`)
+
+	s, warnings, err := ReadSidecar(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Title != "Foo" || !reflect.DeepEqual(s.Tags, []string{"go"}) || s.Recorded.String() != "2021-03-04" {
+		t.Errorf("unexpected sidecar %+v", s)
+	}
+	if s.Visibility != Private {
+		t.Errorf("expected an invalid visibility to be private, got %q", s.Visibility)
+	}
+	if s.Language != "" {
+		t.Errorf("expected an invalid language to be reset, got %q", s.Language)
+	}
+	if len(s.Chapters) != 2 || s.Chapters[0].Start != 90 {
+		t.Errorf("unexpected chapters %+v", s.Chapters)
+	}
+	if len(warnings) != 3 {
+		t.Errorf("expected warnings about the unknown key, visibility and language, got %q", warnings)
+	}
+
+	if s, _, err := ReadSidecar(filepath.Join(dir, "none.mp4")); s != nil || err != nil {
+		t.Errorf("expected no sidecar, got %+v %v", s, err)
+	}
+}
+
+func TestParseVideoUnreadableSidecar(t *testing.T) {
+	dir := t.TempDir()
+	p := &Path{Path: dir}
+	for name, sidecar := range map[string]string{
+		"syntax.mp4":  "visibility: private\ntitle: [unterminated\n",
+		"mapping.mp4": "- visibility: private\n",
+	} {
+		writeVideo(t, dir, name, sidecar)
+		v, err := ParseVideo(p, name)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if !v.IsPrivate() {
+			t.Errorf("%s: expected a video with an unreadable sidecar to be private, got %q", name, v.Visibility)
+		}
+	}
+
+	writeVideo(t, dir, "public.mp4", "title: Public\n")
+	v, err := ParseVideo(p, "public.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Title != "Public" || !v.Listed() {
+		t.Errorf("expected a listed video titled Public, got %q %q", v.Title, v.Visibility)
+	}
+}
+
+func TestUpdateSidecar(t *testing.T) {
+	pth := writeVideo(t, t.TempDir(), "foo.mp4", "# edited by hand\ntitle: Foo\ntags: [a]\n")
+
+	err := UpdateSidecar(pth, map[string]interface{}{
+		"tags":     nil,
+		"chapters": []Chapter{{Start: 90, Title: "Interview"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(SidecarPath(pth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), "version: 1\n") || !strings.Contains(string(data), "# edited by hand") {
+		t.Errorf("expected the version first and the comment kept, got:\n%s", data)
+	}
+	s, _, err := ReadSidecar(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Title != "Foo" || s.Tags != nil || len(s.Chapters) != 1 || s.Chapters[0].Start != 90 {
+		t.Errorf("unexpected sidecar %+v", s)
+	}
+}
+
+func TestParseTimestamp(t *testing.T) {
+	tests := map[string]float64{
+		"90":          90,
+		"1:30":        90,
+		"01:01:30.5":  3690.5,
+		" 0 ":         0,
+		"":            -1,
+		"1:2:3:4":     -1,
+		"-1":          -1,
+		"1.5:00":      -1,
+		"NaN":         -1,
+		"Inf":         -1,
+		"ninety":      -1,
+		"1:30:00:00":  -1,
+		"00:00:01.25": 1.25,
+	}
+	for s, want := range tests {
+		got, err := ParseTimestamp(s)
+		if want < 0 {
+			if err == nil {
+				t.Errorf("ParseTimestamp(%q): expected an error, got %v", s, got)
+			}
+		} else if err != nil || got != want {
+			t.Errorf("ParseTimestamp(%q): expected %v, got %v %v", s, want, got, err)
+		}
+	}
+}
+
+func TestRenditions(t *testing.T) {
+	dir := t.TempDir()
+	pth := filepath.Join(dir, "foo.mp4")
+	for _, name := range []string{"foo.mp4", "foo#720p.mp4", "foo#vp9.webm", "foo#480p.vp9.webm", "foo#.mp4", "foo#720p.jpg", "foobar#720p.mp4"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	renditions, err := Renditions(pth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Rendition{
+		{Quality: "480p", Format: "vp9", Path: RenditionPath(pth, "480p", "vp9")},
+		{Quality: "720p", Path: RenditionPath(pth, "720p", "")},
+		{Format: "vp9", Path: RenditionPath(pth, "", "vp9")},
+	}
+	if !reflect.DeepEqual(renditions, want) {
+		t.Errorf("expected %+v, got %+v", want, renditions)
+	}
+}
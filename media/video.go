@@ -12,7 +12,6 @@ import (
 
 	"git.mills.io/prologic/tube/utils"
 	"github.com/dhowden/tag"
-	"gopkg.in/yaml.v3"
 )
 
 // Video represents metadata for a single video.
@@ -27,28 +26,70 @@ type Video struct {
 	Size        int64
 	Path        string
 	Timestamp   time.Time
+	Chapters    []Chapter // sorted by start
+
+	// from the yml sidecar, see Sidecar
+	Tags       []string
+	Speakers   []string
+	Recorded   time.Time
+	Published  time.Time
+	License    string
+	Language   string
+	Source     string
+	Visibility Visibility
 
 	Views int64
 }
 
-func getTagsFromYml(v *Video) error {
-	ymlFileName := fmt.Sprintf("%s.yml", strings.TrimSuffix(v.Path, filepath.Ext(v.Path)))
-	if !utils.FileExists(ymlFileName) {
-		return nil
-	}
+// audioTypes are the MIME types of the audio-only files the library plays by
+// extension.
+var audioTypes = map[string]string{
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".ogg":  "audio/ogg",
+	".flac": "audio/flac",
+}
 
-	ymlFile, err := ioutil.ReadFile(ymlFileName)
-	if err != nil {
-		return err
+// IsMediaFile returns whether the file name is played by the library: an MP4
+// video or an audio file (but not a rendition, or a hidden temporary file
+// being written, e.g: .tube-rendition-*.mp4).
+func IsMediaFile(name string) bool {
+	base := filepath.Base(name)
+	if strings.ContainsAny(base, "#") || strings.HasPrefix(base, ".") {
+		return false
 	}
+	ext := strings.ToLower(filepath.Ext(name))
+	_, audio := audioTypes[ext]
+	return ext == ".mp4" || audio
+}
 
-	err = yaml.Unmarshal(ymlFile, v)
-	if err != nil {
-		return err
-	}
+// Ext returns the (lower case) extension of the file of v, e.g: .mp4 or .mp3.
+func (v *Video) Ext() string {
+	return strings.ToLower(filepath.Ext(v.Path))
+}
 
-	log.Println("Got tags from yml for", v.Path)
-	return nil
+// IsAudio returns whether v is audio-only, e.g: a podcast episode.
+func (v *Video) IsAudio() bool {
+	_, ok := audioTypes[v.Ext()]
+	return ok
+}
+
+// Listed returns whether v is listed in the playlist and the feed.
+func (v *Video) Listed() bool {
+	return v.Visibility == "" || v.Visibility == Public
+}
+
+// IsPrivate returns whether v is only shown to administrators.
+func (v *Video) IsPrivate() bool {
+	return v.Visibility == Private
+}
+
+// MIMEType returns the MIME type of the file of v.
+func (v *Video) MIMEType() string {
+	if t, ok := audioTypes[v.Ext()]; ok {
+		return t
+	}
+	return "video/mp4"
 }
 
 // ParseVideo parses a video file's metadata and returns a Video.
@@ -96,10 +137,18 @@ func ParseVideo(p *Path, name string) (*Video, error) {
 		Timestamp:   timestamp,
 	}
 	// read yml if exists
-	err = getTagsFromYml(v)
+	sidecar, warnings, err := ReadSidecar(pth)
+	for _, warning := range warnings {
+		log.Printf("%s: %s", SidecarPath(pth), warning)
+	}
 	if err != nil {
-		log.Println("Failed to read yml for", v.Path)
+		// better hidden than leaked, e.g: a typo in a private video's yml
+		log.Printf("Failed to read yml for %s, treating it as private: %s", v.Path, err)
+		v.Visibility = Private
+	} else if sidecar != nil {
+		sidecar.apply(v)
 	}
+	SortChapters(v.Chapters)
 
 	// Add thumbnail from embedded tags (if exists)
 	pic := m.Picture()
@@ -121,3 +170,64 @@ func ParseVideo(p *Path, name string) (*Video, error) {
 
 	return v, nil
 }
+
+// RenditionPath returns the path of the rendition of the video file pth in
+// quality (a transcoder.sizes suffix, e.g: 720p) and format (e.g: vp9, in a
+// WebM), either empty for the source's, e.g: videos/foo#720p.vp9.webm.
+func RenditionPath(pth, quality, format string) string {
+	stem := strings.TrimSuffix(pth, filepath.Ext(pth))
+	switch {
+	case quality == "" && format == "":
+		return pth
+	case format == "":
+		return fmt.Sprintf("%s#%s.mp4", stem, quality)
+	case quality == "":
+		return fmt.Sprintf("%s#%s.webm", stem, format)
+	}
+	return fmt.Sprintf("%s#%s.%s.webm", stem, quality, format)
+}
+
+// Rendition is a file of a video in a lower quality and/or another format
+// (see RenditionPath).
+type Rendition struct {
+	Quality string // empty for the source's
+	Format  string // empty for the MP4
+	Path    string
+}
+
+// Renditions returns the renditions of the video file pth found next to it.
+func Renditions(pth string) ([]Rendition, error) {
+	dir := filepath.Dir(pth)
+	prefix := strings.TrimSuffix(filepath.Base(pth), filepath.Ext(pth)) + "#"
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var renditions []Rendition
+	for _, info := range files {
+		name := info.Name()
+		if info.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(name, prefix)
+		ext := filepath.Ext(rest)
+		r := Rendition{Path: filepath.Join(dir, name)}
+		switch ext {
+		case ".mp4":
+			r.Quality = strings.TrimSuffix(rest, ext)
+		case ".webm":
+			if quality, format, ok := strings.Cut(strings.TrimSuffix(rest, ext), "."); ok {
+				r.Quality, r.Format = quality, format
+			} else {
+				r.Format = quality
+			}
+		default:
+			continue
+		}
+		if r.Quality == "" && r.Format == "" {
+			continue
+		}
+		renditions = append(renditions, r)
+	}
+	return renditions, nil
+}
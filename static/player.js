@@ -0,0 +1,99 @@
+// Playback beacons used for view accounting. Views are only counted once
+// the player reports actual playback, not for every (range) request of the
+// video file. The player also reports its position so playback can resume
+// where the viewer left off.
+(() => {
+    const video = document.getElementById('video') || document.getElementById('audio')
+    if (!video || !video.dataset.beacon || !navigator.sendBeacon) return
+
+    const positionInterval = 5000 // milliseconds between position updates
+    let positionTimer = null
+
+    const sendPosition = () => {
+        if (!video.dataset.position) return
+        const data = new FormData()
+        data.append('t', video.currentTime.toFixed(1))
+        data.append('d', isFinite(video.duration) ? video.duration.toFixed(1) : '0')
+        navigator.sendBeacon(video.dataset.position, data)
+    }
+
+    const progressInterval = 10 // seconds of playback between progress beacons
+    let watched = 0
+    let reported = 0
+    let last = null
+
+    const send = (event) => {
+        const data = new FormData()
+        data.append('event', event)
+        data.append('watched', watched.toFixed(1))
+        data.append('duration', isFinite(video.duration) ? video.duration.toFixed(1) : '0')
+        data.append('quality', video.dataset.quality || '')
+        navigator.sendBeacon(video.dataset.beacon, data)
+    }
+
+    video.addEventListener('play', () => {
+        last = video.currentTime
+        send('play')
+        clearInterval(positionTimer)
+        positionTimer = setInterval(sendPosition, positionInterval)
+    })
+
+    video.addEventListener('timeupdate', () => {
+        if (video.paused || video.seeking || last === null) return
+        const delta = video.currentTime - last
+        last = video.currentTime
+        // large jumps are seeks, not playback
+        if (delta > 0 && delta < 2) watched += delta
+        if (watched - reported >= progressInterval) {
+            reported = watched
+            send('progress')
+        }
+    })
+
+    video.addEventListener('seeked', () => {
+        last = video.currentTime
+    })
+
+    video.addEventListener('pause', () => {
+        last = null
+        clearInterval(positionTimer)
+        sendPosition()
+        if (watched > reported) {
+            reported = watched
+            send('progress')
+        }
+    })
+
+    video.addEventListener('ended', () => {
+        sendPosition()
+        send('ended')
+    })
+
+    window.addEventListener('pagehide', () => {
+        if (!video.paused) sendPosition()
+    })
+})()
+
+// Chapter links seek the player rather than reloading the page (they work
+// without JavaScript too) and the current chapter is highlighted.
+(() => {
+    const video = document.getElementById('video') || document.getElementById('audio')
+    const links = Array.from(document.querySelectorAll('.chapters a[data-start]'))
+    if (!video || !links.length) return
+
+    links.forEach((link) => {
+        link.addEventListener('click', (e) => {
+            e.preventDefault()
+            video.currentTime = parseFloat(link.dataset.start)
+            video.play()
+        })
+    })
+
+    video.addEventListener('timeupdate', () => {
+        let current = null
+        links.forEach((link) => {
+            if (parseFloat(link.dataset.start) <= video.currentTime) current = link
+        })
+        links.forEach((link) => link.classList.toggle('current', link === current))
+    })
+})()
@@ -0,0 +1,121 @@
+package transcoder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Call is a call of a Fake transcoder.
+type Call struct {
+	Method string // Probe, Transcode, Resize, Thumbnail or Waveform
+	Src    string
+	Dst    string // empty for Probe
+	Size   string // Resize only
+	Opts   Options
+}
+
+// Fake is an in-memory Transcoder for tests which doesn't need ffmpeg: it
+// copies the source file to the destination (writes a placeholder for
+// thumbnails and waveforms), returns ProbeResult from Probe and records its
+// calls.
+type Fake struct {
+	// ProbeResult is returned by Probe, nil fails probing (as for files
+	// ffprobe doesn't recognise).
+	ProbeResult *ProbeResult
+
+	// Err, if set, is returned by every call (after recording it).
+	Err error
+
+	// Hook, if set, is called with every call after recording it, an error
+	// fails the call. E.g: to block transcodes until ctx is cancelled.
+	Hook func(ctx context.Context, c Call) error
+
+	mu    sync.Mutex
+	calls []Call
+}
+
+var _ Transcoder = (*Fake)(nil)
+
+// Calls returns the calls made so far in order.
+func (f *Fake) Calls() []Call {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Call(nil), f.calls...)
+}
+
+// record records the call c and returns the error to fail it with, if any.
+func (f *Fake) record(ctx context.Context, c Call) error {
+	f.mu.Lock()
+	f.calls = append(f.calls, c)
+	f.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if f.Hook != nil {
+		if err := f.Hook(ctx, c); err != nil {
+			return err
+		}
+	}
+	return f.Err
+}
+
+// Probe returns ProbeResult.
+func (f *Fake) Probe(ctx context.Context, src string, timeout int) (*ProbeResult, error) {
+	if err := f.record(ctx, Call{Method: "Probe", Src: src}); err != nil {
+		return nil, err
+	}
+	if f.ProbeResult == nil {
+		return nil, fmt.Errorf("error probing %s: no probe result", src)
+	}
+	result := *f.ProbeResult
+	return &result, nil
+}
+
+// Transcode copies src to dst.
+func (f *Fake) Transcode(ctx context.Context, src, dst string, opts Options) error {
+	if err := f.record(ctx, Call{Method: "Transcode", Src: src, Dst: dst, Opts: opts}); err != nil {
+		return err
+	}
+	return copyFile(src, dst)
+}
+
+// Resize copies src to dst.
+func (f *Fake) Resize(ctx context.Context, src, dst, size string, opts Options) error {
+	if err := f.record(ctx, Call{Method: "Resize", Src: src, Dst: dst, Size: size, Opts: opts}); err != nil {
+		return err
+	}
+	return copyFile(src, dst)
+}
+
+// Thumbnail writes a placeholder thumbnail to dst.
+func (f *Fake) Thumbnail(ctx context.Context, src, dst string, position, timeout int) error {
+	if err := f.record(ctx, Call{Method: "Thumbnail", Src: src, Dst: dst}); err != nil {
+		return err
+	}
+	if _, err := os.Stat(src); err != nil {
+		return err
+	}
+	return os.WriteFile(dst, []byte("fake thumbnail"), 0o644)
+}
+
+// Waveform writes a placeholder image to dst.
+func (f *Fake) Waveform(ctx context.Context, src, dst string, timeout int) error {
+	if err := f.record(ctx, Call{Method: "Waveform", Src: src, Dst: dst}); err != nil {
+		return err
+	}
+	if _, err := os.Stat(src); err != nil {
+		return err
+	}
+	return os.WriteFile(dst, []byte("fake waveform"), 0o644)
+}
+
+// copyFile copies the file src to dst.
+func copyFile(src, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, data, 0o644)
+}
@@ -0,0 +1,83 @@
+package transcoder
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// formatNameRegexp matches valid format names.
+var formatNameRegexp = regexp.MustCompile(`^[a-z0-9]+$`)
+
+// webmCodecs are the codecs strings (RFC 6381) of the codecs WebM supports.
+var webmCodecs = map[string]string{
+	"vp8":    "vp8",
+	"vp9":    "vp9",
+	"av1":    "av01.0.08M.08", // main profile, level 4.0, 8 bit
+	"opus":   "opus",
+	"vorbis": "vorbis",
+}
+
+// Format is an additional rendition of a profile's videos (and their sizes)
+// in another codec, in a WebM container, e.g: VP9 or AV1 for browsers that
+// support them.
+type Format struct {
+	Name         string   `json:"name"`          // e.g: vp9, used in file names and the format parameter
+	VideoCodec   string   `json:"video_codec"`   // e.g: libvpx-vp9 or libsvtav1
+	CRF          *int     `json:"crf"`           // constant quality (0 is lossless), null to use video_bitrate
+	VideoBitrate string   `json:"video_bitrate"` // e.g: 1500k
+	Preset       string   `json:"preset"`        // e.g: 8 (libsvtav1)
+	AudioCodec   string   `json:"audio_codec"`   // e.g: libopus (the default)
+	AudioBitrate string   `json:"audio_bitrate"` // e.g: 96k
+	ExtraArgs    []string `json:"extra_args"`    // e.g: ["-row-mt", "1"]
+}
+
+// Validate returns the problems with the format's settings, if any.
+func (f *Format) Validate() []string {
+	var problems []string
+	if !formatNameRegexp.MatchString(f.Name) {
+		problems = append(problems, fmt.Sprintf("invalid name %q, expected lower case letters or digits (e.g: vp9)", f.Name))
+	}
+	if f.VideoCodec == "" {
+		problems = append(problems, "video_codec is required")
+	} else if name := codecName(f.VideoCodec); name == "vorbis" || name == "opus" || webmCodecs[name] == "" {
+		problems = append(problems, fmt.Sprintf("video_codec %s is not supported in WebM, expected e.g: libvpx-vp9 or libsvtav1", f.VideoCodec))
+	}
+	if name := codecName(f.audioCodec()); name != "opus" && name != "vorbis" {
+		problems = append(problems, fmt.Sprintf("audio_codec %s is not supported in WebM, expected libopus or libvorbis", f.AudioCodec))
+	}
+	return append(problems, f.Profile(&Profile{}).Validate()...)
+}
+
+// audioCodec returns the format's audio encoder.
+func (f *Format) audioCodec() string {
+	if f.AudioCodec == "" {
+		return "libopus"
+	}
+	return f.AudioCodec
+}
+
+// MIMEType returns the MIME type of the format's files including the codecs,
+// e.g: video/webm; codecs="vp9, opus".
+func (f *Format) MIMEType() string {
+	return fmt.Sprintf(
+		"video/webm; codecs=\"%s, %s\"",
+		webmCodecs[codecName(f.VideoCodec)],
+		webmCodecs[codecName(f.audioCodec())],
+	)
+}
+
+// Profile returns the encoding settings of the format as a rendition of the
+// videos of the profile p, keeping its maximum resolution and pixel format.
+func (f *Format) Profile(p *Profile) *Profile {
+	return &Profile{
+		VideoCodec:    f.VideoCodec,
+		CRF:           f.CRF,
+		VideoBitrate:  f.VideoBitrate,
+		Preset:        f.Preset,
+		AudioCodec:    f.audioCodec(),
+		AudioBitrate:  f.AudioBitrate,
+		MaxResolution: p.MaxResolution,
+		PixelFormat:   p.PixelFormat,
+		ExtraArgs:     f.ExtraArgs,
+	}
+}
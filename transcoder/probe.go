@@ -0,0 +1,241 @@
+package transcoder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"git.mills.io/prologic/tube/utils"
+)
+
+// Stream is a video or audio stream of a media file.
+type Stream struct {
+	CodecName   string `json:"codec_name"`   // e.g: h264, aac
+	PixelFormat string `json:"pixel_format"` // e.g: yuv420p (video only)
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+}
+
+// ProbeResult describes a media file as reported by ffprobe.
+type ProbeResult struct {
+	Format   string    `json:"format"`    // e.g: mov,mp4,m4a,3gp,3g2,mj2
+	Duration float64   `json:"duration"`  // in seconds
+	Video    *Stream   `json:"video"`     // the first video stream, nil if there is none
+	Audio    *Stream   `json:"audio"`     // the first audio stream, nil if there is none
+	CoverArt bool      `json:"cover_art"` // whether there is an attached picture
+	Chapters []Chapter `json:"chapters"`
+}
+
+// Chapter is a chapter marker of the container.
+type Chapter struct {
+	Start float64 `json:"start"` // in seconds
+	End   float64 `json:"end"`   // in seconds
+	Title string  `json:"title"`
+}
+
+// Probe runs ffprobe on the media file src.
+func (FFmpeg) Probe(ctx context.Context, src string, timeout int) (*ProbeResult, error) {
+	out, err := utils.CmdOutputContext(
+		ctx,
+		timeout,
+		"ffprobe",
+		"-v", "quiet",
+		"-print_format", "json",
+		"-show_format",
+		"-show_streams",
+		"-show_chapters",
+		src,
+	)
+	if err != nil {
+		err := fmt.Errorf("error probing %s: %w", src, err)
+		return nil, err
+	}
+
+	var info struct {
+		Format struct {
+			FormatName string `json:"format_name"`
+			Duration   string `json:"duration"`
+		} `json:"format"`
+		Streams []struct {
+			CodecType   string `json:"codec_type"`
+			CodecName   string `json:"codec_name"`
+			PixelFormat string `json:"pix_fmt"`
+			Width       int    `json:"width"`
+			Height      int    `json:"height"`
+			Disposition struct {
+				AttachedPic int `json:"attached_pic"`
+			} `json:"disposition"`
+		} `json:"streams"`
+		Chapters []struct {
+			StartTime string `json:"start_time"`
+			EndTime   string `json:"end_time"`
+			Tags      struct {
+				Title string `json:"title"`
+			} `json:"tags"`
+		} `json:"chapters"`
+	}
+	if err := json.Unmarshal(out, &info); err != nil {
+		err := fmt.Errorf("error parsing ffprobe output for %s: %w", src, err)
+		return nil, err
+	}
+
+	result := &ProbeResult{Format: info.Format.FormatName}
+	result.Duration, _ = strconv.ParseFloat(info.Format.Duration, 64)
+	for _, s := range info.Streams {
+		stream := &Stream{
+			CodecName:   s.CodecName,
+			PixelFormat: s.PixelFormat,
+			Width:       s.Width,
+			Height:      s.Height,
+		}
+		switch {
+		// cover art is reported as a video stream
+		case s.CodecType == "video" && s.Disposition.AttachedPic != 0:
+			result.CoverArt = true
+		case s.CodecType == "video" && result.Video == nil:
+			result.Video = stream
+		case s.CodecType == "audio" && result.Audio == nil:
+			result.Audio = stream
+		}
+	}
+	for i, c := range info.Chapters {
+		chapter := Chapter{Title: c.Tags.Title}
+		chapter.Start, _ = strconv.ParseFloat(c.StartTime, 64)
+		chapter.End, _ = strconv.ParseFloat(c.EndTime, 64)
+		if chapter.Title == "" {
+			chapter.Title = fmt.Sprintf("Chapter %d", i+1)
+		}
+		result.Chapters = append(result.Chapters, chapter)
+	}
+	return result, nil
+}
+
+// Strategy is how a video is brought into a profile's format.
+type Strategy string
+
+const (
+	// Remux copies the streams into a new container.
+	Remux Strategy = "remux"
+	// TranscodeAudio copies the video stream and encodes the audio.
+	TranscodeAudio Strategy = "transcode_audio"
+	// TranscodeFull encodes both the video and the audio.
+	TranscodeFull Strategy = "transcode"
+	// CopyAudio copies the audio stream (and cover art) of an audio-only
+	// file into a new file of the same format.
+	CopyAudio Strategy = "copy_audio"
+	// EncodeAudio encodes the audio stream of an audio-only file into an
+	// M4A with the profile's audio settings.
+	EncodeAudio Strategy = "encode_audio"
+)
+
+// audioFormats maps the formats (as reported by ffprobe) of audio-only files
+// browsers play to their file extension.
+var audioFormats = map[string]string{
+	"mp3":                     ".mp3",
+	"ogg":                     ".ogg",
+	"flac":                    ".flac",
+	"mov,mp4,m4a,3gp,3g2,mj2": ".m4a",
+}
+
+// IsAudio returns whether the probed file is audio-only (cover art aside).
+func (r *ProbeResult) IsAudio() bool {
+	return r != nil && r.Video == nil && r.Audio != nil
+}
+
+// Ext returns the file extension of the output of strategy s for the probed
+// file, e.g: .mp4 for videos or .mp3 for MP3s copied with CopyAudio.
+func (r *ProbeResult) Ext(s Strategy) string {
+	switch s {
+	case CopyAudio:
+		return audioFormats[r.Format]
+	case EncodeAudio:
+		return ".m4a"
+	}
+	return ".mp4"
+}
+
+// codecNames maps ffmpeg encoders to the codec names reported by ffprobe.
+var codecNames = map[string]string{
+	"libx264":    "h264",
+	"h264_nvenc": "h264",
+	"h264_qsv":   "h264",
+	"h264_vaapi": "h264",
+	"libx265":    "hevc",
+	"hevc_nvenc": "hevc",
+	"libvpx":     "vp8",
+	"libvpx-vp9": "vp9",
+	"libaom-av1": "av1",
+	"libsvtav1":  "av1",
+	"librav1e":   "av1",
+	"libfdk_aac": "aac",
+	"libopus":    "opus",
+	"libvorbis":  "vorbis",
+	"libmp3lame": "mp3",
+}
+
+// codecName returns the codec name of the ffmpeg encoder.
+func codecName(encoder string) string {
+	if name, ok := codecNames[encoder]; ok {
+		return name
+	}
+	return encoder
+}
+
+// Plan returns how to bring the probed video into the profile's format and
+// why: streams already in the profile's codecs (and pixel format and within
+// its maximum resolution) are copied rather than encoded again.
+//
+// Audio-only files are kept as they are if browsers play their format and
+// encoded into M4A otherwise.
+func (p *Profile) Plan(probe *ProbeResult) (Strategy, string) {
+	if probe.IsAudio() {
+		if _, ok := audioFormats[probe.Format]; !ok {
+			return EncodeAudio, fmt.Sprintf("audio-only %s is not played by browsers", probe.Format)
+		}
+		if p.AlwaysTranscode {
+			return EncodeAudio, "profile sets always_transcode"
+		}
+		return CopyAudio, fmt.Sprintf("audio-only %s/%s", probe.Format, probe.Audio.CodecName)
+	}
+	if p.AlwaysTranscode {
+		return TranscodeFull, "profile sets always_transcode"
+	}
+	if probe == nil {
+		return TranscodeFull, "video could not be probed"
+	}
+	if probe.Video == nil {
+		return TranscodeFull, "no video stream found"
+	}
+
+	videoCodec, audioCodec := p.VideoCodec, p.AudioCodec
+	if videoCodec == "" {
+		videoCodec = "libx264"
+	}
+	if audioCodec == "" {
+		audioCodec = "aac"
+	}
+
+	v := probe.Video
+	if v.CodecName != codecName(videoCodec) {
+		return TranscodeFull, fmt.Sprintf("video codec is %s, not %s", v.CodecName, codecName(videoCodec))
+	}
+	if p.PixelFormat != "" && v.PixelFormat != p.PixelFormat {
+		return TranscodeFull, fmt.Sprintf("pixel format is %s, not %s", v.PixelFormat, p.PixelFormat)
+	}
+	if m := resolutionRegexp.FindStringSubmatch(p.MaxResolution); m != nil {
+		width, _ := strconv.Atoi(m[1])
+		height, _ := strconv.Atoi(m[2])
+		if v.Width > width || v.Height > height {
+			return TranscodeFull, fmt.Sprintf("resolution %dx%d exceeds %s", v.Width, v.Height, p.MaxResolution)
+		}
+	}
+
+	if a := probe.Audio; a != nil && a.CodecName != codecName(audioCodec) {
+		return TranscodeAudio, fmt.Sprintf("video is %s, audio codec is %s, not %s", v.CodecName, a.CodecName, codecName(audioCodec))
+	}
+	if probe.Audio == nil {
+		return Remux, fmt.Sprintf("video is already %s, no audio", v.CodecName)
+	}
+	return Remux, fmt.Sprintf("streams are already %s/%s", v.CodecName, probe.Audio.CodecName)
+}
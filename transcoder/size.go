@@ -0,0 +1,71 @@
+package transcoder
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// ffmpegSizes are the dimensions of the abbreviations ffmpeg accepts for its
+// -s option.
+var ffmpegSizes = map[string][2]int{
+	"ntsc": {720, 480}, "pal": {720, 576}, "qntsc": {352, 240}, "qpal": {352, 288},
+	"sntsc": {640, 480}, "spal": {768, 576}, "film": {352, 240}, "ntsc-film": {352, 240},
+	"sqcif": {128, 96}, "qcif": {176, 144}, "cif": {352, 288}, "4cif": {704, 576},
+	"16cif": {1408, 1152}, "qqvga": {160, 120}, "qvga": {320, 240}, "vga": {640, 480},
+	"svga": {800, 600}, "xga": {1024, 768}, "uxga": {1600, 1200}, "qxga": {2048, 1536},
+	"sxga": {1280, 1024}, "qsxga": {2560, 2048}, "hsxga": {5120, 4096}, "wvga": {852, 480},
+	"wxga": {1366, 768}, "wsxga": {1600, 1024}, "wuxga": {1920, 1200}, "woxga": {2560, 1600},
+	"wqsxga": {3200, 2048}, "wquxga": {3840, 2400}, "whsxga": {6400, 4096}, "whuxga": {7680, 4800},
+	"cga": {320, 200}, "ega": {640, 350}, "hd480": {852, 480}, "hd720": {1280, 720},
+	"hd1080": {1920, 1080}, "2k": {2048, 1080}, "2kflat": {1998, 1080}, "2kscope": {2048, 858},
+	"4k": {4096, 2160}, "4kflat": {3996, 2160}, "4kscope": {4096, 1716}, "nhd": {640, 360},
+	"hqvga": {240, 160}, "wqvga": {400, 240}, "fwqvga": {432, 240}, "hvga": {480, 320},
+	"qhd": {960, 540}, "2kdci": {2048, 1080}, "4kdci": {4096, 2160}, "uhd2160": {3840, 2160},
+	"uhd4320": {7680, 4320},
+}
+
+// ParseSize returns the dimensions of size, either WIDTHxHEIGHT (e.g:
+// 1280x720) or an ffmpeg abbreviation (e.g: hd720).
+func ParseSize(size string) (width, height int, ok bool) {
+	if dims, ok := ffmpegSizes[size]; ok {
+		return dims[0], dims[1], true
+	}
+	m := resolutionRegexp.FindStringSubmatch(size)
+	if m == nil {
+		return 0, 0, false
+	}
+	width, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0, 0, false
+	}
+	height, err = strconv.Atoi(m[2])
+	if err != nil {
+		return 0, 0, false
+	}
+	return width, height, true
+}
+
+// Fits returns whether a video of width x height already fits within size
+// (turned for portrait videos), so resizing it to size would upscale it or
+// leave it as is.
+func Fits(size string, width, height int) bool {
+	w, h, ok := ParseSize(size)
+	if !ok {
+		return false
+	}
+	if height > width {
+		w, h = h, w
+	}
+	return width <= w && height <= h
+}
+
+// sizeFilter returns an ffmpeg filter downscaling to fit size keeping the
+// aspect ratio, turning the size for portrait videos.
+func sizeFilter(size string) string {
+	w, h, _ := ParseSize(size)
+	factor := fmt.Sprintf(
+		"if(gte(iw,ih),min(1,min(%d/iw,%d/ih)),min(1,min(%d/iw,%d/ih)))",
+		w, h, h, w,
+	)
+	return fmt.Sprintf("scale=w='trunc(%s*iw/2)*2':h='trunc(%s*ih/2)*2'", factor, factor)
+}
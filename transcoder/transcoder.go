@@ -0,0 +1,299 @@
+// Package transcoder encodes videos and generates thumbnails according to
+// configurable encoding profiles, with ffmpeg (FFmpeg) or another Transcoder.
+package transcoder
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"git.mills.io/prologic/tube/utils"
+)
+
+// DefaultProfileName is the name of the profile used by collections which
+// don't set one.
+const DefaultProfileName = "default"
+
+var (
+	resolutionRegexp = regexp.MustCompile(`^([1-9][0-9]*)x([1-9][0-9]*)$`)
+	bitrateRegexp    = regexp.MustCompile(`^[1-9][0-9]*[kKmM]?$`)
+)
+
+// Transcoder is a backend probing, encoding and thumbnailing media files.
+type Transcoder interface {
+	// Probe describes the media file src.
+	Probe(ctx context.Context, src string, timeout int) (*ProbeResult, error)
+
+	// Transcode brings the video src into the format of opts.Profile as dst.
+	Transcode(ctx context.Context, src, dst string, opts Options) error
+
+	// Resize encodes the video src as dst fitting into size (e.g: hd720 or
+	// 1280x720) keeping the aspect ratio.
+	Resize(ctx context.Context, src, dst, size string, opts Options) error
+
+	// Thumbnail generates a thumbnail dst from a representative frame of the
+	// first position seconds of the video src.
+	Thumbnail(ctx context.Context, src, dst string, position, timeout int) error
+
+	// Waveform generates an image dst of the waveform of the audio src.
+	Waveform(ctx context.Context, src, dst string, timeout int) error
+}
+
+// FFmpeg is the Transcoder running the ffmpeg and ffprobe commands.
+type FFmpeg struct{}
+
+var _ Transcoder = FFmpeg{}
+
+// Profile is a named set of encoding settings. Empty settings are left to
+// ffmpeg's defaults except for the codecs.
+type Profile struct {
+	VideoCodec    string   `json:"video_codec"`    // e.g: libx264 (the default)
+	CRF           *int     `json:"crf"`            // constant quality (0 is lossless), null to use video_bitrate
+	VideoBitrate  string   `json:"video_bitrate"`  // e.g: 2500k
+	Preset        string   `json:"preset"`         // e.g: medium
+	AudioCodec    string   `json:"audio_codec"`    // e.g: aac (the default)
+	AudioBitrate  string   `json:"audio_bitrate"`  // e.g: 128k
+	MaxResolution string   `json:"max_resolution"` // e.g: 1920x1080, downscaled keeping the aspect ratio
+	PixelFormat   string   `json:"pixel_format"`   // e.g: yuv420p
+	ExtraArgs     []string `json:"extra_args"`     // added before the output file
+
+	// AlwaysTranscode encodes every video, even if its streams could be
+	// copied (see Plan).
+	AlwaysTranscode bool `json:"always_transcode"`
+
+	// Formats are additional renditions in other codecs, in order of
+	// preference.
+	Formats []*Format `json:"formats"`
+}
+
+// DefaultProfile returns the built-in profile (H.264 and AAC in MP4).
+func DefaultProfile() *Profile {
+	crf := 23
+	return &Profile{
+		VideoCodec:  "libx264",
+		CRF:         &crf,
+		AudioCodec:  "aac",
+		PixelFormat: "yuv420p",
+		ExtraArgs:   []string{"-movflags", "+faststart"},
+	}
+}
+
+// Validate returns the problems with the profile's settings, if any.
+func (p *Profile) Validate() []string {
+	var problems []string
+	if p.CRF != nil {
+		if max := maxCRF(p.VideoCodec); *p.CRF < 0 || *p.CRF > max {
+			problems = append(problems, fmt.Sprintf("crf must be between 0 and %d, got %d", max, *p.CRF))
+		}
+	}
+	if p.CRF != nil && p.VideoBitrate != "" {
+		problems = append(problems, "crf and video_bitrate are mutually exclusive")
+	}
+	if p.VideoBitrate != "" && !bitrateRegexp.MatchString(p.VideoBitrate) {
+		problems = append(problems, fmt.Sprintf("invalid video_bitrate %q, expected e.g: 2500k or 2M", p.VideoBitrate))
+	}
+	if p.AudioBitrate != "" && !bitrateRegexp.MatchString(p.AudioBitrate) {
+		problems = append(problems, fmt.Sprintf("invalid audio_bitrate %q, expected e.g: 128k", p.AudioBitrate))
+	}
+	if p.MaxResolution != "" && !resolutionRegexp.MatchString(p.MaxResolution) {
+		problems = append(problems, fmt.Sprintf("invalid max_resolution %q, expected WIDTHxHEIGHT (e.g: 1920x1080)", p.MaxResolution))
+	}
+	names := make(map[string]bool)
+	for i, f := range p.Formats {
+		if f == nil {
+			problems = append(problems, fmt.Sprintf("formats[%d] is required", i))
+			continue
+		}
+		for _, problem := range f.Validate() {
+			problems = append(problems, fmt.Sprintf("formats[%d]: %s", i, problem))
+		}
+		if names[f.Name] {
+			problems = append(problems, fmt.Sprintf("formats[%d]: duplicate name %q", i, f.Name))
+		}
+		names[f.Name] = true
+	}
+	return problems
+}
+
+// maxCRF returns the highest (worst quality) crf of the video encoder codec.
+func maxCRF(codec string) int {
+	switch codec {
+	case "", "libx264", "libx264rgb", "libx265":
+		return 51
+	}
+	// e.g: libvpx-vp9, libaom-av1 and libsvtav1
+	return 63
+}
+
+// Args returns the ffmpeg output options encoding with the profile.
+func (p *Profile) Args() []string {
+	return p.encodeArgs()
+}
+
+// encodeArgs returns the ffmpeg output options encoding with the profile,
+// applying the video filters filters after its own.
+func (p *Profile) encodeArgs(filters ...string) []string {
+	return append(append(p.videoArgs(filters...), p.audioArgs()...), p.ExtraArgs...)
+}
+
+// StrategyArgs returns the ffmpeg output options bringing a video into the
+// profile's format with strategy s. Copied streams are put into an MP4 with
+// the index at the start (for progressive playback), the profile's extra_args
+// are only used when encoding the video.
+func (p *Profile) StrategyArgs(s Strategy) []string {
+	switch s {
+	case Remux:
+		return []string{"-map", "0:v:0", "-map", "0:a:0?", "-c", "copy", "-movflags", "+faststart"}
+	case TranscodeAudio:
+		args := []string{"-map", "0:v:0", "-map", "0:a:0?", "-c:v", "copy"}
+		args = append(args, p.audioArgs()...)
+		return append(args, "-movflags", "+faststart")
+	case CopyAudio:
+		return []string{"-map", "0:a:0", "-map", "0:v?", "-c", "copy"}
+	case EncodeAudio:
+		args := append([]string{"-map", "0:a:0", "-vn"}, p.audioArgs()...)
+		return append(args, "-movflags", "+faststart")
+	}
+	return p.Args()
+}
+
+// videoArgs returns the ffmpeg video encoding options of the profile
+// including the video filters filters.
+func (p *Profile) videoArgs(filters ...string) []string {
+	videoCodec := p.VideoCodec
+	if videoCodec == "" {
+		videoCodec = "libx264"
+	}
+
+	args := []string{"-c:v", videoCodec}
+	if p.CRF != nil {
+		args = append(args, "-crf", fmt.Sprint(*p.CRF))
+		switch videoCodec {
+		case "libvpx-vp9", "libaom-av1":
+			// constant quality rather than constrained by the default bitrate
+			args = append(args, "-b:v", "0")
+		}
+	} else if p.VideoBitrate != "" {
+		args = append(args, "-b:v", p.VideoBitrate)
+	}
+	if p.Preset != "" {
+		args = append(args, "-preset", p.Preset)
+	}
+	if p.PixelFormat != "" {
+		args = append(args, "-pix_fmt", p.PixelFormat)
+	}
+	if m := resolutionRegexp.FindStringSubmatch(p.MaxResolution); m != nil {
+		filters = append([]string{scaleFilter(m[1], m[2])}, filters...)
+	}
+	if len(filters) > 0 {
+		args = append(args, "-vf", strings.Join(filters, ","))
+	}
+	return args
+}
+
+// audioArgs returns the ffmpeg audio encoding options of the profile.
+func (p *Profile) audioArgs() []string {
+	audioCodec := p.AudioCodec
+	if audioCodec == "" {
+		audioCodec = "aac"
+	}
+
+	args := []string{"-c:a", audioCodec}
+	if p.AudioBitrate != "" {
+		args = append(args, "-b:a", p.AudioBitrate)
+	}
+	return args
+}
+
+// scaleFilter returns an ffmpeg filter downscaling to fit width x height
+// keeping the aspect ratio (and even dimensions), never upscaling.
+func scaleFilter(width, height string) string {
+	factor := fmt.Sprintf("min(1,min(%s/iw,%s/ih))", width, height)
+	return fmt.Sprintf("scale=w='trunc(%s*iw/2)*2':h='trunc(%s*ih/2)*2'", factor, factor)
+}
+
+// Options are the settings of a single transcode.
+type Options struct {
+	Profile  *Profile          `json:"profile"`  // nil uses DefaultProfile
+	Strategy Strategy          `json:"strategy"` // empty encodes with the profile (TranscodeFull)
+	Metadata map[string]string `json:"metadata"` // e.g: title, comment
+	Timeout  int               `json:"timeout"`  // in seconds
+}
+
+// profile returns the profile of the options.
+func (o Options) profile() *Profile {
+	if o.Profile == nil {
+		return DefaultProfile()
+	}
+	return o.Profile
+}
+
+// Transcode encodes the video src into dst.
+func (FFmpeg) Transcode(ctx context.Context, src, dst string, opts Options) error {
+	return runFFmpeg(ctx, src, dst, opts.profile().StrategyArgs(opts.Strategy), opts)
+}
+
+// Resize encodes the video src into dst fitting into size.
+func (FFmpeg) Resize(ctx context.Context, src, dst, size string, opts Options) error {
+	// resized renditions are always encoded
+	return runFFmpeg(ctx, src, dst, opts.profile().encodeArgs(sizeFilter(size)), opts)
+}
+
+// runFFmpeg runs ffmpeg encoding src into dst with the output options
+// outputArgs and the metadata and timeout of opts.
+func runFFmpeg(ctx context.Context, src, dst string, outputArgs []string, opts Options) error {
+	args := []string{"-y", "-i", src}
+	args = append(args, outputArgs...)
+
+	keys := make([]string, 0, len(opts.Metadata))
+	for k := range opts.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args = append(args, "-metadata", fmt.Sprintf("%s=%s", k, opts.Metadata[k]))
+	}
+
+	args = append(args, "-strict", "-2", "-loglevel", "quiet", dst)
+	if err := utils.RunCmdContext(ctx, opts.Timeout, "ffmpeg", args...); err != nil {
+		err := fmt.Errorf("error running ffmpeg %s: %w", strings.Join(outputArgs, " "), err)
+		return err
+	}
+	return nil
+}
+
+// Thumbnail generates a thumbnail dst from a representative frame of the
+// first position seconds of the video src.
+func (FFmpeg) Thumbnail(ctx context.Context, src, dst string, position, timeout int) error {
+	return utils.RunCmdContext(
+		ctx,
+		timeout,
+		"ffmpeg",
+		"-i", src,
+		"-y",
+		"-vf", "thumbnail",
+		"-t", fmt.Sprint(position),
+		"-vframes", "1",
+		"-strict", "-2",
+		"-loglevel", "quiet",
+		dst,
+	)
+}
+
+// Waveform generates an image dst of the waveform of the audio src.
+func (FFmpeg) Waveform(ctx context.Context, src, dst string, timeout int) error {
+	return utils.RunCmdContext(
+		ctx,
+		timeout,
+		"ffmpeg",
+		"-i", src,
+		"-y",
+		"-filter_complex", "showwavespic=s=1280x720:colors=0x3ea6ff",
+		"-frames:v", "1",
+		"-strict", "-2",
+		"-loglevel", "quiet",
+		dst,
+	)
+}
@@ -0,0 +1,113 @@
+package transcoder
+
+import (
+	"strings"
+	"testing"
+)
+
+func intPtr(n int) *int { return &n }
+
+func TestProfileCRF(t *testing.T) {
+	tests := []struct {
+		name     string
+		profile  Profile
+		problems int
+		args     string // expected in Args, if valid
+	}{
+		{"lossless", Profile{CRF: intPtr(0)}, 0, "-c:v libx264 -crf 0"},
+		{"bitrate", Profile{VideoBitrate: "2M"}, 0, "-c:v libx264 -b:v 2M"},
+		{"both", Profile{CRF: intPtr(23), VideoBitrate: "2M"}, 1, ""},
+		{"x264 max", Profile{VideoCodec: "libx264", CRF: intPtr(51)}, 0, "-c:v libx264 -crf 51"},
+		{"x264 too high", Profile{VideoCodec: "libx264", CRF: intPtr(52)}, 1, ""},
+		{"x265 too high", Profile{VideoCodec: "libx265", CRF: intPtr(63)}, 1, ""},
+		{"vp9", Profile{VideoCodec: "libvpx-vp9", CRF: intPtr(63)}, 0, "-c:v libvpx-vp9 -crf 63 -b:v 0"},
+		{"negative", Profile{CRF: intPtr(-1)}, 1, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			problems := test.profile.Validate()
+			if len(problems) != test.problems {
+				t.Fatalf("expected %d problems, got %q", test.problems, problems)
+			}
+			if test.args == "" {
+				return
+			}
+			if args := strings.Join(test.profile.Args(), " "); !strings.HasPrefix(args, test.args) {
+				t.Errorf("expected args starting with %q, got %q", test.args, args)
+			}
+		})
+	}
+}
+
+func TestProfilePlan(t *testing.T) {
+	mp4 := "mov,mp4,m4a,3gp,3g2,mj2"
+	h264 := &Stream{CodecName: "h264", PixelFormat: "yuv420p", Width: 1920, Height: 1080}
+	tests := []struct {
+		name     string
+		profile  *Profile
+		probe    *ProbeResult
+		strategy Strategy
+	}{
+		{"h264/aac mp4", DefaultProfile(), &ProbeResult{Format: mp4, Video: h264, Audio: &Stream{CodecName: "aac"}}, Remux},
+		{"no audio", DefaultProfile(), &ProbeResult{Format: mp4, Video: h264}, Remux},
+		{"h264/opus", DefaultProfile(), &ProbeResult{Format: "matroska,webm", Video: h264, Audio: &Stream{CodecName: "opus"}}, TranscodeAudio},
+		{"hevc", DefaultProfile(), &ProbeResult{Format: mp4, Video: &Stream{CodecName: "hevc", PixelFormat: "yuv420p"}, Audio: &Stream{CodecName: "aac"}}, TranscodeFull},
+		{"10-bit", DefaultProfile(), &ProbeResult{Format: mp4, Video: &Stream{CodecName: "h264", PixelFormat: "yuv420p10le"}}, TranscodeFull},
+		{"over max_resolution", &Profile{MaxResolution: "1280x720"}, &ProbeResult{Format: mp4, Video: h264, Audio: &Stream{CodecName: "aac"}}, TranscodeFull},
+		{"within max_resolution", &Profile{MaxResolution: "1920x1080"}, &ProbeResult{Format: mp4, Video: h264, Audio: &Stream{CodecName: "aac"}}, Remux},
+		{"always_transcode", &Profile{AlwaysTranscode: true}, &ProbeResult{Format: mp4, Video: h264, Audio: &Stream{CodecName: "aac"}}, TranscodeFull},
+		{"nil probe", DefaultProfile(), nil, TranscodeFull},
+		{"no streams", DefaultProfile(), &ProbeResult{Format: mp4}, TranscodeFull},
+		{"vp9 profile", &Profile{VideoCodec: "libvpx-vp9", AudioCodec: "libopus"}, &ProbeResult{Format: "matroska,webm", Video: &Stream{CodecName: "vp9"}, Audio: &Stream{CodecName: "opus"}}, Remux},
+		{"audio-only mp3", DefaultProfile(), &ProbeResult{Format: "mp3", Audio: &Stream{CodecName: "mp3"}}, CopyAudio},
+		{"audio-only always_transcode", &Profile{AlwaysTranscode: true}, &ProbeResult{Format: "mp3", Audio: &Stream{CodecName: "mp3"}}, EncodeAudio},
+		{"audio-only wma", DefaultProfile(), &ProbeResult{Format: "asf", Audio: &Stream{CodecName: "wmav2"}}, EncodeAudio},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			strategy, reason := test.profile.Plan(test.probe)
+			if strategy != test.strategy {
+				t.Errorf("expected %s, got %s (%s)", test.strategy, strategy, reason)
+			}
+			if reason == "" {
+				t.Error("expected a reason")
+			}
+		})
+	}
+}
+
+func TestFits(t *testing.T) {
+	tests := []struct {
+		size          string
+		width, height int
+		fits          bool
+	}{
+		{"hd720", 1280, 720, true},
+		{"hd720", 640, 360, true},
+		{"hd720", 1920, 1080, false},
+		{"hd720", 1280, 1280, false},
+		{"1280x720", 1281, 720, false},
+		{"hd720", 720, 1280, true},   // portrait
+		{"hd720", 1080, 1920, false}, // portrait
+		{"hd720", 405, 720, true},    // portrait
+		{"invalid", 1, 1, false},
+	}
+	for _, test := range tests {
+		if fits := Fits(test.size, test.width, test.height); fits != test.fits {
+			t.Errorf("Fits(%q, %d, %d) = %t, expected %t", test.size, test.width, test.height, fits, test.fits)
+		}
+	}
+}
+
+func TestSizeFilter(t *testing.T) {
+	for _, size := range []string{"hd720", "1280x720"} {
+		filter := sizeFilter(size)
+		if !strings.HasPrefix(filter, "scale=w='trunc(") || !strings.Contains(filter, "*iw/2)*2':h='trunc(") {
+			t.Errorf("%s: expected even dimensions, got %s", size, filter)
+		}
+		// landscape videos fit 1280x720, portrait ones 720x1280, never upscaled
+		if !strings.Contains(filter, "if(gte(iw,ih),min(1,min(1280/iw,720/ih)),min(1,min(720/iw,1280/ih)))") {
+			t.Errorf("%s: expected the size turned for portrait videos, got %s", size, filter)
+		}
+	}
+}
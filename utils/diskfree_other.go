@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+
+package utils
+
+// DiskFree returns the no. of bytes available to unprivileged users on the
+// file system containing path.
+func DiskFree(path string) (uint64, error) {
+	return 0, ErrDiskFreeUnsupported
+}
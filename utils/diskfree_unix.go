@@ -0,0 +1,17 @@
+//go:build linux || darwin || freebsd
+
+package utils
+
+import (
+	"syscall"
+)
+
+// DiskFree returns the no. of bytes available to unprivileged users on the
+// file system containing path.
+func DiskFree(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
@@ -2,6 +2,7 @@ package utils
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -11,6 +12,10 @@ import (
 	"time"
 )
 
+// ErrDiskFreeUnsupported is returned by DiskFree on platforms where the free
+// disk space can't be determined.
+var ErrDiskFreeUnsupported = errors.New("error, free disk space is not supported on this platform")
+
 // SafeParseInt64 ...
 func SafeParseInt64(s string, d int64) int64 {
 	n, err := strconv.ParseInt(s, 10, 64)
@@ -21,7 +26,16 @@ func SafeParseInt64(s string, d int64) int64 {
 }
 
 func Download(url, filename string) error {
-	res, err := http.Get(url)
+	return DownloadContext(context.Background(), url, filename)
+}
+
+// DownloadContext is Download with a context to cancel the download.
+func DownloadContext(ctx context.Context, url, filename string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return err
 	}
@@ -57,15 +71,17 @@ func CmdExists(cmd string) bool {
 
 // RunCmd ...
 func RunCmd(timeout int, command string, args ...string) error {
-	var (
-		ctx    context.Context
-		cancel context.CancelFunc
-	)
+	return RunCmdContext(context.Background(), timeout, command, args...)
+}
+
+// RunCmdContext is RunCmd with a context, cancelling it kills the command.
+func RunCmdContext(ctx context.Context, timeout int, command string, args ...string) error {
+	var cancel context.CancelFunc
 
 	if timeout > 0 {
-		ctx, cancel = context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
 	} else {
-		ctx, cancel = context.WithCancel(context.Background())
+		ctx, cancel = context.WithCancel(ctx)
 	}
 	defer cancel()
 
@@ -78,3 +94,18 @@ func RunCmd(timeout int, command string, args ...string) error {
 
 	return nil
 }
+
+// CmdOutputContext runs command like RunCmdContext and returns its combined
+// output.
+func CmdOutputContext(ctx context.Context, timeout int, command string, args ...string) ([]byte, error) {
+	var cancel context.CancelFunc
+
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	return exec.CommandContext(ctx, command, args...).CombinedOutput()
+}
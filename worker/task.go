@@ -0,0 +1,52 @@
+// Package worker runs transcodes for a tube server: it leases tasks from the
+// server's work queue over HTTP, downloads their source, runs them with a
+// local Transcoder (ffmpeg) and uploads the results back.
+package worker
+
+import (
+	"git.mills.io/prologic/tube/transcoder"
+)
+
+// Task operations, one per method of transcoder.Transcoder writing a file
+// (the server probes locally).
+const (
+	OpTranscode = "transcode"
+	OpResize    = "resize"
+	OpThumbnail = "thumbnail"
+	OpWaveform  = "waveform"
+)
+
+// Task is a transcoder call leased to a worker.
+type Task struct {
+	// Lease identifies this assignment of the task, it expires unless the
+	// worker reports progress within LeaseTimeout seconds.
+	Lease        string `json:"lease"`
+	LeaseTimeout int    `json:"lease_timeout"`
+	Attempt      int    `json:"attempt"` // 1 for the first
+
+	Op     string `json:"op"`
+	SrcExt string `json:"src_ext"` // e.g: .mov
+	DstExt string `json:"dst_ext"` // e.g: .mp4
+
+	Options  transcoder.Options `json:"options"`            // transcode and resize
+	Size     string             `json:"size,omitempty"`     // resize
+	Position int                `json:"position,omitempty"` // thumbnail
+	Timeout  int                `json:"timeout,omitempty"`  // thumbnail and waveform, in seconds
+}
+
+// LeaseRequest asks for a task.
+type LeaseRequest struct {
+	Worker string `json:"worker"`
+}
+
+// Progress is reported while running a task, extending its lease.
+type Progress struct {
+	Worker string `json:"worker"`
+	Stage  string `json:"stage"` // downloading, running or uploading
+}
+
+// Failure reports that a task failed.
+type Failure struct {
+	Worker string `json:"worker"`
+	Error  string `json:"error"`
+}
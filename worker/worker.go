@@ -0,0 +1,271 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"git.mills.io/prologic/tube/transcoder"
+)
+
+// errLeaseLost is returned when the server no longer knows a task's lease,
+// e.g: because it expired and the task was reassigned, or was cancelled.
+var errLeaseLost = errors.New("error, lease lost")
+
+// Worker leases tasks from a tube server and runs them.
+type Worker struct {
+	Server     string                // base URL of the server, e.g: https://tube.example
+	Token      string                // transcoder.workers.token of the server
+	Name       string                // reported to the server, e.g: the hostname
+	Dir        string                // for temporary files, empty for the system's
+	Poll       time.Duration         // wait between lease requests while idle
+	Transcoder transcoder.Transcoder // runs the tasks, ffmpeg if nil
+	Client     *http.Client          // http.DefaultClient if nil
+}
+
+// Run runs tasks until ctx is cancelled. Errors talking to the server are
+// logged and retried after Poll.
+func (w *Worker) Run(ctx context.Context) error {
+	log.WithField("server", w.Server).WithField("worker", w.Name).Info("worker started")
+	for {
+		task, err := w.lease(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.WithError(err).Warn("error leasing task")
+		}
+		if task != nil {
+			w.runTask(ctx, task)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			log.WithField("worker", w.Name).Info("worker stopped")
+			return nil
+		case <-time.After(w.Poll):
+		}
+	}
+}
+
+// runTask runs task, reporting progress until it's done and its result or
+// failure to the server.
+func (w *Worker) runTask(ctx context.Context, task *Task) {
+	l := log.WithField("lease", task.Lease).WithField("op", task.Op).WithField("attempt", task.Attempt)
+	l.Info("running task")
+	start := time.Now()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu    sync.Mutex
+		stage = "downloading"
+	)
+	setStage := func(s string) {
+		mu.Lock()
+		stage = s
+		mu.Unlock()
+	}
+
+	// heartbeat, cancelling the task if the lease is lost
+	heartbeat := time.Duration(task.LeaseTimeout) * time.Second / 3
+	if heartbeat < time.Second {
+		heartbeat = time.Second
+	}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(heartbeat):
+			}
+			mu.Lock()
+			p := Progress{Worker: w.Name, Stage: stage}
+			mu.Unlock()
+			err := w.call(ctx, "POST", task, "progress", jsonBody(p), nil)
+			if errors.Is(err, errLeaseLost) {
+				l.Warn("lease lost, abandoning task")
+				cancel()
+				return
+			} else if err != nil && ctx.Err() == nil {
+				l.WithError(err).Warn("error reporting progress")
+			}
+		}
+	}()
+
+	err := w.execute(ctx, task, setStage)
+	if err == nil {
+		l.WithField("duration", time.Since(start)).Info("task succeeded")
+		return
+	}
+	if errors.Is(err, errLeaseLost) {
+		return
+	}
+
+	l.WithError(err).Warn("task failed")
+	// report the failure even when stopping, so the task is reassigned
+	// without waiting for the lease to expire
+	rctx, rcancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer rcancel()
+	f := Failure{Worker: w.Name, Error: err.Error()}
+	if err := w.call(rctx, "POST", task, "fail", jsonBody(f), nil); err != nil && !errors.Is(err, errLeaseLost) {
+		l.WithError(err).Warn("error reporting task failure")
+	}
+}
+
+// execute downloads the source of task, runs it and uploads the result.
+func (w *Worker) execute(ctx context.Context, task *Task, setStage func(string)) error {
+	src, err := w.tempFile(task.SrcExt)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(src)
+	if err := w.download(ctx, task, src); err != nil {
+		return err
+	}
+
+	setStage("running")
+	tc := w.Transcoder
+	if tc == nil {
+		tc = transcoder.FFmpeg{}
+	}
+
+	dst, err := w.tempFile(task.DstExt)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dst)
+
+	switch task.Op {
+	case OpTranscode:
+		err = tc.Transcode(ctx, src, dst, task.Options)
+	case OpResize:
+		err = tc.Resize(ctx, src, dst, task.Size, task.Options)
+	case OpThumbnail:
+		err = tc.Thumbnail(ctx, src, dst, task.Position, task.Timeout)
+	case OpWaveform:
+		err = tc.Waveform(ctx, src, dst, task.Timeout)
+	default:
+		err = fmt.Errorf("error, unsupported task %q", task.Op)
+	}
+	if err != nil {
+		return err
+	}
+
+	setStage("uploading")
+	f, err := os.Open(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return w.call(ctx, "PUT", task, "result", f, nil)
+}
+
+// tempFile returns the name of a new empty temporary file with extension ext.
+func (w *Worker) tempFile(ext string) (string, error) {
+	f, err := os.CreateTemp(w.Dir, "tube-worker-*"+ext)
+	if err != nil {
+		err := fmt.Errorf("error creating temporary file: %w", err)
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// download downloads the source of task into the file fn.
+func (w *Worker) download(ctx context.Context, task *Task, fn string) error {
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := w.call(ctx, "GET", task, "source", nil, f); err != nil {
+		err := fmt.Errorf("error downloading source: %w", err)
+		return err
+	}
+	return f.Close()
+}
+
+// lease asks the server for a task, it returns nil if there is none.
+func (w *Worker) lease(ctx context.Context) (*Task, error) {
+	resp, err := w.do(ctx, "POST", "/api/worker/lease", jsonBody(LeaseRequest{Worker: w.Name}))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var task Task
+		if err := json.NewDecoder(resp.Body).Decode(&task); err != nil {
+			err := fmt.Errorf("error decoding task: %w", err)
+			return nil, err
+		}
+		return &task, nil
+	case http.StatusNoContent:
+		return nil, nil
+	}
+	return nil, statusError(resp)
+}
+
+// call sends body (if not nil) to the endpoint of the lease of task and
+// copies the response into out (if not nil).
+func (w *Worker) call(ctx context.Context, method string, task *Task, endpoint string, body io.Reader, out io.Writer) error {
+	pth := fmt.Sprintf("/api/worker/leases/%s/%s", url.PathEscape(task.Lease), endpoint)
+	resp, err := w.do(ctx, method, pth, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusGone:
+		return errLeaseLost
+	case resp.StatusCode/100 != 2:
+		return statusError(resp)
+	case out != nil:
+		_, err := io.Copy(out, resp.Body)
+		return err
+	}
+	return nil
+}
+
+// do sends an authenticated request to the server.
+func (w *Worker) do(ctx context.Context, method, pth string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(w.Server, "/")+pth, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+w.Token)
+	if _, ok := body.(*bytes.Reader); ok {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return client.Do(req)
+}
+
+// jsonBody returns v encoded as JSON.
+func jsonBody(v interface{}) *bytes.Reader {
+	data, _ := json.Marshal(v)
+	return bytes.NewReader(data)
+}
+
+// statusError returns an error for the unexpected response resp.
+func statusError(resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("error, server responded %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}